@@ -14,6 +14,8 @@ import (
 	"time"
 
 	"microsoft.com/sigbench"
+	"microsoft.com/sigbench/fakeserver"
+	"microsoft.com/sigbench/proxy"
 	"microsoft.com/sigbench/snapshot"
 	"microsoft.com/sigbench/service"
 )
@@ -32,6 +34,7 @@ func startAsMaster(agents []string, config string, outDir string) {
 
 	c := &sigbench.MasterController{
 		SnapshotWriter: snapshot.NewJsonSnapshotWriter(outDir + "/counters.txt"),
+		SummaryFile:    outDir + "/summary.json",
 	}
 
 	for _, agent := range agents {
@@ -59,7 +62,10 @@ func startAsMaster(agents []string, config string, outDir string) {
 		log.Fatalln("Fail to open config file: ", err)
 	}
 
-	c.Run(&job)
+	if err := c.Run(&job); err != nil {
+		log.Println("Job failed: ", err)
+		os.Exit(1)
+	}
 
 	// j := &sigbench.Job{
 	// 	Phases: []sigbench.JobPhase{
@@ -132,12 +138,40 @@ func startAsService(address string, outDir string) {
 	log.Fatal(http.ListenAndServe(address, mux))
 }
 
+func startAsFakeServer(address string, hostName string) {
+	log.Fatal(http.ListenAndServe(address, fakeserver.NewServer(hostName)))
+}
+
+func startAsProxy(address string, controlAddress string, target string, protocol string) {
+	if target == "" {
+		log.Fatalln("No proxy target specified")
+	}
+	if protocol != "tcp" && protocol != "websocket" {
+		log.Fatalln("Unknown proxy protocol: ", protocol)
+	}
+
+	p := proxy.NewProxy(target, protocol == "websocket")
+	go func() {
+		log.Fatal(http.ListenAndServe(controlAddress, proxy.NewControlHandler(p)))
+	}()
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal("Fail to listen:", err)
+	}
+	log.Fatal(p.Serve(l))
+}
+
 func main() {
-	var mode = flag.String("mode", "agent", "service | cli | agent")
+	var mode = flag.String("mode", "agent", "service | cli | agent | fakeserver | proxy")
 	var config = flag.String("config", "config.json", "Job config file")
 	var outDir = flag.String("outDir", "output/"+strconv.FormatInt(time.Now().Unix(), 10), "Output directory")
 	var listenAddress = flag.String("l", ":7000", "Listen address")
 	var agents = flag.String("agents", "", "Agent addresses separated by comma")
+	var hostName = flag.String("hostName", fakeserver.DefaultHostName, "Host name reported by the fake server")
+	var proxyTarget = flag.String("proxyTarget", "", "Address the proxy forwards to")
+	var proxyControl = flag.String("proxyControl", ":7001", "Listen address of the proxy control endpoint")
+	var proxyProtocol = flag.String("proxyProtocol", "tcp", "tcp | websocket")
 
 	flag.Parse()
 
@@ -151,6 +185,12 @@ func main() {
 	} else if *mode == "service" {
 		log.Println("Start as service")
 		startAsService(*listenAddress, *outDir)
+	} else if *mode == "fakeserver" {
+		log.Println("Start as fake server: ", *listenAddress)
+		startAsFakeServer(*listenAddress, *hostName)
+	} else if *mode == "proxy" {
+		log.Println("Start as proxy: ", *listenAddress, " -> ", *proxyTarget)
+		startAsProxy(*listenAddress, *proxyControl, *proxyTarget, *proxyProtocol)
 	} else {
 		log.Println("Start as agent: ", *listenAddress)
 		startAsAgent(*listenAddress)
@@ -7,10 +7,13 @@ import (
 	"time"
 
 	"github.com/teris-io/shortid"
+	"microsoft.com/sigbench/metrics"
 	"microsoft.com/sigbench/sessions"
 )
 
 type AgentController struct {
+	// Users started, completed and failed by session and phase
+	phases metrics.Registry
 }
 
 type AgentRunArgs struct {
@@ -44,7 +47,7 @@ func (c *AgentController) getSessionUsers(phase *JobPhase, percentage float64, a
 	}
 }
 
-func (c *AgentController) runPhase(job *Job, phase *JobPhase, agentCount, agentIdx int, wg *sync.WaitGroup) {
+func (c *AgentController) runPhase(job *Job, phase *JobPhase, jobStart time.Time, agentCount, agentIdx int, wg *sync.WaitGroup) {
 	for idx, sessionName := range job.SessionNames {
 		sessionUsers := c.getSessionUsers(phase, job.SessionPercentages[idx], agentCount, agentIdx)
 		log.Println(fmt.Sprintf("Session %s users: %d", sessionName, sessionUsers))
@@ -56,6 +59,7 @@ func (c *AgentController) runPhase(job *Job, phase *JobPhase, agentCount, agentI
 			log.Fatalln("Session not found: " + sessionName)
 		}
 
+		labels := metrics.Labels{metrics.LabelSession: sessionName, metrics.LabelPhase: phase.Name}
 		for i := int64(0); i < sessionUsers; i++ {
 			wg.Add(1)
 			go func(session sessions.Session) {
@@ -69,14 +73,23 @@ func (c *AgentController) runPhase(job *Job, phase *JobPhase, agentCount, agentI
 				}
 
 				ctx := &sessions.UserContext{
-					UserId: uid,
-					Phase:  phase.Name,
-					Params: job.SessionParams,
-				}
+					UserId:   uid,
+					Phase:    phase.Name,
+					JobStart: jobStart,
+					Params:   job.SessionParams,
 
-				// TODO: Check error
-				session.Execute(ctx)
+					AgentIdx:   agentIdx,
+					AgentCount: agentCount,
+				}
 
+				c.phases.Counter("users:started", labels).Inc()
+				start := time.Now()
+				if err := session.Execute(ctx); err != nil {
+					c.phases.Counter("users:failed", labels).Inc()
+				} else {
+					c.phases.Counter("users:completed", labels).Inc()
+				}
+				c.phases.Histogram("users:duration", labels, 1000, 10000, 60000, 300000).Observe(int64(time.Now().Sub(start) / time.Millisecond))
 			}(session)
 		}
 	}
@@ -88,6 +101,7 @@ func (c *AgentController) runPhase(job *Job, phase *JobPhase, agentCount, agentI
 func (c *AgentController) Run(args *AgentRunArgs, result *AgentRunResult) error {
 	log.Println("Start run: ", args)
 	var wg sync.WaitGroup
+	jobStart := time.Now()
 
 	for _, phase := range args.Job.Phases {
 		log.Println("Phase: ", phase)
@@ -101,7 +115,7 @@ func (c *AgentController) Run(args *AgentRunArgs, result *AgentRunResult) error
 			}
 
 			wg.Add(1)
-			go c.runPhase(&args.Job, &phase, args.AgentCount, args.AgentIdx, &wg)
+			go c.runPhase(&args.Job, &phase, jobStart, args.AgentCount, args.AgentIdx, &wg)
 
 			if phase.Duration-now.Sub(start) <= 0 {
 				ticker.Stop()
@@ -125,6 +139,7 @@ type AgentSetupResult struct {
 }
 
 func (c *AgentController) Setup(args *AgentSetupArgs, result *AgentSetupResult) error {
+	c.phases.Reset()
 	for _, session := range sessions.SessionMap {
 		if err := session.Setup(args.SessionParams); err != nil {
 			return err
@@ -140,6 +155,7 @@ type AgentListCountersArgs struct {
 
 type AgentListCountersResult struct {
 	Counters map[string]int64
+	Metrics  []metrics.Sample
 }
 
 func (c *AgentController) ListCounters(args *AgentListCountersArgs, result *AgentListCountersResult) error {
@@ -150,6 +166,19 @@ func (c *AgentController) ListCounters(args *AgentListCountersArgs, result *Agen
 			for k, v := range counters {
 				result.Counters[k] = result.Counters[k] + v
 			}
+			if metricsSession, ok := session.(sessions.MetricsSession); ok {
+				result.Metrics = append(result.Metrics, metrics.WithLabel(metricsSession.Metrics(), metrics.LabelSession, sessionName)...)
+			}
+		}
+	}
+
+	sessionNames := make(map[string]bool)
+	for _, sessionName := range args.SessionNames {
+		sessionNames[sessionName] = true
+	}
+	for _, sample := range c.phases.Samples() {
+		if sessionNames[sample.Labels[metrics.LabelSession]] {
+			result.Metrics = append(result.Metrics, sample)
 		}
 	}
 	return nil
@@ -1,6 +1,13 @@
 package sigbench
 
-import "testing"
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"microsoft.com/sigbench/metrics"
+	"microsoft.com/sigbench/sessions"
+)
 
 func TestGetSessionUsers(t *testing.T) {
 	c := &AgentController{}
@@ -48,3 +55,31 @@ func TestGetSessionUsers(t *testing.T) {
 		}
 	})
 }
+
+func TestRunPhaseMetrics(t *testing.T) {
+	sessions.SessionMap["dummy"] = &sessions.DummySession{}
+	defer delete(sessions.SessionMap, "dummy")
+
+	c := &AgentController{}
+	job := &Job{SessionNames: []string{"dummy"}, SessionPercentages: []float64{1}}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	c.runPhase(job, &JobPhase{Name: "ramp", UsersPerSecond: 3}, time.Now(), 1, 0, &wg)
+	wg.Wait()
+
+	var result AgentListCountersResult
+	if err := c.ListCounters(&AgentListCountersArgs{SessionNames: job.SessionNames}, &result); err != nil {
+		t.Fatal(err)
+	}
+	counters := metrics.Flatten(result.Metrics)
+	if counters["users:started{phase=ramp,session=dummy}"] != 3 || counters["users:completed{phase=ramp,session=dummy}"] != 3 ||
+		counters["users:failed{phase=ramp,session=dummy}"] != 0 || counters["users:duration{phase=ramp,session=dummy}:<1000"] != 3 {
+		t.Fatal("Unexpected phase counters", counters)
+	}
+
+	result = AgentListCountersResult{}
+	c.ListCounters(&AgentListCountersArgs{SessionNames: []string{"other"}}, &result)
+	if len(result.Metrics) != 0 {
+		t.Fatal("Expect no metrics of other sessions but got", result.Metrics)
+	}
+}
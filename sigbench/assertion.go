@@ -0,0 +1,260 @@
+package sigbench
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"microsoft.com/sigbench/metrics"
+)
+
+// Assertion checks a metric computed from the collected counters against a
+// threshold, e.g. that the error rate stays below 0.1%:
+//
+//	{"Metric": "signalrcore:broadcast:error / signalrcore:broadcast:success + signalrcore:broadcast:error", "Op": "<", "Value": 0.001}
+//
+// Metric is a counter name, a sum of counters joined by "+", or a ratio of two
+// such sums joined by "/". pNN(prefix) is the NNth percentile of the latency
+// histogram written under prefix, as the upper bound of its bucket.
+//
+// Without Phase the metric is computed from the counters at the end of the
+// job. With Phase it is computed from how much the counters grew during that
+// phase, so phase assertions are meant for cumulative counters like errors,
+// messages and latency buckets.
+type Assertion struct {
+	Name   string `json:",omitempty"`
+	Metric string
+	Op     string
+	Value  float64
+	Phase  string `json:",omitempty"`
+}
+
+type AssertionResult struct {
+	Assertion
+	Actual float64
+	Passed bool
+	Error  string `json:",omitempty"`
+}
+
+// JobSummary is the outcome of a job written to the output directory.
+type JobSummary struct {
+	Passed       bool
+	DurationSecs int64
+	Assertions   []AssertionResult
+	Search       *CapacitySearchResult `json:",omitempty"`
+	Backends     []BackendDistribution `json:",omitempty"`
+	Counters     map[string]int64
+	Phases       map[string]map[string]int64 `json:",omitempty"`
+	Metrics      []metrics.Sample            `json:",omitempty"`
+}
+
+// MarshalJSON writes an infinite actual value as a string, since JSON has no
+// representation for it.
+func (r AssertionResult) MarshalJSON() ([]byte, error) {
+	type plain AssertionResult
+	if !math.IsInf(r.Actual, 0) && !math.IsNaN(r.Actual) {
+		return json.Marshal(plain(r))
+	}
+	return json.Marshal(struct {
+		plain
+		Actual string
+	}{plain(r), strconv.FormatFloat(r.Actual, 'g', -1, 64)})
+}
+
+var ErrAssertionsFailed = errors.New("job assertions failed")
+
+var percentileExpr = regexp.MustCompile(`^p(\d+(?:\.\d+)?)\((.+)\)$`)
+
+func (a *Assertion) String() string {
+	s := a.Metric + " " + a.Op + " " + strconv.FormatFloat(a.Value, 'g', -1, 64)
+	if a.Phase != "" {
+		s += " during " + a.Phase
+	}
+	if a.Name != "" {
+		s = a.Name + ": " + s
+	}
+	return s
+}
+
+// Validate checks the assertion can be evaluated for the phases of job.
+func (a *Assertion) Validate(job *Job) error {
+	switch a.Op {
+	case "<", "<=", ">", ">=", "==":
+	default:
+		return fmt.Errorf("unknown operator %q in assertion %s", a.Op, a)
+	}
+	if _, err := evalMetric(a.Metric, map[string]int64{}); err != nil {
+		return fmt.Errorf("invalid metric in assertion %s: %s", a, err)
+	}
+	if a.Phase != "" {
+		for _, phase := range job.Phases {
+			if phase.Name == a.Phase {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown phase in assertion %s", a)
+	}
+	return nil
+}
+
+// Evaluate checks the assertion against counters.
+func (a *Assertion) Evaluate(counters map[string]int64) AssertionResult {
+	result := AssertionResult{Assertion: *a}
+	actual, err := evalMetric(a.Metric, counters)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if math.IsNaN(actual) {
+		result.Error = "no samples"
+		return result
+	}
+	result.Actual = actual
+
+	switch a.Op {
+	case "<":
+		result.Passed = actual < a.Value
+	case "<=":
+		result.Passed = actual <= a.Value
+	case ">":
+		result.Passed = actual > a.Value
+	case ">=":
+		result.Passed = actual >= a.Value
+	case "==":
+		result.Passed = actual == a.Value
+	}
+	return result
+}
+
+// gaugeSuffixes end the names of counters which hold a current value, like
+// the users connected right now, rather than a running total.
+var gaugeSuffixes = []string{
+	":connected",
+	":inprogress",
+	":outstanding",
+	":entries:pending",
+	":sendrate:target",
+	":sendrate:target:milli",
+	":sendrate:measured",
+}
+
+func isGauge(name string) bool {
+	for _, suffix := range gaugeSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// counterDelta returns how much each counter grew from start to end. Gauges
+// keep their value at the end, since their growth means nothing.
+func counterDelta(start, end map[string]int64) map[string]int64 {
+	delta := make(map[string]int64, len(end))
+	for k, v := range end {
+		if isGauge(k) {
+			delta[k] = v
+		} else {
+			delta[k] = v - start[k]
+		}
+	}
+	return delta
+}
+
+func evalMetric(expr string, counters map[string]int64) (float64, error) {
+	parts := strings.Split(expr, "/")
+	if len(parts) > 2 {
+		return 0, errors.New("at most one division is supported")
+	}
+
+	numerator, err := evalSum(parts[0], counters)
+	if err != nil || len(parts) == 1 {
+		return numerator, err
+	}
+	denominator, err := evalSum(parts[1], counters)
+	if err != nil {
+		return 0, err
+	}
+	if denominator == 0 {
+		if numerator == 0 {
+			return 0, nil
+		}
+		return math.Inf(1), nil
+	}
+	return numerator / denominator, nil
+}
+
+func evalSum(expr string, counters map[string]int64) (float64, error) {
+	sum := float64(0)
+	for _, operand := range strings.Split(expr, "+") {
+		operand = strings.TrimSpace(operand)
+		if operand == "" {
+			return 0, errors.New("empty operand")
+		}
+		if m := percentileExpr.FindStringSubmatch(operand); m != nil {
+			p, err := strconv.ParseFloat(m[1], 64)
+			if err != nil || p <= 0 || p > 100 {
+				return 0, fmt.Errorf("invalid percentile %s", m[1])
+			}
+			sum += histogramPercentile(counters, strings.TrimSpace(m[2]), p)
+			continue
+		}
+		sum += float64(counters[operand])
+	}
+	return sum, nil
+}
+
+// histogramPercentile returns the upper bound of the bucket of the
+// histogram under prefix which holds the pth percentile. It is +Inf for the
+// overflow bucket and NaN for an empty histogram.
+func histogramPercentile(counters map[string]int64, prefix string, p float64) float64 {
+	type bucket struct {
+		bound float64
+		count int64
+	}
+	var buckets []bucket
+	total := int64(0)
+	for k, v := range counters {
+		if !strings.HasPrefix(k, prefix+":") {
+			continue
+		}
+		suffix := k[len(prefix)+1:]
+		switch {
+		case strings.HasPrefix(suffix, ">="):
+			if _, err := strconv.ParseInt(suffix[2:], 10, 64); err != nil {
+				continue
+			}
+			buckets = append(buckets, bucket{math.Inf(1), v})
+		case strings.HasPrefix(suffix, "<"):
+			bound, err := strconv.ParseInt(suffix[1:], 10, 64)
+			if err != nil {
+				continue
+			}
+			buckets = append(buckets, bucket{float64(bound), v})
+		default:
+			continue
+		}
+		total += v
+	}
+	if total == 0 {
+		return math.NaN()
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].bound < buckets[j].bound
+	})
+	target := p / 100 * float64(total)
+	cumulative := int64(0)
+	for _, b := range buckets {
+		cumulative += b.count
+		if float64(cumulative) >= target {
+			return b.bound
+		}
+	}
+	return math.Inf(1)
+}
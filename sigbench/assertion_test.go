@@ -0,0 +1,104 @@
+package sigbench
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestEvalMetric(t *testing.T) {
+	counters := map[string]int64{
+		"s:error":         2,
+		"s:success":       998,
+		"s:latency:<100":  90,
+		"s:latency:<200":  9,
+		"s:latency:>=200": 1,
+	}
+
+	cases := []struct {
+		expr     string
+		expected float64
+	}{
+		{"s:success", 998},
+		{"s:missing", 0},
+		{"s:error + s:success", 1000},
+		{"s:error / s:error + s:success", 0.002},
+		{"s:missing / s:missing", 0},
+		{"p50(s:latency)", 100},
+		{"p99(s:latency)", 200},
+		{"p99.5(s:latency)", math.Inf(1)},
+	}
+	for _, c := range cases {
+		actual, err := evalMetric(c.expr, counters)
+		if err != nil {
+			t.Fatal(c.expr, err)
+		}
+		if actual != c.expected {
+			t.Fatal(c.expr, "should be", c.expected, "but", actual)
+		}
+	}
+
+	if actual, _ := evalMetric("p99(s:empty)", counters); !math.IsNaN(actual) {
+		t.Fatal("Percentile without samples should be NaN but", actual)
+	}
+	for _, expr := range []string{"a / b / c", "a + ", "p0(s:latency)"} {
+		if _, err := evalMetric(expr, counters); err == nil {
+			t.Fatal("Expect error for", expr)
+		}
+	}
+}
+
+func TestAssertionEvaluate(t *testing.T) {
+	counters := map[string]int64{"connected": 10}
+
+	if result := (&Assertion{Metric: "connected", Op: ">=", Value: 10}).Evaluate(counters); !result.Passed {
+		t.Fatal("Expect pass but", result)
+	}
+	if result := (&Assertion{Metric: "connected", Op: "<", Value: 10}).Evaluate(counters); result.Passed || result.Actual != 10 {
+		t.Fatal("Expect fail with actual 10 but", result)
+	}
+	if result := (&Assertion{Metric: "p99(latency)", Op: "<", Value: 200}).Evaluate(counters); result.Passed || result.Error == "" {
+		t.Fatal("Expect fail without samples but", result)
+	}
+}
+
+func TestAssertionValidate(t *testing.T) {
+	job := &Job{Phases: []JobPhase{{Name: "Peak"}}}
+
+	if err := (&Assertion{Metric: "a", Op: "<", Value: 1, Phase: "Peak"}).Validate(job); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Assertion{Metric: "a", Op: "!=", Value: 1}).Validate(job); err == nil {
+		t.Fatal("Expect error for unknown operator")
+	}
+	if err := (&Assertion{Metric: "a", Op: "<", Value: 1, Phase: "Warmup"}).Validate(job); err == nil {
+		t.Fatal("Expect error for unknown phase")
+	}
+}
+
+func TestCounterDelta(t *testing.T) {
+	delta := counterDelta(map[string]int64{"a": 3, "b": 1}, map[string]int64{"a": 5, "b": 1, "c": 2})
+	if delta["a"] != 2 || delta["b"] != 0 || delta["c"] != 2 {
+		t.Fatal("Unexpected delta", delta)
+	}
+	// Gauges are taken at the end of the phase
+	delta = counterDelta(
+		map[string]int64{"ws:connected": 800, "ws:success": 10},
+		map[string]int64{"ws:connected": 1000, "ws:success": 30},
+	)
+	if delta["ws:connected"] != 1000 || delta["ws:success"] != 20 {
+		t.Fatal("Unexpected delta of gauge", delta)
+	}
+}
+
+func TestAssertionResultJSON(t *testing.T) {
+	result := AssertionResult{Assertion: Assertion{Metric: "p99(latency)", Op: "<", Value: 200}, Actual: math.Inf(1)}
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"Actual":"+Inf"`) || !strings.Contains(string(data), `"Metric":"p99(latency)"`) {
+		t.Fatal("Unexpected JSON", string(data))
+	}
+}
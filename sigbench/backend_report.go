@@ -0,0 +1,98 @@
+package sigbench
+
+import (
+	"log"
+	"math"
+	"sort"
+
+	"microsoft.com/sigbench/metrics"
+	"microsoft.com/sigbench/sessions"
+)
+
+// BackendDistribution is how the connections of a session spread over the
+// backend instances, to verify that a load balancer is fair.
+type BackendDistribution struct {
+	Session      string
+	Instances    map[string]int64
+	Unidentified int64 `json:",omitempty"`
+	Total        int64
+	Min          int64
+	Max          int64
+
+	// Imbalance is the highest count over the mean count, 1 if perfectly
+	// balanced.
+	Imbalance float64
+
+	// Deviation is the standard deviation of the counts over the mean count.
+	Deviation float64
+}
+
+// backendDistributions collects the backend metrics of the sessions into a
+// distribution for each session.
+func backendDistributions(samples []metrics.Sample) []BackendDistribution {
+	bySession := make(map[string]*BackendDistribution)
+	get := func(session string) *BackendDistribution {
+		d, ok := bySession[session]
+		if !ok {
+			d = &BackendDistribution{Session: session, Instances: make(map[string]int64)}
+			bySession[session] = d
+		}
+		return d
+	}
+	for _, s := range samples {
+		switch s.Name {
+		case "backend:connections":
+			get(s.Labels[metrics.LabelSession]).Instances[s.Labels[sessions.LabelInstance]] += s.Value
+		case "backend:unidentified":
+			get(s.Labels[metrics.LabelSession]).Unidentified += s.Value
+		}
+	}
+
+	distributions := make([]BackendDistribution, 0, len(bySession))
+	for _, d := range bySession {
+		if len(d.Instances) > 0 {
+			d.Min = math.MaxInt64
+		}
+		for _, cnt := range d.Instances {
+			d.Total += cnt
+			if cnt < d.Min {
+				d.Min = cnt
+			}
+			if cnt > d.Max {
+				d.Max = cnt
+			}
+		}
+		if d.Total > 0 {
+			mean := float64(d.Total) / float64(len(d.Instances))
+			variance := float64(0)
+			for _, cnt := range d.Instances {
+				variance += (float64(cnt) - mean) * (float64(cnt) - mean)
+			}
+			variance /= float64(len(d.Instances))
+			d.Imbalance = float64(d.Max) / mean
+			d.Deviation = math.Sqrt(variance) / mean
+		}
+		distributions = append(distributions, *d)
+	}
+	sort.Slice(distributions, func(i, j int) bool {
+		return distributions[i].Session < distributions[j].Session
+	})
+	return distributions
+}
+
+func printBackendDistributions(distributions []BackendDistribution) {
+	for _, d := range distributions {
+		log.Printf("Backends of %s: %d instances, min %d, max %d, imbalance %.2f, deviation %.2f, unidentified %d",
+			d.Session, len(d.Instances), d.Min, d.Max, d.Imbalance, d.Deviation, d.Unidentified)
+
+		instances := make([]string, 0, len(d.Instances))
+		for instance := range d.Instances {
+			instances = append(instances, instance)
+		}
+		sort.Strings(instances)
+		for _, instance := range instances {
+			cnt := d.Instances[instance]
+			log.Printf("     %s: %d (%.1f%%)", instance, cnt, float64(cnt)*100/float64(d.Total))
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package sigbench
+
+import (
+	"testing"
+
+	"microsoft.com/sigbench/metrics"
+)
+
+func TestBackendDistributions(t *testing.T) {
+	connections := func(session, instance string, v int64) metrics.Sample {
+		return metrics.Sample{
+			Name:   "backend:connections",
+			Kind:   metrics.KindCounter,
+			Labels: metrics.Labels{metrics.LabelSession: session, "instance": instance},
+			Value:  v,
+		}
+	}
+	unidentified := func(session string, v int64) metrics.Sample {
+		return metrics.Sample{
+			Name:   "backend:unidentified",
+			Kind:   metrics.KindCounter,
+			Labels: metrics.Labels{metrics.LabelSession: session},
+			Value:  v,
+		}
+	}
+	distributions := backendDistributions([]metrics.Sample{
+		connections("signalrcore:echo", "a", 2),
+		connections("signalrcore:echo", "b", 4),
+		connections("signalrcore:echo", "c:5000", 6),
+		unidentified("signalrcore:echo", 1),
+		unidentified("signalrfx:broadcast:sender", 3),
+		connections("signalrcore:broadcast:sender", "x", 5),
+		{Name: "host:users", Kind: metrics.KindCounter, Labels: metrics.Labels{metrics.LabelSession: "signalrcore:echo"}, Value: 9},
+	})
+	if len(distributions) != 3 {
+		t.Fatal("Expect 3 distributions but got", distributions)
+	}
+
+	d := distributions[1]
+	if d.Session != "signalrcore:echo" || len(d.Instances) != 3 || d.Instances["c:5000"] != 6 || d.Unidentified != 1 {
+		t.Fatal("Unexpected distribution", d)
+	}
+	if d.Total != 12 || d.Min != 2 || d.Max != 6 || d.Imbalance != 1.5 {
+		t.Fatal("Unexpected statistics", d)
+	}
+
+	if d := distributions[0]; d.Session != "signalrcore:broadcast:sender" || d.Imbalance != 1 || d.Deviation != 0 {
+		t.Fatal("Expect a balanced distribution but got", d)
+	}
+	if d := distributions[2]; d.Session != "signalrfx:broadcast:sender" || d.Total != 0 || d.Unidentified != 3 {
+		t.Fatal("Expect only unidentified connections but got", d)
+	}
+}
@@ -0,0 +1,153 @@
+package sigbench
+
+import (
+	"errors"
+	"time"
+)
+
+// CapacitySearch replaces the phases of a job with successive short steps to
+// find the highest users per second which still meet the criteria. The rate
+// doubles from MinUsersPerSecond until a step fails, then the search bisects
+// between the highest passing and the lowest failing rate.
+type CapacitySearch struct {
+	MinUsersPerSecond int64
+
+	// MaxUsersPerSecond bounds the search, 0 means no bound.
+	MaxUsersPerSecond int64 `json:",omitempty"`
+
+	// Precision stops the search once the passing and failing rates are at
+	// most that far apart. Defaults to 1.
+	Precision int64 `json:",omitempty"`
+
+	// MaxSteps bounds the number of steps. Defaults to 10.
+	MaxSteps int `json:",omitempty"`
+
+	StepDuration time.Duration
+
+	// Criteria are evaluated over the counters of each step and must all
+	// pass for the rate to be sustainable.
+	Criteria []Assertion
+
+	// ConcurrencyMetric is sampled every second during each step, e.g. the
+	// connected counter of a session, to report the peak concurrent
+	// connections along with the rate.
+	ConcurrencyMetric string `json:",omitempty"`
+}
+
+type CapacitySearchStep struct {
+	UsersPerSecond  int64
+	Passed          bool
+	PeakConcurrency float64 `json:",omitempty"`
+	Criteria        []AssertionResult
+}
+
+// CapacitySearchResult is the highest sustainable rate, 0 if even the
+// minimum failed, and the steps explored to find it.
+type CapacitySearchResult struct {
+	UsersPerSecond  int64
+	PeakConcurrency float64 `json:",omitempty"`
+	Steps           []CapacitySearchStep
+}
+
+func (s *CapacitySearch) Validate() error {
+	if s.MinUsersPerSecond <= 0 {
+		return errors.New("MinUsersPerSecond of capacity search must be positive")
+	}
+	if s.MaxUsersPerSecond != 0 && s.MaxUsersPerSecond < s.MinUsersPerSecond {
+		return errors.New("MaxUsersPerSecond of capacity search is below MinUsersPerSecond")
+	}
+	if s.StepDuration <= 0 {
+		return errors.New("StepDuration of capacity search must be positive")
+	}
+	if len(s.Criteria) == 0 {
+		return errors.New("capacity search requires criteria")
+	}
+	for _, criterion := range s.Criteria {
+		// Steps have no named phases to refer to
+		if err := criterion.Validate(&Job{}); err != nil {
+			return err
+		}
+	}
+	if s.ConcurrencyMetric != "" {
+		if _, err := evalMetric(s.ConcurrencyMetric, map[string]int64{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// capacitySearchState tracks the highest passing and the lowest failing rate
+// to pick the rate of the next step.
+type capacitySearchState struct {
+	search  *CapacitySearch
+	steps   int
+	passing int64
+	failing int64
+}
+
+func newCapacitySearchState(search *CapacitySearch) *capacitySearchState {
+	return &capacitySearchState{search: search}
+}
+
+// next returns the rate of the next step, or false once the search converged.
+func (s *capacitySearchState) next() (int64, bool) {
+	maxSteps := s.search.MaxSteps
+	if maxSteps <= 0 {
+		maxSteps = 10
+	}
+	precision := s.search.Precision
+	if precision <= 0 {
+		precision = 1
+	}
+
+	if s.steps >= maxSteps {
+		return 0, false
+	}
+	if s.passing == 0 {
+		if s.failing != 0 {
+			return 0, false
+		}
+		return s.search.MinUsersPerSecond, true
+	}
+	if s.failing == 0 {
+		if s.passing == s.search.MaxUsersPerSecond {
+			return 0, false
+		}
+		rate := s.passing * 2
+		if s.search.MaxUsersPerSecond != 0 && rate > s.search.MaxUsersPerSecond {
+			rate = s.search.MaxUsersPerSecond
+		}
+		return rate, true
+	}
+	if s.failing-s.passing <= precision {
+		return 0, false
+	}
+	return (s.passing + s.failing) / 2, true
+}
+
+func (s *capacitySearchState) record(rate int64, passed bool) {
+	s.steps++
+	if passed {
+		if rate > s.passing {
+			s.passing = rate
+		}
+	} else if s.failing == 0 || rate < s.failing {
+		s.failing = rate
+	}
+}
+
+// evaluateStep checks the criteria against the counters gathered during a
+// step.
+func (s *CapacitySearch) evaluateStep(rate int64, counters map[string]int64, peakConcurrency float64) CapacitySearchStep {
+	step := CapacitySearchStep{
+		UsersPerSecond:  rate,
+		Passed:          true,
+		PeakConcurrency: peakConcurrency,
+	}
+	for _, criterion := range s.Criteria {
+		result := criterion.Evaluate(counters)
+		step.Passed = step.Passed && result.Passed
+		step.Criteria = append(step.Criteria, result)
+	}
+	return step
+}
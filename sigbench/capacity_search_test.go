@@ -0,0 +1,100 @@
+package sigbench
+
+import "testing"
+
+// explore runs a capacity search against a system which sustains up to
+// capacity users per second and returns the rates of the steps.
+func explore(search *CapacitySearch, capacity int64) ([]int64, int64) {
+	state := newCapacitySearchState(search)
+	var rates []int64
+	for rate, ok := state.next(); ok; rate, ok = state.next() {
+		rates = append(rates, rate)
+		state.record(rate, rate <= capacity)
+	}
+	return rates, state.passing
+}
+
+func TestCapacitySearch(t *testing.T) {
+	t.Run("Doubles then bisects", func(t *testing.T) {
+		rates, result := explore(&CapacitySearch{MinUsersPerSecond: 10, MaxSteps: 20}, 55)
+		expected := []int64{10, 20, 40, 80, 60, 50, 55, 57, 56}
+		if len(rates) != len(expected) {
+			t.Fatal("Unexpected steps", rates)
+		}
+		for i := range expected {
+			if rates[i] != expected[i] {
+				t.Fatal("Unexpected steps", rates)
+			}
+		}
+		if result != 55 {
+			t.Fatal("Capacity should be 55 but", result)
+		}
+	})
+
+	t.Run("Precision", func(t *testing.T) {
+		rates, result := explore(&CapacitySearch{MinUsersPerSecond: 10, Precision: 10}, 55)
+		if len(rates) != 6 || result != 50 {
+			t.Fatal("Unexpected steps", rates, "with result", result)
+		}
+	})
+
+	t.Run("Max", func(t *testing.T) {
+		rates, result := explore(&CapacitySearch{MinUsersPerSecond: 10, MaxUsersPerSecond: 30}, 100)
+		if len(rates) != 3 || rates[2] != 30 || result != 30 {
+			t.Fatal("Unexpected steps", rates, "with result", result)
+		}
+	})
+
+	t.Run("Min fails", func(t *testing.T) {
+		rates, result := explore(&CapacitySearch{MinUsersPerSecond: 10}, 5)
+		if len(rates) != 1 || result != 0 {
+			t.Fatal("Unexpected steps", rates, "with result", result)
+		}
+	})
+
+	t.Run("Max steps", func(t *testing.T) {
+		rates, _ := explore(&CapacitySearch{MinUsersPerSecond: 1, MaxSteps: 4}, 1000)
+		if len(rates) != 4 {
+			t.Fatal("Unexpected steps", rates)
+		}
+	})
+}
+
+func TestCapacitySearchEvaluateStep(t *testing.T) {
+	search := &CapacitySearch{
+		Criteria: []Assertion{
+			{Metric: "error / success + error", Op: "<", Value: 0.01},
+			{Metric: "success", Op: ">", Value: 0},
+		},
+	}
+
+	if step := search.evaluateStep(10, map[string]int64{"success": 100}, 0); !step.Passed || len(step.Criteria) != 2 {
+		t.Fatal("Expect pass but", step)
+	}
+	if step := search.evaluateStep(10, map[string]int64{"success": 90, "error": 10}, 0); step.Passed {
+		t.Fatal("Expect fail but", step)
+	}
+}
+
+func TestCapacitySearchValidate(t *testing.T) {
+	valid := CapacitySearch{
+		MinUsersPerSecond: 10,
+		StepDuration:      1,
+		Criteria:          []Assertion{{Metric: "error", Op: "==", Value: 0}},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := valid
+	invalid.MaxUsersPerSecond = 5
+	if err := invalid.Validate(); err == nil {
+		t.Fatal("Expect error for max below min")
+	}
+
+	invalid = valid
+	invalid.Criteria = []Assertion{{Metric: "error", Op: "==", Value: 0, Phase: "peak"}}
+	if err := invalid.Validate(); err == nil {
+		t.Fatal("Expect error for criteria with phase")
+	}
+}
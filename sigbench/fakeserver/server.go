@@ -0,0 +1,12 @@
+package fakeserver
+
+import "net/http"
+
+// NewServer serves the SignalR Core chat hub at /chat and the classic SignalR
+// one at /signalr, both reporting hostName in X-HostName.
+func NewServer(hostName string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/chat", NewSignalRCoreServer(hostName))
+	mux.Handle("/signalr/", NewSignalRFxServer(hostName))
+	return mux
+}
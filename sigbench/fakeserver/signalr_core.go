@@ -0,0 +1,360 @@
+// Package fakeserver provides in-process stand-ins for the SignalR servers the
+// sessions benchmark, so that sessions can be run locally and tested without
+// a .NET server.
+package fakeserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const signalRCoreTerminator = '\x1e'
+
+const (
+	signalRCoreTypeInvocation       = 1
+	signalRCoreTypeStreamItem       = 2
+	signalRCoreTypeCompletion       = 3
+	signalRCoreTypeStreamInvocation = 4
+	signalRCoreTypeCancelInvocation = 5
+	signalRCoreTypePing             = 6
+	signalRCoreTypeClose            = 7
+)
+
+// DefaultHostName is reported in X-HostName. It ends with a VMSS instance id
+// like the hosts of the real deployments.
+const DefaultHostName = "fakeserver000000"
+
+type signalRCoreMessage struct {
+	Type         int               `json:"type"`
+	InvocationId string            `json:"invocationId,omitempty"`
+	Target       string            `json:"target,omitempty"`
+	Arguments    []json.RawMessage `json:"arguments,omitempty"`
+	StreamIds    []string          `json:"streamIds,omitempty"`
+}
+
+type signalRCoreClient struct {
+	wsClient
+
+	// Cancel channels of the running server-to-client streams
+	streamsLock sync.Mutex
+	streams     map[string]chan struct{}
+
+	// Invocation ids and item counts of the client-to-server streams, only
+	// touched by the reader
+	uploads     map[string]string
+	uploadItems map[string]int
+}
+
+func (c *signalRCoreClient) write(msg interface{}) error {
+	return c.writeJSON(msg, signalRCoreTerminator)
+}
+
+// SignalRCoreServer implements the chat hub of the SignalR Core samples:
+// negotiate on OPTIONS /chat, the websocket transport with the JSON protocol
+// and the echo, send and broadcastMessage hub methods. The disconnect hub
+// method drops the connection without completing the invocation. Counter
+// streams count items to the client and UploadStream counts the items
+// streamed by the client.
+type SignalRCoreServer struct {
+	HostName string
+
+	// StreamCompletions is how many times the completion of a stream is
+	// sent, once if zero.
+	StreamCompletions int
+
+	upgrader websocket.Upgrader
+	nextId   int64
+	lock     sync.RWMutex
+	clients  map[*signalRCoreClient]struct{}
+	mux      *http.ServeMux
+}
+
+func NewSignalRCoreServer(hostName string) *SignalRCoreServer {
+	if hostName == "" {
+		hostName = DefaultHostName
+	}
+	s := &SignalRCoreServer{
+		HostName: hostName,
+		clients:  make(map[*signalRCoreClient]struct{}),
+		mux:      http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/chat", s.handleChat)
+	return s
+}
+
+func (s *SignalRCoreServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("X-HostName", s.HostName)
+	s.mux.ServeHTTP(w, req)
+}
+
+// Clients returns the number of connected clients.
+func (s *SignalRCoreServer) Clients() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.clients)
+}
+
+func (s *SignalRCoreServer) handleChat(w http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.Method == http.MethodOptions || req.Method == http.MethodPost && req.URL.Query().Get("id") == "":
+		s.handleNegotiate(w, req)
+	case websocket.IsWebSocketUpgrade(req):
+		s.handleWebsocket(w, req)
+	default:
+		http.Error(w, "unsupported transport", http.StatusBadRequest)
+	}
+}
+
+func (s *SignalRCoreServer) handleNegotiate(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"connectionId":        strconv.FormatInt(atomic.AddInt64(&s.nextId, 1), 10),
+		"availableTransports": []string{"WebSockets"},
+	})
+}
+
+func (s *SignalRCoreServer) handleWebsocket(w http.ResponseWriter, req *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		log.Println("Fail to upgrade websocket: ", err)
+		return
+	}
+	c := &signalRCoreClient{
+		wsClient:    wsClient{conn: conn},
+		streams:     make(map[string]chan struct{}),
+		uploads:     make(map[string]string),
+		uploadItems: make(map[string]int),
+	}
+	defer c.cancelStreams()
+	defer conn.Close()
+	defer func() {
+		s.lock.Lock()
+		delete(s.clients, c)
+		s.lock.Unlock()
+	}()
+
+	handshaked := false
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		for len(data) > 0 {
+			idx := bytes.IndexByte(data, signalRCoreTerminator)
+			if idx < 0 {
+				return
+			}
+			frame := data[:idx]
+			data = data[idx+1:]
+
+			if !handshaked {
+				if err = s.handshake(c, frame); err != nil {
+					return
+				}
+				handshaked = true
+				continue
+			}
+			if !s.dispatch(c, frame) {
+				return
+			}
+		}
+	}
+}
+
+func (s *SignalRCoreServer) handshake(c *signalRCoreClient, frame []byte) error {
+	var req struct {
+		Protocol string `json:"protocol"`
+		Version  int    `json:"version"`
+	}
+	resp := map[string]string{}
+	if err := json.Unmarshal(frame, &req); err != nil {
+		resp["error"] = "invalid handshake: " + err.Error()
+	} else if req.Protocol != "json" {
+		resp["error"] = "unsupported protocol: " + req.Protocol
+	}
+	if err := c.write(resp); err != nil {
+		return err
+	}
+	if msg, ok := resp["error"]; ok {
+		return errors.New(msg)
+	}
+
+	s.lock.Lock()
+	s.clients[c] = struct{}{}
+	s.lock.Unlock()
+	return nil
+}
+
+// dispatch handles a frame after the handshake. It returns false once the
+// connection should be closed.
+func (s *SignalRCoreServer) dispatch(c *signalRCoreClient, frame []byte) bool {
+	var msg signalRCoreMessage
+	if err := json.Unmarshal(frame, &msg); err != nil {
+		c.write(map[string]interface{}{"type": signalRCoreTypeClose, "error": "invalid message"})
+		return false
+	}
+
+	switch msg.Type {
+	case signalRCoreTypePing:
+		return true
+	case signalRCoreTypeClose:
+		return false
+	case signalRCoreTypeStreamInvocation:
+		s.stream(c, &msg)
+		return true
+	case signalRCoreTypeCancelInvocation:
+		c.streamsLock.Lock()
+		if cancel, ok := c.streams[msg.InvocationId]; ok {
+			close(cancel)
+			delete(c.streams, msg.InvocationId)
+		}
+		c.streamsLock.Unlock()
+		return true
+	case signalRCoreTypeStreamItem:
+		if _, ok := c.uploads[msg.InvocationId]; ok {
+			c.uploadItems[msg.InvocationId]++
+		}
+		return true
+	case signalRCoreTypeCompletion:
+		if invocationId, ok := c.uploads[msg.InvocationId]; ok {
+			c.write(map[string]interface{}{
+				"type":         signalRCoreTypeCompletion,
+				"invocationId": invocationId,
+				"result":       c.uploadItems[msg.InvocationId],
+			})
+			delete(c.uploads, msg.InvocationId)
+			delete(c.uploadItems, msg.InvocationId)
+		}
+		return true
+	case signalRCoreTypeInvocation:
+	default:
+		return true
+	}
+
+	// The invocation completes once its client streams complete
+	if msg.Target == "UploadStream" && len(msg.StreamIds) > 0 {
+		for _, streamId := range msg.StreamIds {
+			c.uploads[streamId] = msg.InvocationId
+		}
+		return true
+	}
+
+	completion := map[string]interface{}{
+		"type":         signalRCoreTypeCompletion,
+		"invocationId": msg.InvocationId,
+	}
+	switch msg.Target {
+	case "echo":
+		c.write(&signalRCoreMessage{
+			Type:      signalRCoreTypeInvocation,
+			Target:    "echo",
+			Arguments: msg.Arguments,
+		})
+	case "disconnect":
+		return false
+	case "send", "broadcastMessage":
+		s.broadcast(&signalRCoreMessage{
+			Type:      signalRCoreTypeInvocation,
+			Target:    "broadcastMessage",
+			Arguments: msg.Arguments,
+		})
+	default:
+		completion["error"] = "Unknown hub method '" + msg.Target + "'"
+	}
+
+	if msg.InvocationId != "" {
+		c.write(completion)
+	}
+	return true
+}
+
+func (s *SignalRCoreServer) broadcast(msg *signalRCoreMessage) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for c := range s.clients {
+		c.write(msg)
+	}
+}
+
+// stream sends the items of a Counter stream, the number of items and the
+// delay between them in milliseconds being its arguments, until it is
+// cancelled.
+func (s *SignalRCoreServer) stream(c *signalRCoreClient, msg *signalRCoreMessage) {
+	completions := s.StreamCompletions
+	if completions == 0 {
+		completions = 1
+	}
+	complete := func(errMsg string) {
+		completion := map[string]interface{}{
+			"type":         signalRCoreTypeCompletion,
+			"invocationId": msg.InvocationId,
+		}
+		if errMsg != "" {
+			completion["error"] = errMsg
+		}
+		for i := 0; i < completions; i++ {
+			c.write(completion)
+		}
+	}
+
+	var count, delayMs int
+	if msg.Target != "Counter" {
+		complete("Unknown hub method '" + msg.Target + "'")
+		return
+	}
+	if len(msg.Arguments) > 0 {
+		json.Unmarshal(msg.Arguments[0], &count)
+	}
+	if len(msg.Arguments) > 1 {
+		json.Unmarshal(msg.Arguments[1], &delayMs)
+	}
+
+	cancel := make(chan struct{})
+	c.streamsLock.Lock()
+	c.streams[msg.InvocationId] = cancel
+	c.streamsLock.Unlock()
+
+	go func() {
+		for i := 0; i < count; i++ {
+			select {
+			case <-cancel:
+				complete("")
+				return
+			case <-time.After(time.Duration(delayMs) * time.Millisecond):
+			}
+			c.write(map[string]interface{}{
+				"type":         signalRCoreTypeStreamItem,
+				"invocationId": msg.InvocationId,
+				"item":         i,
+			})
+		}
+
+		c.streamsLock.Lock()
+		_, running := c.streams[msg.InvocationId]
+		delete(c.streams, msg.InvocationId)
+		c.streamsLock.Unlock()
+		if running {
+			complete("")
+		}
+	}()
+}
+
+// cancelStreams stops the streams of a closed connection.
+func (c *signalRCoreClient) cancelStreams() {
+	c.streamsLock.Lock()
+	defer c.streamsLock.Unlock()
+	for id, cancel := range c.streams {
+		close(cancel)
+		delete(c.streams, id)
+	}
+}
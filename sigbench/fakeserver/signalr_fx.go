@@ -0,0 +1,339 @@
+package fakeserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type signalRFxHubFrame struct {
+	Hub       string            `json:"H"`
+	Method    string            `json:"M"`
+	Arguments []json.RawMessage `json:"A"`
+}
+
+type signalRFxMessage struct {
+	Cursor      string              `json:"C,omitempty"`
+	Init        int                 `json:"S,omitempty"`
+	GroupsToken string              `json:"G,omitempty"`
+	Frames      []signalRFxHubFrame `json:"M"`
+}
+
+type signalRFxHubResult struct {
+	Id    string `json:"I"`
+	Error string `json:"E,omitempty"`
+}
+
+type signalRFxConnection struct {
+	wsClient
+	id     string
+	token  string
+	groups map[string]struct{}
+}
+
+// SignalRFxServer implements the chat hub of ASP.NET SignalR 1.4 over the
+// websockets transport: negotiate, connect with the init message, start, hub
+// invocation results, the message cursor, groups token and keep-alive.
+type SignalRFxServer struct {
+	HostName string
+
+	// KeepAliveTimeout is announced in negotiate. Keep-alive messages are
+	// sent every third of it.
+	KeepAliveTimeout time.Duration
+
+	// InitDelay delays the init message after the websocket is open.
+	InitDelay time.Duration
+
+	// InitMessages is how many times the init message is sent, once if zero.
+	InitMessages int
+
+	// DropBeforeInit closes the websocket instead of sending the init
+	// message.
+	DropBeforeInit bool
+
+	upgrader    websocket.Upgrader
+	nextId      int64
+	nextMessage int64
+	lock        sync.RWMutex
+	connections map[string]*signalRFxConnection
+	mux         *http.ServeMux
+}
+
+func NewSignalRFxServer(hostName string) *SignalRFxServer {
+	if hostName == "" {
+		hostName = DefaultHostName
+	}
+	s := &SignalRFxServer{
+		HostName:         hostName,
+		KeepAliveTimeout: 20 * time.Second,
+		connections:      make(map[string]*signalRFxConnection),
+		mux:              http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/signalr/negotiate", s.handleNegotiate)
+	s.mux.HandleFunc("/signalr/connect", s.handleConnect)
+	s.mux.HandleFunc("/signalr/start", s.handleStart)
+	s.mux.HandleFunc("/signalr/ping", s.handlePing)
+	s.mux.HandleFunc("/signalr/abort", s.handleAbort)
+	return s
+}
+
+func (s *SignalRFxServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("X-HostName", s.HostName)
+	s.mux.ServeHTTP(w, req)
+}
+
+// Clients returns the number of connected clients.
+func (s *SignalRFxServer) Clients() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	n := 0
+	for _, c := range s.connections {
+		if c.conn != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func writeJSONResponse(w http.ResponseWriter, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// connection returns the connection of the token in the request.
+func (s *SignalRFxServer) connection(w http.ResponseWriter, req *http.Request) *signalRFxConnection {
+	s.lock.RLock()
+	c, ok := s.connections[req.URL.Query().Get("connectionToken")]
+	s.lock.RUnlock()
+	if !ok {
+		http.Error(w, "Unrecognized user identity. The user identity cannot change during an active SignalR connection.", http.StatusForbidden)
+		return nil
+	}
+	return c
+}
+
+// cursor returns the cursor of a new message in the format of the scale-out
+// message bus, one stream with a hexadecimal id.
+func (s *SignalRFxServer) cursor() string {
+	return "d-FAKE-B," + strings.ToUpper(strconv.FormatInt(atomic.AddInt64(&s.nextMessage, 1), 16))
+}
+
+func (s *SignalRFxServer) handleNegotiate(w http.ResponseWriter, req *http.Request) {
+	if protocol := req.URL.Query().Get("clientProtocol"); protocol != "1.4" {
+		http.Error(w, "Unsupported client protocol: "+protocol, http.StatusBadRequest)
+		return
+	}
+
+	id := strconv.FormatInt(atomic.AddInt64(&s.nextId, 1), 10)
+	c := &signalRFxConnection{
+		id:     id,
+		token:  base64.StdEncoding.EncodeToString([]byte(id + ":")),
+		groups: make(map[string]struct{}),
+	}
+	s.lock.Lock()
+	s.connections[c.token] = c
+	s.lock.Unlock()
+
+	writeJSONResponse(w, map[string]interface{}{
+		"Url":                     "/signalr",
+		"ConnectionToken":         c.token,
+		"ConnectionId":            c.id,
+		"KeepAliveTimeout":        s.KeepAliveTimeout.Seconds(),
+		"DisconnectTimeout":       30.0,
+		"ConnectionTimeout":       110.0,
+		"TryWebSockets":           true,
+		"ProtocolVersion":         "1.4",
+		"TransportConnectTimeout": 5.0,
+		"LongPollDelay":           0.0,
+	})
+}
+
+func (s *SignalRFxServer) handleConnect(w http.ResponseWriter, req *http.Request) {
+	c := s.connection(w, req)
+	if c == nil {
+		return
+	}
+	if req.URL.Query().Get("transport") != "webSockets" {
+		http.Error(w, "Unsupported transport", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		log.Println("Fail to upgrade websocket: ", err)
+		return
+	}
+	s.lock.Lock()
+	c.conn = conn
+	s.lock.Unlock()
+
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		conn.Close()
+		s.lock.Lock()
+		delete(s.connections, c.token)
+		s.lock.Unlock()
+	}()
+
+	go func() {
+		select {
+		case <-time.After(s.InitDelay):
+		case <-done:
+			return
+		}
+		if s.DropBeforeInit {
+			conn.Close()
+			return
+		}
+		for i := 0; i == 0 || i < s.InitMessages; i++ {
+			c.writeJSON(&signalRFxMessage{Cursor: s.cursor(), Init: 1, Frames: []signalRFxHubFrame{}})
+		}
+
+		if s.KeepAliveTimeout <= 0 {
+			return
+		}
+		ticker := time.NewTicker(s.KeepAliveTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.writeJSON(struct{}{})
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		s.dispatch(c, data)
+	}
+}
+
+// dispatch invokes a hub method and replies with its result.
+func (s *SignalRFxServer) dispatch(c *signalRFxConnection, data []byte) {
+	var invocation struct {
+		Hub       string            `json:"H"`
+		Method    string            `json:"M"`
+		Arguments []json.RawMessage `json:"A"`
+		Id        json.RawMessage   `json:"I"`
+	}
+	if err := json.Unmarshal(data, &invocation); err != nil {
+		return
+	}
+
+	// Clients send the invocation id as either a number or a string
+	result := signalRFxHubResult{Id: strings.Trim(string(invocation.Id), "\"")}
+	if !strings.EqualFold(invocation.Hub, "chat") {
+		result.Error = "'" + invocation.Hub + "' Hub could not be resolved."
+		c.writeJSON(&result)
+		return
+	}
+
+	switch strings.ToLower(invocation.Method) {
+	case "send":
+		s.broadcast(&signalRFxHubFrame{Hub: "Chat", Method: "send", Arguments: invocation.Arguments}, "")
+	case "joingroup", "leavegroup":
+		var group string
+		if len(invocation.Arguments) < 1 || json.Unmarshal(invocation.Arguments[0], &group) != nil {
+			result.Error = "Invalid group name"
+			break
+		}
+		s.lock.Lock()
+		if strings.ToLower(invocation.Method) == "joingroup" {
+			c.groups[group] = struct{}{}
+		} else {
+			delete(c.groups, group)
+		}
+		token := s.groupsToken(c)
+		s.lock.Unlock()
+		c.writeJSON(&signalRFxMessage{Cursor: s.cursor(), GroupsToken: token, Frames: []signalRFxHubFrame{}})
+	case "sendtogroup":
+		var group string
+		if len(invocation.Arguments) < 1 || json.Unmarshal(invocation.Arguments[0], &group) != nil {
+			result.Error = "Invalid group name"
+			break
+		}
+		s.broadcast(&signalRFxHubFrame{Hub: "Chat", Method: "send", Arguments: invocation.Arguments[1:]}, group)
+	default:
+		result.Error = "'" + invocation.Method + "' method could not be resolved."
+	}
+	c.writeJSON(&result)
+}
+
+// groupsToken returns the token the client passes back on reconnect to
+// rejoin its groups. Callers must hold the lock.
+func (s *SignalRFxServer) groupsToken(c *signalRFxConnection) string {
+	groups := make([]string, 0, len(c.groups))
+	for group := range c.groups {
+		groups = append(groups, "Chat."+group)
+	}
+	sort.Strings(groups)
+	data, _ := json.Marshal(groups)
+	return c.id + ":" + base64.StdEncoding.EncodeToString(data)
+}
+
+// broadcast sends frame to all connected clients, or to the members of group
+// if it is not empty.
+func (s *SignalRFxServer) broadcast(frame *signalRFxHubFrame, group string) {
+	msg := &signalRFxMessage{Cursor: s.cursor(), Frames: []signalRFxHubFrame{*frame}}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, c := range s.connections {
+		if c.conn == nil {
+			continue
+		}
+		if _, ok := c.groups[group]; group != "" && !ok {
+			continue
+		}
+		c.writeJSON(msg)
+	}
+}
+
+func (s *SignalRFxServer) handleStart(w http.ResponseWriter, req *http.Request) {
+	c := s.connection(w, req)
+	if c == nil {
+		return
+	}
+
+	s.lock.RLock()
+	connected := c.conn != nil
+	s.lock.RUnlock()
+	if !connected {
+		http.Error(w, "The connection has not been established", http.StatusBadRequest)
+		return
+	}
+	writeJSONResponse(w, map[string]string{"Response": "started"})
+}
+
+func (s *SignalRFxServer) handlePing(w http.ResponseWriter, req *http.Request) {
+	writeJSONResponse(w, map[string]string{"Response": "pong"})
+}
+
+func (s *SignalRFxServer) handleAbort(w http.ResponseWriter, req *http.Request) {
+	c := s.connection(w, req)
+	if c == nil {
+		return
+	}
+
+	s.lock.RLock()
+	conn := c.conn
+	s.lock.RUnlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
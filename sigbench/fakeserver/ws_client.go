@@ -0,0 +1,29 @@
+package fakeserver
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsClient serializes writes to a websocket shared by the reader and the
+// goroutines sending to the client.
+type wsClient struct {
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+}
+
+// writeJSON sends msg as a text message, followed by the given terminator
+// bytes if any.
+func (c *wsClient) writeJSON(msg interface{}, terminator ...byte) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	data = append(data, terminator...)
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
@@ -1,11 +1,19 @@
 package sigbench
 
-import "time"
+import (
+	"time"
+
+	"microsoft.com/sigbench/proxy"
+)
 
 type JobPhase struct {
 	Name           string
 	UsersPerSecond int64
 	Duration       time.Duration
+
+	// Faults injected by the proxies of the job during this phase. Proxies
+	// forward traffic untouched in phases without faults.
+	Faults *proxy.Faults `json:",omitempty"`
 }
 
 type Job struct {
@@ -13,4 +21,14 @@ type Job struct {
 	SessionNames       []string
 	SessionPercentages []float64
 	SessionParams      map[string]string
+
+	// Control addresses of the fault injection proxies between agents and
+	// targets.
+	Proxies []string `json:",omitempty"`
+
+	// Assertions which must hold for the job to pass.
+	Assertions []Assertion `json:",omitempty"`
+
+	// Search runs a capacity search instead of the phases if set.
+	Search *CapacitySearch `json:",omitempty"`
 }
@@ -1,18 +1,31 @@
 package sigbench
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"log"
+	"math"
 	"sort"
 	"strconv"
 	"sync"
 	"time"
 
+	"microsoft.com/sigbench/metrics"
+	"microsoft.com/sigbench/proxy"
 	"microsoft.com/sigbench/snapshot"
 )
 
 type MasterController struct {
 	Agents         []*AgentDelegate
 	SnapshotWriter snapshot.SnapshotWriter
+
+	// SummaryFile receives the JobSummary of each run if set.
+	SummaryFile string
+
+	proxies []*proxy.Client
+
+	// Counters at the start and end of each phase, by phase name
+	phaseCounters map[string][2]map[string]int64
 }
 
 func (c *MasterController) RegisterAgent(address string) error {
@@ -47,7 +60,16 @@ func (c *MasterController) setupAllAgents(job *Job) error {
 }
 
 func (c *MasterController) collectCounters(sessionNames []string) map[string]int64 {
+	counters, _ := c.collectMetrics(sessionNames)
+	return counters
+}
+
+// collectMetrics returns the counters of all agents and proxies along with
+// the aggregated labeled metrics of the agents, which are also flattened
+// into the counters.
+func (c *MasterController) collectMetrics(sessionNames []string) (map[string]int64, []metrics.Sample) {
 	counters := make(map[string]int64)
+	aggregator := metrics.NewAggregator()
 	for _, agent := range c.Agents {
 		args := &AgentListCountersArgs{
 			SessionNames: sessionNames,
@@ -59,8 +81,107 @@ func (c *MasterController) collectCounters(sessionNames []string) map[string]int
 		for k, v := range result.Counters {
 			counters[k] = counters[k] + v
 		}
+		if err := aggregator.Add(agent.Address, result.Metrics); err != nil {
+			log.Println("ERROR: Fail to aggregate metrics from agent:", agent.Address, err)
+		}
 	}
-	return counters
+	for _, p := range c.proxies {
+		proxyCounters, err := p.Counters()
+		if err != nil {
+			log.Println("ERROR: Fail to list counters from proxy:", p.Address, err)
+		}
+		for k, v := range proxyCounters {
+			counters[k] = counters[k] + v
+		}
+	}
+
+	samples := aggregator.Samples()
+	for k, v := range metrics.Flatten(samples) {
+		counters[k] = counters[k] + v
+	}
+	return counters, samples
+}
+
+func (c *MasterController) setProxyFaults(faults proxy.Faults) {
+	for _, p := range c.proxies {
+		if err := p.SetFaults(faults); err != nil {
+			log.Println("ERROR: Fail to set faults of proxy:", p.Address, err)
+		}
+	}
+}
+
+// runPhases follows the phases of job, switching the faults of the proxies
+// and recording the counters at the phase boundaries for phase assertions.
+// Healthy forwarding is restored after the last phase.
+func (c *MasterController) runPhases(job *Job, stopChan chan struct{}) {
+	if len(c.proxies) > 0 {
+		defer c.setProxyFaults(proxy.Faults{})
+	}
+	recordCounters := len(job.Assertions) > 0
+	var start map[string]int64
+	if recordCounters {
+		start = c.collectCounters(job.SessionNames)
+	}
+	for _, phase := range job.Phases {
+		if len(c.proxies) > 0 {
+			faults := proxy.Faults{}
+			if phase.Faults != nil {
+				faults = *phase.Faults
+			}
+			log.Println("Proxy faults of phase", phase.Name, ":", faults)
+			c.setProxyFaults(faults)
+		}
+
+		stopped := false
+		select {
+		case <-time.After(phase.Duration):
+		case <-stopChan:
+			stopped = true
+		}
+
+		if recordCounters {
+			end := c.collectCounters(job.SessionNames)
+			c.phaseCounters[phase.Name] = [2]map[string]int64{start, end}
+			start = end
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// evaluateAssertions checks the assertions of job against the final counters
+// or the counters recorded during their phase.
+func (c *MasterController) evaluateAssertions(job *Job, counters map[string]int64) []AssertionResult {
+	results := make([]AssertionResult, 0, len(job.Assertions))
+	for _, assertion := range job.Assertions {
+		var result AssertionResult
+		if assertion.Phase == "" {
+			result = assertion.Evaluate(counters)
+		} else if window, ok := c.phaseCounters[assertion.Phase]; ok {
+			result = assertion.Evaluate(counterDelta(window[0], window[1]))
+		} else {
+			result = AssertionResult{Assertion: assertion, Error: "phase not reached"}
+		}
+
+		if result.Passed {
+			log.Println("PASS", assertion.String(), "( actual", result.Actual, ")")
+		} else if result.Error != "" {
+			log.Println("FAIL", assertion.String(), "(", result.Error, ")")
+		} else {
+			log.Println("FAIL", assertion.String(), "( actual", result.Actual, ")")
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (c *MasterController) writeSummary(summary *JobSummary) error {
+	data, err := json.MarshalIndent(summary, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.SummaryFile, data, 0644)
 }
 
 func (c *MasterController) watchCounters(sessionNames []string, stopChan chan struct{}) {
@@ -69,9 +190,9 @@ func (c *MasterController) watchCounters(sessionNames []string, stopChan chan st
 	for {
 		select {
 		case <-ticker.C:
-			counters := c.collectCounters(sessionNames)
+			counters, samples := c.collectMetrics(sessionNames)
 
-			if err := c.SnapshotWriter.WriteCounters(time.Now(), counters); err != nil {
+			if err := c.SnapshotWriter.WriteCounters(time.Now(), counters, phaseBreakdown(samples)); err != nil {
 				log.Println("Error: fail to write counter snapshot: ", err)
 			}
 
@@ -98,15 +219,10 @@ func (c *MasterController) printCounters(counters map[string]int64) {
 	}
 }
 
-func (c *MasterController) Run(job *Job) error {
-	// TODO: Validate job
+// runAgents runs job on all agents and waits until they finished.
+func (c *MasterController) runAgents(job *Job) {
 	var wg sync.WaitGroup
 	var agentCount int = len(c.Agents)
-	var timeStart time.Time = time.Now()
-
-	if err := c.setupAllAgents(job); err != nil {
-		return err
-	}
 
 	for idx, agent := range c.Agents {
 		wg.Add(1)
@@ -126,20 +242,166 @@ func (c *MasterController) Run(job *Job) error {
 		}(idx, agent)
 	}
 
+	wg.Wait()
+}
+
+// runCapacitySearch runs the steps of the capacity search of job, each as a
+// job with a single phase at the rate of the step.
+func (c *MasterController) runCapacitySearch(job *Job) *CapacitySearchResult {
+	search := job.Search
+	state := newCapacitySearchState(search)
+	result := &CapacitySearchResult{}
+
+	for rate, ok := state.next(); ok; rate, ok = state.next() {
+		stepJob := *job
+		stepJob.Phases = []JobPhase{
+			{
+				Name:           "search-" + strconv.FormatInt(rate, 10),
+				UsersPerSecond: rate,
+				Duration:       search.StepDuration,
+			},
+		}
+		log.Println("Capacity search step:", rate, "users per second")
+
+		start := c.collectCounters(job.SessionNames)
+		stopSampleChan := make(chan struct{})
+		peakChan := make(chan float64)
+		go func() {
+			peakChan <- c.samplePeakConcurrency(job, stopSampleChan)
+		}()
+
+		c.runAgents(&stepJob)
+
+		close(stopSampleChan)
+		peak := <-peakChan
+		end := c.collectCounters(job.SessionNames)
+
+		step := search.evaluateStep(rate, counterDelta(start, end), peak)
+		state.record(rate, step.Passed)
+		result.Steps = append(result.Steps, step)
+		if step.Passed && rate > result.UsersPerSecond {
+			result.UsersPerSecond = rate
+			result.PeakConcurrency = peak
+		}
+		log.Println("Capacity search step:", rate, "users per second, passed:", step.Passed)
+	}
+
+	log.Println("Capacity search result:", result.UsersPerSecond, "users per second")
+	for _, step := range result.Steps {
+		log.Println("    ", step.UsersPerSecond, ": passed", step.Passed, ", peak concurrency", step.PeakConcurrency)
+	}
+	return result
+}
+
+// samplePeakConcurrency returns the highest value of the concurrency metric
+// of the capacity search of job until stopChan is closed.
+func (c *MasterController) samplePeakConcurrency(job *Job, stopChan chan struct{}) float64 {
+	peak := float64(0)
+	if job.Search.ConcurrencyMetric == "" {
+		<-stopChan
+		return peak
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			value, err := evalMetric(job.Search.ConcurrencyMetric, c.collectCounters(job.SessionNames))
+			// Comparisons with NaN are false
+			if err == nil && value > peak && !math.IsInf(value, 0) {
+				peak = value
+			}
+		case <-stopChan:
+			return peak
+		}
+	}
+}
+
+func (c *MasterController) Run(job *Job) error {
+	phaseJob := job
+	if job.Search != nil {
+		if err := job.Search.Validate(); err != nil {
+			return err
+		}
+		// The phases of the job are replaced by the steps of the search
+		phaseJob = &Job{}
+	}
+	for _, assertion := range job.Assertions {
+		if err := assertion.Validate(phaseJob); err != nil {
+			return err
+		}
+	}
+
+	var timeStart time.Time = time.Now()
+
+	if err := c.setupAllAgents(job); err != nil {
+		return err
+	}
+
+	c.proxies = nil
+	for _, address := range job.Proxies {
+		c.proxies = append(c.proxies, proxy.NewClient(address))
+	}
+
 	stopWatchCounterChan := make(chan struct{})
 	go c.watchCounters(job.SessionNames, stopWatchCounterChan)
 
-	wg.Wait()
+	var searchResult *CapacitySearchResult
+	if job.Search != nil {
+		searchResult = c.runCapacitySearch(job)
+	} else {
+		c.phaseCounters = make(map[string][2]map[string]int64)
+		stopPhasesChan := make(chan struct{})
+		phasesDoneChan := make(chan struct{})
+		go func() {
+			c.runPhases(job, stopPhasesChan)
+			close(phasesDoneChan)
+		}()
+
+		c.runAgents(job)
+
+		close(stopPhasesChan)
+		<-phasesDoneChan
+	}
 
 	close(stopWatchCounterChan)
 
 	log.Println("--- Finished ---")
-	counters := c.collectCounters(job.SessionNames)
-	c.SnapshotWriter.WriteCounters(time.Now(), counters)
+	counters, samples := c.collectMetrics(job.SessionNames)
+	phases := phaseBreakdown(samples)
+	c.SnapshotWriter.WriteCounters(time.Now(), counters, phases)
 	c.printCounters(counters)
+	backends := backendDistributions(samples)
+	printBackendDistributions(backends)
 
 	totalDuration := int64(time.Now().Sub(timeStart) / time.Second)
 	log.Println("Test duration:", totalDuration, "secs")
 
+	summary := &JobSummary{
+		Passed:       true,
+		DurationSecs: totalDuration,
+		Assertions:   c.evaluateAssertions(job, counters),
+		Search:       searchResult,
+		Backends:     backends,
+		Counters:     counters,
+		Phases:       phases,
+		Metrics:      samples,
+	}
+	for _, result := range summary.Assertions {
+		summary.Passed = summary.Passed && result.Passed
+	}
+	if searchResult != nil && searchResult.UsersPerSecond == 0 {
+		summary.Passed = false
+	}
+	if c.SummaryFile != "" {
+		if err := c.writeSummary(summary); err != nil {
+			log.Println("Error: fail to write job summary: ", err)
+		}
+	}
+
+	if !summary.Passed {
+		return ErrAssertionsFailed
+	}
 	return nil
 }
@@ -0,0 +1,241 @@
+// Package metrics keeps named counters, gauges and histograms with labels,
+// so that dimensions like the session, host or agent are not encoded in
+// counter names. Agents ship their metrics as samples which the master
+// aggregates.
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type Kind int
+
+const (
+	KindCounter Kind = iota
+	KindGauge
+	KindHistogram
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindCounter:
+		return "counter"
+	case KindGauge:
+		return "gauge"
+	case KindHistogram:
+		return "histogram"
+	}
+	return "unknown"
+}
+
+// Common labels
+const (
+	LabelSession = "session"
+	LabelPhase   = "phase"
+	LabelHost    = "host"
+	LabelAgent   = "agent"
+)
+
+type Labels map[string]string
+
+// String returns the labels as k=v pairs sorted by key.
+func (l Labels) String() string {
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + "=" + l[k]
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (l Labels) clone() Labels {
+	labels := make(Labels, len(l)+1)
+	for key, value := range l {
+		labels[key] = value
+	}
+	return labels
+}
+
+// With returns a copy of the labels with k set to v.
+func (l Labels) With(k, v string) Labels {
+	labels := l.clone()
+	labels[k] = v
+	return labels
+}
+
+// Without returns a copy of the labels without k.
+func (l Labels) Without(k string) Labels {
+	labels := make(Labels, len(l))
+	for key, value := range l {
+		if key != k {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+// Key identifies a metric by its name and labels, e.g. host:users{host=a}.
+func Key(name string, labels Labels) string {
+	if len(labels) == 0 {
+		return name
+	}
+	return name + "{" + labels.String() + "}"
+}
+
+// Counter only goes up.
+type Counter struct {
+	value int64
+}
+
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+// Gauge is a current value like the number of active connections.
+type Gauge struct {
+	value int64
+}
+
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.value, v)
+}
+
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.value, n)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+// Histogram counts values in buckets below each bound and one bucket for
+// values at or above the last bound.
+type Histogram struct {
+	bounds  []int64
+	buckets []int64
+}
+
+func NewHistogram(bounds ...int64) *Histogram {
+	return &Histogram{
+		bounds:  append([]int64(nil), bounds...),
+		buckets: make([]int64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) Observe(v int64) {
+	for i, bound := range h.bounds {
+		if v < bound {
+			atomic.AddInt64(&h.buckets[i], 1)
+			return
+		}
+	}
+	atomic.AddInt64(&h.buckets[len(h.bounds)], 1)
+}
+
+type metric struct {
+	name      string
+	labels    Labels
+	kind      Kind
+	counter   *Counter
+	gauge     *Gauge
+	histogram *Histogram
+}
+
+// Registry holds the metrics of a session. Metrics are created on first use
+// and live until Reset.
+type Registry struct {
+	lock    sync.Mutex
+	metrics map[string]*metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]*metric)}
+}
+
+// Reset drops all metrics.
+func (r *Registry) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.metrics = make(map[string]*metric)
+}
+
+func (r *Registry) get(name string, labels Labels, kind Kind, create func(m *metric)) *metric {
+	key := Key(name, labels)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.metrics == nil {
+		r.metrics = make(map[string]*metric)
+	}
+	if m, ok := r.metrics[key]; ok {
+		if m.kind != kind {
+			panic("metric " + key + " is a " + m.kind.String() + ", not a " + kind.String())
+		}
+		return m
+	}
+	m := &metric{name: name, labels: labels.clone(), kind: kind}
+	create(m)
+	r.metrics[key] = m
+	return m
+}
+
+func (r *Registry) Counter(name string, labels Labels) *Counter {
+	return r.get(name, labels, KindCounter, func(m *metric) {
+		m.counter = &Counter{}
+	}).counter
+}
+
+func (r *Registry) Gauge(name string, labels Labels) *Gauge {
+	return r.get(name, labels, KindGauge, func(m *metric) {
+		m.gauge = &Gauge{}
+	}).gauge
+}
+
+// Histogram returns the histogram with the given bounds. The bounds of an
+// existing histogram are kept.
+func (r *Registry) Histogram(name string, labels Labels, bounds ...int64) *Histogram {
+	return r.get(name, labels, KindHistogram, func(m *metric) {
+		m.histogram = NewHistogram(bounds...)
+	}).histogram
+}
+
+// Samples returns the current values of all metrics sorted by key.
+func (r *Registry) Samples() []Sample {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	samples := make([]Sample, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		s := Sample{Name: m.name, Kind: m.kind, Labels: m.labels.clone()}
+		switch m.kind {
+		case KindCounter:
+			s.Value = m.counter.Value()
+		case KindGauge:
+			s.Value = m.gauge.Value()
+		case KindHistogram:
+			s.Bounds = append([]int64(nil), m.histogram.bounds...)
+			s.Buckets = make([]int64, len(m.histogram.buckets))
+			for i := range m.histogram.buckets {
+				s.Buckets[i] = atomic.LoadInt64(&m.histogram.buckets[i])
+				s.Value += s.Buckets[i]
+			}
+		}
+		samples = append(samples, s)
+	}
+	SortSamples(samples)
+	return samples
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import "testing"
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("host:users", Labels{LabelHost: "a"}).Inc()
+	r.Counter("host:users", Labels{LabelHost: "a"}).Add(2)
+	r.Counter("host:users", Labels{LabelHost: "b"}).Inc()
+	r.Gauge("host:active", Labels{LabelHost: "a"}).Set(5)
+	h := r.Histogram("latency", nil, 100, 500)
+	h.Observe(50)
+	h.Observe(100)
+	h.Observe(1000)
+
+	samples := r.Samples()
+	if len(samples) != 4 {
+		t.Fatal("Expect 4 samples but got", samples)
+	}
+	if s := samples[0]; s.Key() != "host:active{host=a}" || s.Kind != KindGauge || s.Value != 5 {
+		t.Fatal("Unexpected sample", s)
+	}
+	if s := samples[1]; s.Key() != "host:users{host=a}" || s.Value != 3 {
+		t.Fatal("Unexpected sample", s)
+	}
+	if s := samples[3]; s.Key() != "latency" || s.Value != 3 || s.Buckets[0] != 1 || s.Buckets[1] != 1 || s.Buckets[2] != 1 {
+		t.Fatal("Unexpected sample", s)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("Expect panic for a gauge used as a counter")
+		}
+	}()
+	r.Counter("host:active", Labels{LabelHost: "a"})
+}
+
+func TestAggregator(t *testing.T) {
+	agent1 := []Sample{
+		{Name: "users", Kind: KindCounter, Labels: Labels{LabelSession: "s"}, Value: 2},
+		{Name: "active", Kind: KindGauge, Value: 3},
+		{Name: "latency", Kind: KindHistogram, Value: 3, Bounds: []int64{100}, Buckets: []int64{1, 2}},
+	}
+	agent2 := []Sample{
+		{Name: "users", Kind: KindCounter, Labels: Labels{LabelSession: "s"}, Value: 5},
+		{Name: "active", Kind: KindGauge, Value: 4},
+		{Name: "latency", Kind: KindHistogram, Value: 1, Bounds: []int64{100}, Buckets: []int64{1, 0}},
+	}
+
+	a := NewAggregator()
+	if err := a.Add("agent1", agent1); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Add("agent2", agent2); err != nil {
+		t.Fatal(err)
+	}
+	if agent1[1].Labels != nil {
+		t.Fatal("Expect the samples of agents to be left untouched")
+	}
+
+	counters := Flatten(a.Samples())
+	expected := map[string]int64{
+		"users{session=s}":     7,
+		"active{agent=agent1}": 3,
+		"active{agent=agent2}": 4,
+		"active":               7,
+		"latency:<100":         2,
+		"latency:>=100":        2,
+	}
+	if len(counters) != len(expected) {
+		t.Fatal("Unexpected counters", counters)
+	}
+	for k, v := range expected {
+		if counters[k] != v {
+			t.Fatal("Expect", k, "to be", v, "but got", counters)
+		}
+	}
+
+	if err := a.Add("agent3", []Sample{{Name: "latency", Kind: KindHistogram, Bounds: []int64{200}, Buckets: []int64{1, 0}}}); err == nil {
+		t.Fatal("Expect error for different histogram bounds")
+	}
+	if err := a.Add("agent3", []Sample{{Name: "users", Kind: KindGauge, Labels: Labels{LabelSession: "s"}}}); err != nil {
+		t.Fatal("Expect gauges to be kept apart from counters but got", err)
+	}
+	if err := a.Add("agent3", []Sample{{Name: "users", Kind: KindHistogram, Labels: Labels{LabelSession: "s"}}}); err == nil {
+		t.Fatal("Expect error for different kinds")
+	}
+}
@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Sample is the value of a metric at some point, the wire format between
+// agents and the master. Value is the count of a counter, the value of a
+// gauge or the number of observations of a histogram. Buckets of a
+// histogram hold the observations below each of Bounds and, last, those at
+// or above the last bound.
+type Sample struct {
+	Name    string
+	Kind    Kind
+	Labels  Labels  `json:",omitempty"`
+	Value   int64   `json:",omitempty"`
+	Bounds  []int64 `json:",omitempty"`
+	Buckets []int64 `json:",omitempty"`
+}
+
+func (s *Sample) Key() string {
+	return Key(s.Name, s.Labels)
+}
+
+func SortSamples(samples []Sample) {
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].Key() < samples[j].Key()
+	})
+}
+
+// WithLabel returns the samples with label k set to v.
+func WithLabel(samples []Sample, k, v string) []Sample {
+	labeled := make([]Sample, len(samples))
+	for i, s := range samples {
+		s.Labels = s.Labels.With(k, v)
+		labeled[i] = s
+	}
+	return labeled
+}
+
+func sameBounds(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Aggregator merges the samples of all agents. Counters with the same name
+// and labels are summed and histograms merged bucket by bucket. Gauges are
+// kept per agent, since e.g. the send rate of one agent means nothing once
+// added to another.
+type Aggregator struct {
+	samples map[string]*Sample
+}
+
+func NewAggregator() *Aggregator {
+	return &Aggregator{samples: make(map[string]*Sample)}
+}
+
+// Add merges the samples of agent.
+func (a *Aggregator) Add(agent string, samples []Sample) error {
+	for _, s := range samples {
+		if s.Kind == KindGauge {
+			s.Labels = s.Labels.With(LabelAgent, agent)
+		}
+		key := s.Key()
+
+		existing, ok := a.samples[key]
+		if !ok {
+			merged := s
+			merged.Labels = s.Labels.clone()
+			merged.Bounds = append([]int64(nil), s.Bounds...)
+			merged.Buckets = append([]int64(nil), s.Buckets...)
+			a.samples[key] = &merged
+			continue
+		}
+		if existing.Kind != s.Kind {
+			return fmt.Errorf("metric %s is a %s on one agent and a %s on %s", key, existing.Kind, s.Kind, agent)
+		}
+
+		switch s.Kind {
+		case KindCounter:
+			existing.Value += s.Value
+		case KindGauge:
+			existing.Value = s.Value
+		case KindHistogram:
+			if !sameBounds(existing.Bounds, s.Bounds) {
+				return fmt.Errorf("histogram %s has different bounds on %s", key, agent)
+			}
+			for i := range s.Buckets {
+				existing.Buckets[i] += s.Buckets[i]
+			}
+			existing.Value += s.Value
+		}
+	}
+	return nil
+}
+
+// Samples returns the merged samples sorted by key.
+func (a *Aggregator) Samples() []Sample {
+	samples := make([]Sample, 0, len(a.samples))
+	for _, s := range a.samples {
+		samples = append(samples, *s)
+	}
+	SortSamples(samples)
+	return samples
+}
+
+// Flatten turns samples into counters keyed like name{k=v,...}. Histograms
+// write a counter per bucket, name{...}:<bound and name{...}:>=bound for the
+// last one, like the latency histograms of the sessions. Gauges of several
+// agents are also written as their sum without the agent label.
+func Flatten(samples []Sample) map[string]int64 {
+	counters := make(map[string]int64)
+	for _, s := range samples {
+		key := s.Key()
+		switch s.Kind {
+		case KindCounter:
+			counters[key] += s.Value
+		case KindGauge:
+			counters[key] = s.Value
+			if _, ok := s.Labels[LabelAgent]; ok {
+				counters[Key(s.Name, s.Labels.Without(LabelAgent))] += s.Value
+			}
+		case KindHistogram:
+			for i, bound := range s.Bounds {
+				counters[key+":<"+strconv.FormatInt(bound, 10)] += s.Buckets[i]
+			}
+			if len(s.Bounds) > 0 {
+				counters[key+":>="+strconv.FormatInt(s.Bounds[len(s.Bounds)-1], 10)] += s.Buckets[len(s.Bounds)]
+			}
+		}
+	}
+	return counters
+}
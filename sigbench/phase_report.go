@@ -0,0 +1,27 @@
+package sigbench
+
+import "microsoft.com/sigbench/metrics"
+
+// phaseBreakdown groups the metrics recorded with a phase label by phase,
+// flattened into counters without the phase label. Metrics without a phase
+// only count in the totals.
+func phaseBreakdown(samples []metrics.Sample) map[string]map[string]int64 {
+	byPhase := make(map[string][]metrics.Sample)
+	for _, s := range samples {
+		phase, ok := s.Labels[metrics.LabelPhase]
+		if !ok {
+			continue
+		}
+		s.Labels = s.Labels.Without(metrics.LabelPhase)
+		byPhase[phase] = append(byPhase[phase], s)
+	}
+	if len(byPhase) == 0 {
+		return nil
+	}
+
+	phases := make(map[string]map[string]int64, len(byPhase))
+	for phase, phaseSamples := range byPhase {
+		phases[phase] = metrics.Flatten(phaseSamples)
+	}
+	return phases
+}
@@ -0,0 +1,30 @@
+package sigbench
+
+import (
+	"testing"
+
+	"microsoft.com/sigbench/metrics"
+)
+
+func TestPhaseBreakdown(t *testing.T) {
+	phases := phaseBreakdown([]metrics.Sample{
+		{Name: "users:started", Kind: metrics.KindCounter, Labels: metrics.Labels{metrics.LabelSession: "s", metrics.LabelPhase: "ramp"}, Value: 10},
+		{Name: "users:started", Kind: metrics.KindCounter, Labels: metrics.Labels{metrics.LabelSession: "s", metrics.LabelPhase: "steady"}, Value: 30},
+		{Name: "latency", Kind: metrics.KindHistogram, Labels: metrics.Labels{metrics.LabelPhase: "steady"}, Bounds: []int64{100}, Buckets: []int64{4, 1}},
+		{Name: "backend:unidentified", Kind: metrics.KindCounter, Labels: metrics.Labels{metrics.LabelSession: "s"}, Value: 5},
+	})
+	if len(phases) != 2 {
+		t.Fatal("Expect 2 phases but got", phases)
+	}
+	if phases["ramp"]["users:started{session=s}"] != 10 || len(phases["ramp"]) != 1 {
+		t.Fatal("Unexpected ramp counters", phases["ramp"])
+	}
+	steady := phases["steady"]
+	if steady["users:started{session=s}"] != 30 || steady["latency:<100"] != 4 || steady["latency:>=100"] != 1 {
+		t.Fatal("Unexpected steady counters", steady)
+	}
+
+	if phases := phaseBreakdown([]metrics.Sample{{Name: "a", Kind: metrics.KindCounter, Value: 1}}); phases != nil {
+		t.Fatal("Expect no phases but got", phases)
+	}
+}
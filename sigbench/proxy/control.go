@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// NewControlHandler serves the faults of p at /faults, which can be read with
+// GET and changed with PUT, and its counters at /counters.
+func NewControlHandler(p *Proxy) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/faults", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			var faults Faults
+			if err := json.NewDecoder(req.Body).Decode(&faults); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			p.SetFaults(faults)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.Faults())
+	})
+	mux.HandleFunc("/counters", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(p.Counters())
+	})
+	return mux
+}
+
+// Client changes the faults of a remote proxy through its control address.
+type Client struct {
+	Address string
+	client  *http.Client
+}
+
+func NewClient(address string) *Client {
+	return &Client{
+		Address: address,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c *Client) do(method, path string, body interface{}, result interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, "http://"+c.Address+path, &reqBody)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from proxy %s", resp.StatusCode, c.Address)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (c *Client) SetFaults(faults Faults) error {
+	var result Faults
+	return c.do(http.MethodPut, "/faults", &faults, &result)
+}
+
+func (c *Client) Counters() (map[string]int64, error) {
+	var counters map[string]int64
+	if err := c.do(http.MethodGet, "/counters", nil, &counters); err != nil {
+		return nil, err
+	}
+	return counters, nil
+}
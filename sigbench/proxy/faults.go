@@ -0,0 +1,66 @@
+// Package proxy forwards connections between agents and target servers while
+// injecting network faults, so that jobs can compare healthy and degraded
+// network phases.
+package proxy
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Faults describes the network conditions a proxy emulates. The zero value
+// forwards traffic untouched.
+type Faults struct {
+	// LatencyMs delays every chunk of data in each direction.
+	LatencyMs int64
+
+	// JitterMs adds a random delay between 0 and JitterMs on top of the
+	// latency. Data is never reordered.
+	JitterMs int64
+
+	// DropRate is the probability a chunk is lost. Over raw TCP a lost
+	// packet shows up as a retransmission, so the chunk is delayed by
+	// RetransmitMs instead. Websocket-aware proxies drop whole data frames.
+	DropRate float64
+
+	// RetransmitMs is the delay of a dropped chunk over raw TCP. Defaults to
+	// 200.
+	RetransmitMs int64
+
+	// BandwidthBytesPerSec caps the throughput of each connection in each
+	// direction, 0 means unlimited.
+	BandwidthBytesPerSec int64
+
+	// ResetRate is the probability per second that a connection is reset
+	// abruptly.
+	ResetRate float64
+}
+
+// delay returns how long a chunk arriving now is held back.
+func (f *Faults) delay(r *rand.Rand) time.Duration {
+	d := time.Duration(f.LatencyMs) * time.Millisecond
+	if f.JitterMs > 0 {
+		d += time.Duration(r.Int63n(f.JitterMs+1)) * time.Millisecond
+	}
+	return d
+}
+
+// dropped tells whether a chunk is lost.
+func (f *Faults) dropped(r *rand.Rand) bool {
+	return f.DropRate > 0 && r.Float64() < f.DropRate
+}
+
+func (f *Faults) retransmitDelay() time.Duration {
+	if f.RetransmitMs > 0 {
+		return time.Duration(f.RetransmitMs) * time.Millisecond
+	}
+	return 200 * time.Millisecond
+}
+
+// transmitTime returns how long n bytes take at the bandwidth cap.
+func (f *Faults) transmitTime(n int) time.Duration {
+	if f.BandwidthBytesPerSec <= 0 {
+		return 0
+	}
+	return time.Duration(int64(n) * int64(time.Second) / f.BandwidthBytesPerSec)
+}
@@ -0,0 +1,219 @@
+package proxy
+
+import (
+	"bufio"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// chunk is a piece of data read from one side of a connection. Droppable
+// chunks can be discarded without corrupting the stream.
+type chunk struct {
+	data      []byte
+	arrival   time.Time
+	droppable bool
+}
+
+// Proxy forwards every accepted connection to Target applying the current
+// faults. Websocket-aware proxies parse HTTP and websocket frames so that
+// whole messages can be dropped.
+type Proxy struct {
+	Target    string
+	Websocket bool
+
+	lock   sync.RWMutex
+	faults Faults
+
+	cntActive      int64
+	cntTotal       int64
+	cntError       int64
+	cntBytesUp     int64
+	cntBytesDown   int64
+	cntDropped     int64
+	cntRetransmits int64
+	cntResets      int64
+}
+
+func NewProxy(target string, websocket bool) *Proxy {
+	return &Proxy{
+		Target:    target,
+		Websocket: websocket,
+	}
+}
+
+// SetFaults changes the faults of existing and new connections.
+func (p *Proxy) SetFaults(faults Faults) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.faults = faults
+}
+
+func (p *Proxy) Faults() Faults {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.faults
+}
+
+func (p *Proxy) Counters() map[string]int64 {
+	return map[string]int64{
+		"proxy:connections:active":  atomic.LoadInt64(&p.cntActive),
+		"proxy:connections:total":   atomic.LoadInt64(&p.cntTotal),
+		"proxy:connections:error":   atomic.LoadInt64(&p.cntError),
+		"proxy:connections:reset":   atomic.LoadInt64(&p.cntResets),
+		"proxy:bytes:upstream":      atomic.LoadInt64(&p.cntBytesUp),
+		"proxy:bytes:downstream":    atomic.LoadInt64(&p.cntBytesDown),
+		"proxy:frames:dropped":      atomic.LoadInt64(&p.cntDropped),
+		"proxy:packets:retransmits": atomic.LoadInt64(&p.cntRetransmits),
+	}
+}
+
+// Serve accepts connections on l until it is closed.
+func (p *Proxy) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *Proxy) handle(client net.Conn) {
+	server, err := net.DialTimeout("tcp", p.Target, 30*time.Second)
+	if err != nil {
+		log.Println("Fail to connect to target: ", err)
+		atomic.AddInt64(&p.cntError, 1)
+		client.Close()
+		return
+	}
+
+	atomic.AddInt64(&p.cntTotal, 1)
+	atomic.AddInt64(&p.cntActive, 1)
+	defer atomic.AddInt64(&p.cntActive, -1)
+
+	var closeOnce sync.Once
+	done := make(chan struct{})
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			close(done)
+			client.Close()
+			server.Close()
+		})
+	}
+	defer closeBoth()
+
+	up := make(chan chunk, 64)
+	down := make(chan chunk, 64)
+	if p.Websocket {
+		requests := make(chan *http.Request, 16)
+		upgraded := make(chan bool, 1)
+		go readHTTPRequests(bufio.NewReader(client), up, requests, upgraded)
+		go readHTTPResponses(bufio.NewReader(server), down, requests, upgraded)
+	} else {
+		go readRaw(client, up)
+		go readRaw(server, down)
+	}
+
+	go p.resetRandomly(client, server, done, closeBoth)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	forward := func(dst net.Conn, ch <-chan chunk, bytes *int64) {
+		defer wg.Done()
+		if !p.write(dst, ch, bytes) {
+			closeBoth()
+			// Drain so that the reader isn't blocked
+			for range ch {
+			}
+		}
+	}
+	go forward(server, up, &p.cntBytesUp)
+	go forward(client, down, &p.cntBytesDown)
+	wg.Wait()
+}
+
+// readRaw reads chunks from conn until it is closed.
+func readRaw(conn net.Conn, ch chan<- chunk) {
+	defer close(ch)
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := conn.Read(buf)
+		if n > 0 {
+			ch <- chunk{data: buf[:n], arrival: time.Now()}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// write forwards chunks to dst in order, applying the faults. It returns
+// false if the connection broke, otherwise it half-closes dst once the other
+// side finished sending.
+func (p *Proxy) write(dst net.Conn, ch <-chan chunk, bytes *int64) bool {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var last time.Time
+	for c := range ch {
+		f := p.Faults()
+
+		at := c.arrival.Add(f.delay(r))
+		if f.dropped(r) {
+			if c.droppable {
+				atomic.AddInt64(&p.cntDropped, 1)
+				continue
+			}
+			if !p.Websocket {
+				atomic.AddInt64(&p.cntRetransmits, 1)
+				at = at.Add(f.retransmitDelay())
+			}
+		}
+		if at.Before(last) {
+			at = last
+		}
+		time.Sleep(at.Sub(time.Now()))
+
+		if _, err := dst.Write(c.data); err != nil {
+			return false
+		}
+		atomic.AddInt64(bytes, int64(len(c.data)))
+		time.Sleep(f.transmitTime(len(c.data)))
+		last = time.Now()
+	}
+
+	if tcpConn, ok := dst.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	}
+	return true
+}
+
+// resetRandomly resets both sides of the connection at the configured rate.
+func (p *Proxy) resetRandomly(client, server net.Conn, done <-chan struct{}, closeBoth func()) {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f := p.Faults()
+			if f.ResetRate <= 0 || r.Float64() >= f.ResetRate {
+				continue
+			}
+			// Closing with linger 0 sends RST instead of FIN
+			for _, conn := range []net.Conn{client, server} {
+				if tcpConn, ok := conn.(*net.TCPConn); ok {
+					tcpConn.SetLinger(0)
+				}
+			}
+			atomic.AddInt64(&p.cntResets, 1)
+			closeBoth()
+			return
+		case <-done:
+			return
+		}
+	}
+}
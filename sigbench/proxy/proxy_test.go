@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func startProxy(t *testing.T, target string, ws bool) (*Proxy, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	p := NewProxy(target, ws)
+	go p.Serve(l)
+	return p, l.Addr().String()
+}
+
+func TestReadFrame(t *testing.T) {
+	var stream bytes.Buffer
+	// Masked text frame "hello"
+	stream.Write([]byte{0x81, 0x85, 1, 2, 3, 4, 'h' ^ 1, 'e' ^ 2, 'l' ^ 3, 'l' ^ 4, 'o' ^ 1})
+	// Ping
+	stream.Write([]byte{0x89, 0x00})
+	// Binary frame with 16 bit length
+	stream.Write([]byte{0x82, 126, 0x01, 0x00})
+	stream.Write(make([]byte, 256))
+	// First fragment of a text message
+	stream.Write([]byte{0x01, 0x01, 'a'})
+
+	expected := []struct {
+		size      int
+		droppable bool
+	}{{11, true}, {2, false}, {260, true}, {3, false}}
+	for i, e := range expected {
+		frame, droppable, err := readFrame(&stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frame) != e.size || droppable != e.droppable {
+			t.Error("Frame", i, "expected", e.size, e.droppable, "but got", len(frame), droppable)
+		}
+	}
+	if _, _, err := readFrame(&stream); err != io.EOF {
+		t.Error("Expect EOF but got", err)
+	}
+}
+
+func TestProxyLatency(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	p, addr := startProxy(t, l.Addr().String(), false)
+	p.SetFaults(Faults{LatencyMs: 100})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if rtt := time.Now().Sub(start); rtt < 200*time.Millisecond {
+		t.Fatal("Expect latency in both directions but round trip took", rtt)
+	}
+	if p.Counters()["proxy:bytes:upstream"] != 4 {
+		t.Fatal("Expect 4 bytes upstream but got", p.Counters())
+	}
+}
+
+func TestWebsocketProxyDrop(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			typ, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(typ, msg)
+		}
+	}))
+	defer ts.Close()
+
+	p, addr := startProxy(t, strings.TrimPrefix(ts.URL, "http://"), true)
+	p.SetFaults(Faults{DropRate: 1})
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/", nil)
+	if err != nil {
+		t.Fatal("Expect the upgrade to pass through but got", err)
+	}
+	defer conn.Close()
+
+	conn.WriteMessage(websocket.TextMessage, []byte("lost"))
+	time.Sleep(100 * time.Millisecond)
+	p.SetFaults(Faults{})
+	conn.WriteMessage(websocket.TextMessage, []byte("delivered"))
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "delivered" {
+		t.Fatal("Expect the first message to be dropped but got", string(msg))
+	}
+	if p.Counters()["proxy:frames:dropped"] != 1 {
+		t.Fatal("Expect one dropped frame but got", p.Counters())
+	}
+}
+
+func TestControl(t *testing.T) {
+	p := NewProxy("", false)
+	ts := httptest.NewServer(NewControlHandler(p))
+	defer ts.Close()
+
+	client := NewClient(strings.TrimPrefix(ts.URL, "http://"))
+	if err := client.SetFaults(Faults{LatencyMs: 50, DropRate: 0.1}); err != nil {
+		t.Fatal(err)
+	}
+	if f := p.Faults(); f.LatencyMs != 50 || f.DropRate != 0.1 {
+		t.Fatal("Expect faults to be applied but got", f)
+	}
+	counters, err := client.Counters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := counters["proxy:connections:total"]; !ok {
+		t.Fatal("Expect proxy counters but got", counters)
+	}
+}
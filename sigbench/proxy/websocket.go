@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const maxFrameSize = 1 << 30
+
+func isWebsocketUpgrade(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+}
+
+// readHTTPRequests forwards HTTP requests of the client as chunks and hands
+// them to the response reader. After a websocket upgrade is accepted, it
+// forwards websocket frames instead.
+func readHTTPRequests(r *bufio.Reader, ch chan<- chunk, requests chan<- *http.Request, upgraded <-chan bool) {
+	defer close(ch)
+	defer close(requests)
+	for {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		err = req.Write(&buf)
+		req.Body.Close()
+		if err != nil {
+			return
+		}
+
+		requests <- req
+		ch <- chunk{data: buf.Bytes(), arrival: time.Now()}
+
+		if isWebsocketUpgrade(req) {
+			if ok := <-upgraded; ok {
+				readFrames(r, ch)
+				return
+			}
+		}
+	}
+}
+
+// readHTTPResponses forwards the responses of the server to the requests as
+// chunks, switching to websocket frames once an upgrade is accepted.
+// Responses are forwarded once complete, so streaming bodies are not
+// supported.
+func readHTTPResponses(r *bufio.Reader, ch chan<- chunk, requests <-chan *http.Request, upgraded chan<- bool) {
+	defer close(ch)
+	defer close(upgraded)
+	for req := range requests {
+		resp, err := http.ReadResponse(r, req)
+		if err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		err = resp.Write(&buf)
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+
+		ch <- chunk{data: buf.Bytes(), arrival: time.Now()}
+
+		if isWebsocketUpgrade(req) {
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				upgraded <- true
+				readFrames(r, ch)
+				return
+			}
+			upgraded <- false
+		}
+	}
+}
+
+func readFrames(r io.Reader, ch chan<- chunk) {
+	for {
+		data, droppable, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		ch <- chunk{data: data, arrival: time.Now(), droppable: droppable}
+	}
+}
+
+// readFrame reads a complete websocket frame including its header. Only
+// unfragmented text and binary frames are droppable, since dropping control
+// frames or parts of a message would break the connection.
+func readFrame(r io.Reader) ([]byte, bool, error) {
+	frame := make([]byte, 2, 14)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, false, err
+	}
+	fin := frame[0]&0x80 != 0
+	opcode := frame[0] & 0x0f
+	masked := frame[1]&0x80 != 0
+
+	length := uint64(frame[1] & 0x7f)
+	extLen := 0
+	switch length {
+	case 126:
+		extLen = 2
+	case 127:
+		extLen = 8
+	}
+	if masked {
+		extLen += 4
+	}
+	frame = frame[:2+extLen]
+	if _, err := io.ReadFull(r, frame[2:]); err != nil {
+		return nil, false, err
+	}
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(frame[2:4]))
+	case 127:
+		length = binary.BigEndian.Uint64(frame[2:10])
+	}
+	if length > maxFrameSize {
+		return nil, false, errors.New("websocket frame too large")
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, false, err
+	}
+	return append(frame, payload...), fin && (opcode == 1 || opcode == 2), nil
+}
@@ -127,6 +127,7 @@ func (c *SigbenchMux) HandleJobCreate(w http.ResponseWriter, req *http.Request)
 
 	c.masterController = &sigbench.MasterController{
 		SnapshotWriter: snapshot.NewJsonSnapshotWriter(c.outDir + "/counters.txt"),
+		SummaryFile:    c.outDir + "/summary.json",
 	}
 
 	c.lock.Unlock()
@@ -151,7 +152,9 @@ func (c *SigbenchMux) HandleJobCreate(w http.ResponseWriter, req *http.Request)
 	}
 
 	go func() {
-		c.masterController.Run(&job)
+		if err := c.masterController.Run(&job); err != nil {
+			log.Println("Job failed: ", err)
+		}
 
 		c.lock.Lock()
 		c.masterController = nil
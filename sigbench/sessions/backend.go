@@ -0,0 +1,77 @@
+package sessions
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultBackendHeader = "X-HostName"
+	LabelInstance        = "instance"
+)
+
+var (
+	backendIdentifiersLock sync.Mutex
+	backendIdentifiers     = make(map[string]*BackendIdentifier)
+)
+
+// BackendIdentifier tells which backend instance served a connection from a
+// header of the negotiate response, so that the distribution of users over
+// the instances behind a load balancer can be checked.
+type BackendIdentifier struct {
+	Header  string
+	pattern *regexp.Regexp
+}
+
+// BackendIdentifierFromParams returns the identifier reading backendHeader
+// (defaults to X-HostName). With backendRegex the instance is the first
+// group of its match, or the whole match without groups. Identifiers are
+// shared by all users with the same parameters.
+func BackendIdentifierFromParams(params map[string]string) (*BackendIdentifier, error) {
+	header := params[ParamBackendHeader]
+	if header == "" {
+		header = DefaultBackendHeader
+	}
+	regex := params[ParamBackendRegex]
+	key := strings.Join([]string{header, regex}, "\n")
+
+	backendIdentifiersLock.Lock()
+	defer backendIdentifiersLock.Unlock()
+	if b, ok := backendIdentifiers[key]; ok {
+		return b, nil
+	}
+
+	b := &BackendIdentifier{Header: header}
+	if regex != "" {
+		pattern, err := regexp.Compile(regex)
+		if err != nil {
+			return nil, err
+		}
+		b.pattern = pattern
+	}
+	backendIdentifiers[key] = b
+	return b, nil
+}
+
+// Identify returns the backend instance named in header, or false if the
+// header is missing or doesn't match.
+func (b *BackendIdentifier) Identify(header http.Header) (string, bool) {
+	value := header.Get(b.Header)
+	if value == "" {
+		return "", false
+	}
+	if b.pattern == nil {
+		return value, true
+	}
+
+	m := b.pattern.FindStringSubmatch(value)
+	if m == nil {
+		return "", false
+	}
+	if len(m) > 1 {
+		return m[1], true
+	}
+	return m[0], true
+}
@@ -0,0 +1,52 @@
+package sessions
+
+import (
+	"net/http"
+	"testing"
+
+	"microsoft.com/sigbench/metrics"
+)
+
+func TestBackendIdentifier(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-HostName", "daysh85d200001D")
+	header.Set("X-Backend", "pod/signalr-7")
+
+	cases := []struct {
+		params   map[string]string
+		instance string
+		ok       bool
+	}{
+		{map[string]string{}, "daysh85d200001D", true},
+		{map[string]string{ParamBackendRegex: ".{6}$"}, "00001D", true},
+		{map[string]string{ParamBackendHeader: "X-Backend", ParamBackendRegex: `signalr-(\d+)`}, "7", true},
+		{map[string]string{ParamBackendHeader: "X-Backend", ParamBackendRegex: `^node`}, "", false},
+		{map[string]string{ParamBackendHeader: "X-Missing"}, "", false},
+	}
+	for _, c := range cases {
+		b, err := BackendIdentifierFromParams(c.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if instance, ok := b.Identify(header); instance != c.instance || ok != c.ok {
+			t.Fatal("Expect", c.instance, c.ok, "for", c.params, "but got", instance, ok)
+		}
+	}
+
+	if _, err := BackendIdentifierFromParams(map[string]string{ParamBackendRegex: "("}); err == nil {
+		t.Fatal("Expect error for invalid regex")
+	}
+}
+
+func TestConnectCountersBackends(t *testing.T) {
+	var c ConnectCounters
+	c.Reset()
+	c.RecordBackend("a", true)
+	c.RecordBackend("a", true)
+	c.RecordBackend("", false)
+
+	counters := metrics.Flatten(c.Samples())
+	if counters["backend:connections{instance=a}"] != 2 || counters["backend:unidentified"] != 1 {
+		t.Fatal("Unexpected backend counters", counters)
+	}
+}
@@ -0,0 +1,64 @@
+package sessions
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+const DefaultSenderTag = "sigbench:sender"
+
+// BroadcastPayload is carried as the message argument of broadcast messages so
+// that receivers can tell messages of designated senders apart from others.
+type BroadcastPayload struct {
+	Tag       string `json:"t"`
+	Seq       int64  `json:"s"`
+	Timestamp int64  `json:"ts"`
+}
+
+func EncodeBroadcastPayload(payload *BroadcastPayload) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func DecodeBroadcastPayload(data string) (*BroadcastPayload, error) {
+	var payload BroadcastPayload
+	if err := json.Unmarshal([]byte(data), &payload); err != nil {
+		return nil, err
+	}
+	return &payload, nil
+}
+
+func senderTag(params map[string]string) string {
+	if tag, ok := params[ParamSenderTag]; ok && tag != "" {
+		return tag
+	}
+	return DefaultSenderTag
+}
+
+// listenDurationSecs returns how long receivers stay connected, falling back
+// to the broadcast duration of senders.
+func listenDurationSecs(params map[string]string) int {
+	for _, key := range []string{ParamListenDurationSecs, ParamBroadcastDurationSecs} {
+		if secsStr, ok := params[key]; ok {
+			if secs, err := strconv.Atoi(secsStr); err == nil {
+				return secs
+			}
+		}
+	}
+	return 10
+}
+
+// recvTimeout returns how long senders wait for their own messages to come
+// back after they stop sending.
+func recvTimeout(params map[string]string) time.Duration {
+	if secsStr, ok := params[ParamRecvTimeoutSecs]; ok {
+		if secs, err := strconv.Atoi(secsStr); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return time.Minute
+}
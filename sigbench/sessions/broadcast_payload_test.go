@@ -0,0 +1,50 @@
+package sessions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBroadcastPayload(t *testing.T) {
+	data, err := EncodeBroadcastPayload(&BroadcastPayload{Tag: "t", Seq: 3, Timestamp: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := DecodeBroadcastPayload(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Tag != "t" || payload.Seq != 3 || payload.Timestamp != 42 {
+		t.Fatal("Unexpected payload", payload)
+	}
+
+	if _, err = DecodeBroadcastPayload("hello"); err == nil {
+		t.Fatal("Expect error for a plain message")
+	}
+}
+
+func TestBroadcastParams(t *testing.T) {
+	if tag := senderTag(map[string]string{}); tag != DefaultSenderTag {
+		t.Fatal("Expect the default tag but got", tag)
+	}
+	if tag := senderTag(map[string]string{ParamSenderTag: "mine"}); tag != "mine" {
+		t.Fatal("Expect the given tag but got", tag)
+	}
+
+	if secs := listenDurationSecs(map[string]string{ParamBroadcastDurationSecs: "5"}); secs != 5 {
+		t.Fatal("Expect to fall back to the broadcast duration but got", secs)
+	}
+	if secs := listenDurationSecs(map[string]string{ParamListenDurationSecs: "7", ParamBroadcastDurationSecs: "5"}); secs != 7 {
+		t.Fatal("Expect the listen duration but got", secs)
+	}
+	if secs := listenDurationSecs(map[string]string{}); secs != 10 {
+		t.Fatal("Expect the default duration but got", secs)
+	}
+
+	if d := recvTimeout(map[string]string{ParamRecvTimeoutSecs: "3"}); d != 3*time.Second {
+		t.Fatal("Expect 3s but got", d)
+	}
+	if d := recvTimeout(map[string]string{ParamRecvTimeoutSecs: "x"}); d != time.Minute {
+		t.Fatal("Expect the default timeout but got", d)
+	}
+}
@@ -2,7 +2,74 @@ package sessions
 
 const (
 	ParamHost                  = "host"
+	ParamEndpointSelection     = "endpointSelection"
+	ParamEndpointWeights       = "endpointWeights"
+	ParamBackendHeader         = "backendHeader"
+	ParamBackendRegex          = "backendRegex"
 	ParamPassword              = "password"
 	ParamBroadcastDurationSecs = "broadcastDurationSecs"
 	ParamPublishInterval       = "publishInterval"
+	ParamSendRate              = "sendRate"
+	ParamSendMode              = "sendMode"
+	ParamBurstSize             = "burstSize"
+	ParamSenderTag             = "senderTag"
+	ParamListenDurationSecs    = "listenDurationSecs"
+	ParamRecvTimeoutSecs       = "recvTimeoutSecs"
+	ParamReconnectPolicy       = "reconnectPolicy"
+	ParamReconnectDelayMs      = "reconnectDelayMs"
+	ParamReconnectMaxDelayMs   = "reconnectMaxDelayMs"
+	ParamReconnectMaxAttempts  = "reconnectMaxAttempts"
+	ParamDropFraction          = "dropFraction"
+	ParamDropAfterSecs         = "dropAfterSecs"
+	ParamInvokeMethod          = "invokeMethod"
+	ParamInvokeArgs            = "invokeArgs"
+	ParamInvokeDurationSecs    = "invokeDurationSecs"
+	ParamStreamMethod          = "streamMethod"
+	ParamStreamArgs            = "streamArgs"
+	ParamStreamItemCount       = "streamItemCount"
+	ParamStreamCancelAfter     = "streamCancelAfter"
+	ParamUploadMethod          = "uploadMethod"
+	ParamPingIntervalSecs      = "pingIntervalSecs"
+	ParamScript                = "script"
+	ParamScriptFile            = "scriptFile"
+	ParamWsUrl                 = "wsUrl"
+	ParamWsDurationSecs        = "wsDurationSecs"
+	ParamWsMessageType         = "wsMessageType"
+	ParamWsSubprotocols        = "wsSubprotocols"
+	ParamWsHeaders             = "wsHeaders"
+	ParamWsCompression         = "wsCompression"
+	ParamWsInsecureSkipVerify  = "wsInsecureSkipVerify"
+	ParamHttpUrl               = "httpUrl"
+	ParamHttpMethod            = "httpMethod"
+	ParamHttpHeaders           = "httpHeaders"
+	ParamHttpBody              = "httpBody"
+	ParamHttpExpectedStatus    = "httpExpectedStatus"
+	ParamHttpKeepAlive         = "httpKeepAlive"
+	ParamHttpRequestCount      = "httpRequestCount"
+	ParamScheme                = "scheme"
+	ParamTLSCAFile             = "tlsCaFile"
+	ParamTLSCertFile           = "tlsCertFile"
+	ParamTLSKeyFile            = "tlsKeyFile"
+	ParamTLSInsecureSkipVerify = "tlsInsecureSkipVerify"
+	ParamTLSServerName         = "tlsServerName"
+	ParamSourceIps             = "sourceIps"
+	ParamDialTimeoutMs         = "dialTimeoutMs"
+	ParamReadBufferSize        = "readBufferSize"
+	ParamWriteBufferSize       = "writeBufferSize"
+	ParamMaxIdleConns          = "maxIdleConns"
+	ParamRedisMode             = "redisMode"
+	ParamRedisSentinelMaster   = "redisSentinelMaster"
+	ParamRedisSentinelPassword = "redisSentinelPassword"
+	ParamRedisTLS              = "redisTls"
+	ParamRedisMaxIdle          = "redisMaxIdle"
+	ParamRedisMaxActive        = "redisMaxActive"
+	ParamRedisChannels         = "redisChannels"
+	ParamRedisSubscribers      = "redisSubscribersPerChannel"
+	ParamRedisPattern          = "redisPattern"
+	ParamRedisRole             = "redisRole"
+	ParamRedisStream           = "redisStream"
+	ParamRedisStreamGroups     = "redisStreamGroups"
+	ParamRedisStreamMaxLen     = "redisStreamMaxLen"
+	ParamRedisStreamClaimMs    = "redisStreamClaimIdleMs"
+	ParamRedisStreamSkipAck    = "redisStreamSkipAckFraction"
 )
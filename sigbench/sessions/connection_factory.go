@@ -0,0 +1,152 @@
+package sessions
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	connectionFactoriesLock sync.Mutex
+	connectionFactories     = make(map[string]*ConnectionFactory)
+)
+
+// ConnectionFactory creates the network connections, HTTP clients and
+// websocket dialers of the sessions. Binding to several local source IPs
+// round-robin lifts the limit of ephemeral ports a single IP has.
+type ConnectionFactory struct {
+	localAddrs      []*net.TCPAddr
+	nextLocalAddr   uint64
+	dialTimeout     time.Duration
+	readBufferSize  int
+	writeBufferSize int
+	maxIdleConns    int
+
+	lock    sync.Mutex
+	clients map[*tls.Config]*http.Client
+}
+
+// ConnectionFactoryFromParams returns the factory for the connection
+// parameters. Factories are shared by all users with the same parameters so
+// that idle connections can be reused.
+func ConnectionFactoryFromParams(params map[string]string) (*ConnectionFactory, error) {
+	key := strings.Join([]string{
+		params[ParamSourceIps],
+		params[ParamDialTimeoutMs],
+		params[ParamReadBufferSize],
+		params[ParamWriteBufferSize],
+		params[ParamMaxIdleConns],
+	}, "\n")
+
+	connectionFactoriesLock.Lock()
+	defer connectionFactoriesLock.Unlock()
+	if f, ok := connectionFactories[key]; ok {
+		return f, nil
+	}
+
+	f := &ConnectionFactory{
+		dialTimeout: 30 * time.Second,
+		clients:     make(map[*tls.Config]*http.Client),
+	}
+	if ipsStr := params[ParamSourceIps]; ipsStr != "" {
+		for _, ipStr := range strings.Split(ipsStr, ",") {
+			ip := net.ParseIP(strings.TrimSpace(ipStr))
+			if ip == nil {
+				return nil, errors.New("invalid source ip: " + ipStr)
+			}
+			f.localAddrs = append(f.localAddrs, &net.TCPAddr{IP: ip})
+		}
+	}
+	for param, value := range map[string]*int{
+		ParamReadBufferSize:  &f.readBufferSize,
+		ParamWriteBufferSize: &f.writeBufferSize,
+		ParamMaxIdleConns:    &f.maxIdleConns,
+	} {
+		if str, ok := params[param]; ok {
+			n, err := strconv.Atoi(str)
+			if err != nil {
+				return nil, err
+			}
+			*value = n
+		}
+	}
+	if msStr, ok := params[ParamDialTimeoutMs]; ok {
+		ms, err := strconv.Atoi(msStr)
+		if err != nil {
+			return nil, err
+		}
+		f.dialTimeout = time.Duration(ms) * time.Millisecond
+	}
+
+	connectionFactories[key] = f
+	return f, nil
+}
+
+// netDialer returns a dialer bound to the next source IP.
+func (f *ConnectionFactory) netDialer() *net.Dialer {
+	d := &net.Dialer{
+		Timeout:   f.dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if len(f.localAddrs) > 0 {
+		idx := atomic.AddUint64(&f.nextLocalAddr, 1)
+		d.LocalAddr = f.localAddrs[idx%uint64(len(f.localAddrs))]
+	}
+	return d
+}
+
+func (f *ConnectionFactory) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f.netDialer().DialContext(ctx, network, addr)
+}
+
+// NewTransport returns a new HTTP transport dialing through the factory.
+func (f *ConnectionFactory) NewTransport(tlsConfig *tls.Config) *http.Transport {
+	t := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         f.dialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		ReadBufferSize:      f.readBufferSize,
+		WriteBufferSize:     f.writeBufferSize,
+	}
+	if f.maxIdleConns > 0 {
+		t.MaxIdleConns = f.maxIdleConns
+		t.MaxIdleConnsPerHost = f.maxIdleConns
+	}
+	return t
+}
+
+// HTTPClient returns the client shared by all users of the factory with the
+// same TLS configuration.
+func (f *ConnectionFactory) HTTPClient(tlsConfig *tls.Config) *http.Client {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	client, ok := f.clients[tlsConfig]
+	if !ok {
+		client = &http.Client{Transport: f.NewTransport(tlsConfig)}
+		f.clients[tlsConfig] = client
+	}
+	return client
+}
+
+// WebsocketDialer returns a new websocket dialer with the factory's buffer
+// sizes. Dial it with the factory's DialWebsocket.
+func (f *ConnectionFactory) WebsocketDialer(tlsConfig *tls.Config) *websocket.Dialer {
+	return &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 45 * time.Second,
+		ReadBufferSize:   f.readBufferSize,
+		WriteBufferSize:  f.writeBufferSize,
+		TLSClientConfig:  tlsConfig,
+	}
+}
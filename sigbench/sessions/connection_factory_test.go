@@ -0,0 +1,56 @@
+package sessions
+
+import (
+	"net"
+	"testing"
+)
+
+func TestConnectionFactorySourceIps(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	factory, err := ConnectionFactoryFromParams(map[string]string{
+		ParamSourceIps:     "127.0.0.2,127.0.0.3",
+		ParamDialTimeoutMs: "1000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		c, err := factory.netDialer().Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal("Expect dial to succeed but got", err)
+		}
+		seen[c.LocalAddr().(*net.TCPAddr).IP.String()]++
+		c.Close()
+	}
+	if seen["127.0.0.2"] != 2 || seen["127.0.0.3"] != 2 {
+		t.Fatal("Expect source ips to be used round-robin but got", seen)
+	}
+
+	same, _ := ConnectionFactoryFromParams(map[string]string{
+		ParamSourceIps:     "127.0.0.2,127.0.0.3",
+		ParamDialTimeoutMs: "1000",
+	})
+	if same != factory {
+		t.Fatal("Expect factories with the same params to be shared")
+	}
+
+	if _, err = ConnectionFactoryFromParams(map[string]string{ParamSourceIps: "localhost"}); err == nil {
+		t.Fatal("Expect error for invalid source ip")
+	}
+}
@@ -0,0 +1,310 @@
+package sessions
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"microsoft.com/sigbench/metrics"
+)
+
+const (
+	ConnectStageDNS          = "dns"
+	ConnectStageTCP          = "tcp"
+	ConnectStageTLS          = "tls"
+	ConnectStageNegotiate    = "negotiate"
+	ConnectStageWebsocket    = "websocket"
+	ConnectStageHandshakeAck = "handshake"
+	ConnectStageTotal        = "total"
+)
+
+var connectStages = []string{
+	ConnectStageDNS,
+	ConnectStageTCP,
+	ConnectStageTLS,
+	ConnectStageNegotiate,
+	ConnectStageWebsocket,
+	ConnectStageHandshakeAck,
+	ConnectStageTotal,
+}
+
+// ConnectCounters aggregates the time users of a session spend in each stage
+// of connecting, and how many connections each backend instance served.
+type ConnectCounters struct {
+	stagesOnce sync.Once
+	stages     map[string]*LatencyHistogram
+	backends   metrics.Registry
+}
+
+// histograms returns the histogram of each stage, created once and reset in
+// place afterwards so that they can be read while a job is set up.
+func (c *ConnectCounters) histograms() map[string]*LatencyHistogram {
+	c.stagesOnce.Do(func() {
+		c.stages = make(map[string]*LatencyHistogram)
+		for _, stage := range connectStages {
+			c.stages[stage] = NewLatencyHistogram(10, 50, 100, 500, 1000)
+		}
+	})
+	return c.stages
+}
+
+func (c *ConnectCounters) Reset() {
+	for _, h := range c.histograms() {
+		h.Reset()
+	}
+	c.backends.Reset()
+}
+
+// Record adds the duration of a connect stage. It is a no-op on nil counters.
+func (c *ConnectCounters) Record(stage string, d time.Duration) {
+	if c == nil {
+		return
+	}
+	if h, ok := c.histograms()[stage]; ok {
+		h.Record(int64(d / time.Millisecond))
+	}
+}
+
+// RecordBackend counts a connection served by the backend instance, or an
+// unidentified one if ok is false. It is a no-op on nil counters.
+func (c *ConnectCounters) RecordBackend(instance string, ok bool) {
+	if c == nil {
+		return
+	}
+	if !ok {
+		c.backends.Counter("backend:unidentified", nil).Inc()
+		return
+	}
+	c.backends.Counter("backend:connections", metrics.Labels{LabelInstance: instance}).Inc()
+}
+
+func (c *ConnectCounters) AddCounters(counters map[string]int64, prefix string) {
+	for stage, h := range c.histograms() {
+		h.AddCounters(counters, prefix+":connect:"+stage)
+	}
+}
+
+// Samples returns the connections of each backend instance as
+// backend:connections and those of unknown instances as backend:unidentified.
+func (c *ConnectCounters) Samples() []metrics.Sample {
+	return c.backends.Samples()
+}
+
+// withConnectTrace returns req with a trace recording its DNS lookup, TCP
+// connect and TLS handshake into counters.
+func withConnectTrace(req *http.Request, counters *ConnectCounters) *http.Request {
+	var lock sync.Mutex
+	var dnsStart, tlsStart time.Time
+	connectStart := make(map[string]time.Time)
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			counters.Record(ConnectStageDNS, time.Now().Sub(dnsStart))
+		},
+		// Dual-stack hosts may be connected in parallel
+		ConnectStart: func(network, addr string) {
+			lock.Lock()
+			connectStart[addr] = time.Now()
+			lock.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			lock.Lock()
+			start := connectStart[addr]
+			lock.Unlock()
+			if err == nil {
+				counters.Record(ConnectStageTCP, time.Now().Sub(start))
+			}
+		},
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				counters.Record(ConnectStageTLS, time.Now().Sub(tlsStart))
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// tracedNetDial resolves and connects to addr through the factory, recording
+// both stages. A custom netDial does its own resolution so only its total is
+// recorded.
+func (f *ConnectionFactory) tracedNetDial(netDial func(network, addr string) (net.Conn, error), counters *ConnectCounters) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		if netDial != nil {
+			start := time.Now()
+			conn, err := netDial(network, addr)
+			if err == nil {
+				counters.Record(ConnectStageTCP, time.Now().Sub(start))
+			}
+			return conn, err
+		}
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addrs := []string{host}
+		if net.ParseIP(host) == nil {
+			start := time.Now()
+			if addrs, err = net.LookupHost(host); err != nil {
+				return nil, err
+			}
+			counters.Record(ConnectStageDNS, time.Now().Sub(start))
+		}
+
+		dialer := f.netDialer()
+		for _, ip := range addrs {
+			start := time.Now()
+			var conn net.Conn
+			if conn, err = dialer.Dial(network, net.JoinHostPort(ip, port)); err == nil {
+				counters.Record(ConnectStageTCP, time.Now().Sub(start))
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// DialWebsocket dials a ws or wss url through the factory, recording the
+// stages of the dial. For wss the TLS handshake is done here with the
+// dialer's TLS configuration so that its duration can be recorded.
+func (f *ConnectionFactory) DialWebsocket(dialer *websocket.Dialer, rawUrl string, header http.Header, counters *ConnectCounters) (*websocket.Conn, *http.Response, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	timeout := dialer.HandshakeTimeout
+	if timeout == 0 {
+		timeout = 45 * time.Second
+	}
+	netDial := f.tracedNetDial(dialer.NetDial, counters)
+
+	d := *dialer
+	d.NetDial = netDial
+	if u.Scheme == "wss" {
+		tlsConfig := dialer.TLSClientConfig
+
+		// The TLS connection goes to the server directly
+		d.Proxy = nil
+		d.TLSClientConfig = nil
+		d.NetDial = func(network, addr string) (net.Conn, error) {
+			rawConn, err := netDial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			cfg := &tls.Config{}
+			if tlsConfig != nil {
+				cfg = tlsConfig.Clone()
+			}
+			if cfg.ServerName == "" {
+				cfg.ServerName = u.Hostname()
+			}
+
+			start := time.Now()
+			conn := tls.Client(rawConn, cfg)
+			conn.SetDeadline(start.Add(timeout))
+			if err = conn.Handshake(); err != nil {
+				rawConn.Close()
+				return nil, err
+			}
+			conn.SetDeadline(time.Time{})
+			counters.Record(ConnectStageTLS, time.Now().Sub(start))
+			return conn, nil
+		}
+		u.Scheme = "ws"
+	}
+
+	start := time.Now()
+	c, resp, err := d.Dial(u.String(), header)
+	if err == nil {
+		counters.Record(ConnectStageWebsocket, time.Now().Sub(start))
+	}
+	return c, resp, err
+}
+
+// Endpoint is how sessions reach a SignalR host: over http and ws, or https
+// and wss with the configured TLS settings.
+type Endpoint struct {
+	Host      string
+	secure    bool
+	tlsConfig *tls.Config
+	factory   *ConnectionFactory
+	client    *http.Client
+	counters  *ConnectCounters
+	backend   *BackendIdentifier
+}
+
+func NewEndpoint(host string, params map[string]string, counters *ConnectCounters) (*Endpoint, error) {
+	secure, err := secureScheme(params)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := NewTLSConfigFromParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	factory, err := ConnectionFactoryFromParams(params)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := BackendIdentifierFromParams(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Endpoint{
+		Host:      host,
+		secure:    secure,
+		tlsConfig: tlsConfig,
+		factory:   factory,
+		client:    factory.HTTPClient(tlsConfig),
+		counters:  counters,
+		backend:   backend,
+	}, nil
+}
+
+func (e *Endpoint) HttpUrl(path string) string {
+	if e.secure {
+		return "https://" + e.Host + path
+	}
+	return "http://" + e.Host + path
+}
+
+func (e *Endpoint) WsUrl(path string) string {
+	if e.secure {
+		return "wss://" + e.Host + path
+	}
+	return "ws://" + e.Host + path
+}
+
+// Record adds the duration of a connect stage to the endpoint's counters.
+func (e *Endpoint) Record(stage string, d time.Duration) {
+	e.counters.Record(stage, d)
+}
+
+// RecordBackend counts the backend instance which sent resp.
+func (e *Endpoint) RecordBackend(resp *http.Response) {
+	e.counters.RecordBackend(e.backend.Identify(resp.Header))
+}
+
+// Do sends an HTTP request to the endpoint.
+func (e *Endpoint) Do(req *http.Request) (*http.Response, error) {
+	return e.client.Do(withConnectTrace(req, e.counters))
+}
+
+// DialWebsocket opens a websocket to path on the endpoint.
+func (e *Endpoint) DialWebsocket(path string) (*websocket.Conn, *http.Response, error) {
+	return e.factory.DialWebsocket(e.factory.WebsocketDialer(e.tlsConfig), e.WsUrl(path), nil, e.counters)
+}
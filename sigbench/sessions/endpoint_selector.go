@@ -0,0 +1,181 @@
+package sessions
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"microsoft.com/sigbench/metrics"
+)
+
+const (
+	EndpointSelectionRoundRobin = "roundrobin"
+	EndpointSelectionWeighted   = "weighted"
+	EndpointSelectionRandom     = "random"
+	EndpointSelectionLeastConn  = "leastconn"
+	EndpointSelectionSticky     = "sticky"
+)
+
+// EndpointSelector picks the target of each user from a comma-separated
+// list of hosts or urls, and counts the users each target host served.
+type EndpointSelector struct {
+	lock     sync.Mutex
+	key      string
+	mode     string
+	targets  []string
+	labels   []string
+	weights  []int64
+	current  []int64
+	next     int
+	rand     *rand.Rand
+	active   []*metrics.Gauge
+	registry metrics.Registry
+}
+
+// EndpointLease is the target selected for a user. Release it once the user
+// is done.
+type EndpointLease struct {
+	Target string
+	active *metrics.Gauge
+	errors *metrics.Counter
+}
+
+// Release marks the user done, counting an error if err isn't nil.
+func (l *EndpointLease) Release(err error) {
+	l.active.Add(-1)
+	if err != nil {
+		l.errors.Inc()
+	}
+}
+
+func (s *EndpointSelector) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.key = ""
+	s.registry.Reset()
+}
+
+// endpointLabel returns the host of a url target, or the target itself.
+func endpointLabel(target string) string {
+	if u, err := url.Parse(target); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return target
+}
+
+// configure rebuilds the selector when the targets or the selection params
+// changed.
+func (s *EndpointSelector) configure(targets string, params map[string]string) error {
+	key := strings.Join([]string{targets, params[ParamEndpointSelection], params[ParamEndpointWeights]}, "\n")
+	if key == s.key {
+		return nil
+	}
+
+	mode := params[ParamEndpointSelection]
+	switch mode {
+	case "":
+		mode = EndpointSelectionRoundRobin
+	case EndpointSelectionRoundRobin, EndpointSelectionWeighted, EndpointSelectionRandom,
+		EndpointSelectionLeastConn, EndpointSelectionSticky:
+	default:
+		return fmt.Errorf("unknown endpoint selection %q", mode)
+	}
+
+	list := strings.Split(targets, ",")
+	weights := make([]int64, len(list))
+	for i := range weights {
+		weights[i] = 1
+	}
+	if weightsStr, ok := params[ParamEndpointWeights]; ok {
+		parts := strings.Split(weightsStr, ",")
+		if len(parts) != len(list) {
+			return errors.New("endpoint weights don't match the targets")
+		}
+		for i, part := range parts {
+			weight, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+			if err != nil || weight <= 0 {
+				return fmt.Errorf("invalid endpoint weight %q", part)
+			}
+			weights[i] = weight
+		}
+	}
+
+	s.key = key
+	s.mode = mode
+	s.targets = list
+	s.weights = weights
+	s.current = make([]int64, len(list))
+	s.next = 0
+	s.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	s.labels = make([]string, len(list))
+	s.active = make([]*metrics.Gauge, len(list))
+	for i, target := range list {
+		s.labels[i] = endpointLabel(target)
+		s.active[i] = s.registry.Gauge("host:active", metrics.Labels{metrics.LabelHost: s.labels[i]})
+	}
+	return nil
+}
+
+// Select picks the target of the user from targets.
+func (s *EndpointSelector) Select(ctx *UserContext, targets string) (*EndpointLease, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.configure(targets, ctx.Params); err != nil {
+		return nil, err
+	}
+
+	idx := 0
+	switch s.mode {
+	case EndpointSelectionRoundRobin:
+		idx = s.next % len(s.targets)
+		s.next++
+	case EndpointSelectionWeighted:
+		// Smooth weighted round-robin spreads the picks of heavy targets
+		total := int64(0)
+		for i, weight := range s.weights {
+			s.current[i] += weight
+			total += weight
+			if s.current[i] > s.current[idx] {
+				idx = i
+			}
+		}
+		s.current[idx] -= total
+	case EndpointSelectionRandom:
+		idx = s.rand.Intn(len(s.targets))
+	case EndpointSelectionLeastConn:
+		for i, active := range s.active {
+			if active.Value() < s.active[idx].Value() {
+				idx = i
+			}
+		}
+	case EndpointSelectionSticky:
+		h := fnv.New32a()
+		h.Write([]byte(ctx.UserId))
+		idx = int(h.Sum32() % uint32(len(s.targets)))
+	}
+
+	labels := metrics.Labels{metrics.LabelHost: s.labels[idx]}
+	if ctx.Phase != "" {
+		labels[metrics.LabelPhase] = ctx.Phase
+	}
+	s.registry.Counter("host:users", labels).Inc()
+	s.active[idx].Add(1)
+	return &EndpointLease{
+		Target: s.targets[idx],
+		active: s.active[idx],
+		errors: s.registry.Counter("host:errors", labels),
+	}, nil
+}
+
+// Samples returns the users of each target host and phase as host:users,
+// those which failed as host:errors and the users still running as
+// host:active.
+func (s *EndpointSelector) Samples() []metrics.Sample {
+	return s.registry.Samples()
+}
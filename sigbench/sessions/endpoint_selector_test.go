@@ -0,0 +1,112 @@
+package sessions
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"microsoft.com/sigbench/metrics"
+)
+
+func selectTargets(t *testing.T, s *EndpointSelector, params map[string]string, targets string, users ...string) []string {
+	var selected []string
+	for _, user := range users {
+		lease, err := s.Select(&UserContext{UserId: user, Params: params}, targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		selected = append(selected, lease.Target)
+	}
+	return selected
+}
+
+func TestEndpointSelector(t *testing.T) {
+	t.Run("Round-robin", func(t *testing.T) {
+		var s EndpointSelector
+		s.Reset()
+		selected := selectTargets(t, &s, map[string]string{}, "a,b,c", "1", "2", "3", "4")
+		if strings.Join(selected, ",") != "a,b,c,a" {
+			t.Fatal("Unexpected targets", selected)
+		}
+	})
+
+	t.Run("Weighted", func(t *testing.T) {
+		var s EndpointSelector
+		s.Reset()
+		params := map[string]string{ParamEndpointSelection: "weighted", ParamEndpointWeights: "3,1"}
+		selected := selectTargets(t, &s, params, "a,b", "1", "2", "3", "4", "5", "6", "7", "8")
+		if strings.Join(selected, ",") != "a,a,b,a,a,a,b,a" {
+			t.Fatal("Unexpected targets", selected)
+		}
+	})
+
+	t.Run("Least connections", func(t *testing.T) {
+		var s EndpointSelector
+		s.Reset()
+		params := map[string]string{ParamEndpointSelection: "leastconn"}
+		ctx := &UserContext{Params: params}
+		first, _ := s.Select(ctx, "a,b")
+		second, _ := s.Select(ctx, "a,b")
+		first.Release(nil)
+		third, _ := s.Select(ctx, "a,b")
+		if first.Target != "a" || second.Target != "b" || third.Target != "a" {
+			t.Fatal("Unexpected targets", first.Target, second.Target, third.Target)
+		}
+	})
+
+	t.Run("Sticky", func(t *testing.T) {
+		var s EndpointSelector
+		s.Reset()
+		params := map[string]string{ParamEndpointSelection: "sticky"}
+		selected := selectTargets(t, &s, params, "a,b,c,d", "user1", "user2", "user1", "user2")
+		if selected[0] != selected[2] || selected[1] != selected[3] {
+			t.Fatal("Expect the same targets for the same users but", selected)
+		}
+	})
+
+	t.Run("Random", func(t *testing.T) {
+		var s EndpointSelector
+		s.Reset()
+		params := map[string]string{ParamEndpointSelection: "random"}
+		for _, target := range selectTargets(t, &s, params, "a,b", "1", "2", "3") {
+			if target != "a" && target != "b" {
+				t.Fatal("Unexpected target", target)
+			}
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		var s EndpointSelector
+		s.Reset()
+		for _, params := range []map[string]string{
+			{ParamEndpointSelection: "fastest"},
+			{ParamEndpointSelection: "weighted", ParamEndpointWeights: "1"},
+			{ParamEndpointSelection: "weighted", ParamEndpointWeights: "1,0"},
+		} {
+			if _, err := s.Select(&UserContext{Params: params}, "a,b"); err == nil {
+				t.Fatal("Expect error for", params)
+			}
+		}
+	})
+}
+
+func TestEndpointSelectorSamples(t *testing.T) {
+	var s EndpointSelector
+	s.Reset()
+	ctx := &UserContext{Phase: "peak", Params: map[string]string{}}
+	targets := "ws://a:5000/ws,ws://b:5000/ws?x=1"
+	first, _ := s.Select(ctx, targets)
+	second, _ := s.Select(ctx, targets)
+	third, _ := s.Select(ctx, targets)
+	first.Release(nil)
+	second.Release(errors.New("fail"))
+
+	counters := metrics.Flatten(s.Samples())
+	if counters["host:users{host=a:5000,phase=peak}"] != 2 || counters["host:active{host=a:5000}"] != 1 || counters["host:errors{host=a:5000,phase=peak}"] != 0 {
+		t.Fatal("Unexpected counters of a", counters)
+	}
+	if counters["host:users{host=b:5000,phase=peak}"] != 1 || counters["host:active{host=b:5000}"] != 0 || counters["host:errors{host=b:5000,phase=peak}"] != 1 {
+		t.Fatal("Unexpected counters of b", counters)
+	}
+	third.Release(nil)
+}
@@ -0,0 +1,130 @@
+package sessions
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEndpointUrls(t *testing.T) {
+	endpoint, err := NewEndpoint("example.com:5001", map[string]string{ParamScheme: "https"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.HttpUrl("/chat") != "https://example.com:5001/chat" || endpoint.WsUrl("/chat") != "wss://example.com:5001/chat" {
+		t.Fatal("Expect secure urls but got", endpoint.HttpUrl("/chat"), endpoint.WsUrl("/chat"))
+	}
+
+	if _, err = NewEndpoint("example.com", map[string]string{ParamScheme: "ftp"}, nil); err == nil {
+		t.Fatal("Expect error for unknown scheme")
+	}
+}
+
+func TestDialWebsocketTLS(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c.Close()
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "sigbench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err = ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test certificate is issued for example.com
+	params := map[string]string{
+		ParamScheme:        "https",
+		ParamTLSCAFile:     caFile,
+		ParamTLSServerName: "example.com",
+	}
+	var counters ConnectCounters
+	counters.Reset()
+	endpoint, err := NewEndpoint(strings.TrimPrefix(server.URL, "https://"), params, &counters)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, endpoint.HttpUrl("/"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := endpoint.Do(req)
+	if err != nil {
+		t.Fatal("Expect https request to succeed but got", err)
+	}
+	resp.Body.Close()
+
+	c, _, err := endpoint.DialWebsocket("/")
+	if err != nil {
+		t.Fatal("Expect wss dial to succeed but got", err)
+	}
+	c.Close()
+
+	recorded := map[string]int64{}
+	counters.AddCounters(recorded, "test")
+	if n := sumCounters(recorded, "test:connect:tls:"); n != 2 {
+		t.Fatal("Expect two TLS handshakes but got", recorded)
+	}
+	if n := sumCounters(recorded, "test:connect:tcp:"); n != 2 {
+		t.Fatal("Expect two TCP connects but got", recorded)
+	}
+	if n := sumCounters(recorded, "test:connect:websocket:"); n != 1 {
+		t.Fatal("Expect one websocket dial but got", recorded)
+	}
+}
+
+func sumCounters(counters map[string]int64, prefix string) int64 {
+	total := int64(0)
+	for key, cnt := range counters {
+		if strings.HasPrefix(key, prefix) {
+			total += cnt
+		}
+	}
+	return total
+}
+
+func TestConnectCountersReset(t *testing.T) {
+	var c ConnectCounters
+	c.Record(ConnectStageTotal, 20*time.Millisecond)
+
+	// Counters are read while the next job is set up
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			c.AddCounters(make(map[string]int64), "test")
+		}
+	}()
+	c.Reset()
+	<-done
+
+	counters := make(map[string]int64)
+	c.AddCounters(counters, "test")
+	if counters["test:connect:"+ConnectStageTotal+":<50"] != 0 {
+		t.Fatal("Expect the stages to be reset but got", counters)
+	}
+	c.Record(ConnectStageTotal, 20*time.Millisecond)
+	c.AddCounters(counters, "test")
+	if counters["test:connect:"+ConnectStageTotal+":<50"] != 1 {
+		t.Fatal("Expect the stage to be recorded after reset but got", counters)
+	}
+}
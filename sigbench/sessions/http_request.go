@@ -0,0 +1,248 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"microsoft.com/sigbench/metrics"
+)
+
+// LabelStatus labels the responses of each HTTP status code.
+const LabelStatus = "status"
+
+// HttpRequestSession sends the HTTP request described by the http* session
+// parameters, e.g. to benchmark negotiate endpoints in isolation.
+type HttpRequestSession struct {
+	counterInitiated int64
+	counterRequests  int64
+	counterCompleted int64
+	counterError     int64
+	counterStatus    int64
+	latency          *LatencyHistogram
+	sendRate         SendRateCounter
+	client           *http.Client
+	connect          ConnectCounters
+
+	statuses  metrics.Registry
+	endpoints EndpointSelector
+	phases    PhaseMetrics
+}
+
+func (s *HttpRequestSession) Name() string {
+	return "Http:Request"
+}
+
+func (s *HttpRequestSession) Setup(sessionParams map[string]string) error {
+	// The keep-alive connections of the previous job are not reused
+	if s.client != nil {
+		s.client.CloseIdleConnections()
+	}
+	s.endpoints.Reset()
+	s.phases.Reset()
+	s.counterInitiated = 0
+	s.counterRequests = 0
+	s.counterCompleted = 0
+	s.counterError = 0
+	s.counterStatus = 0
+	s.latency = NewLatencyHistogram()
+	s.sendRate.Reset()
+	s.connect.Reset()
+	s.statuses.Reset()
+
+	keepAlive := true
+	if keepAliveStr, ok := sessionParams[ParamHttpKeepAlive]; ok {
+		var err error
+		if keepAlive, err = strconv.ParseBool(keepAliveStr); err != nil {
+			return err
+		}
+	}
+	tlsConfig, err := NewTLSConfigFromParams(sessionParams)
+	if err != nil {
+		return err
+	}
+	factory, err := ConnectionFactoryFromParams(sessionParams)
+	if err != nil {
+		return err
+	}
+	transport := factory.NewTransport(tlsConfig)
+	transport.DisableKeepAlives = !keepAlive
+	if _, ok := sessionParams[ParamMaxIdleConns]; !ok {
+		transport.MaxIdleConnsPerHost = 1024
+	}
+	s.client = &http.Client{
+		Transport: transport,
+		Timeout:   recvTimeout(sessionParams),
+	}
+	return nil
+}
+
+func (s *HttpRequestSession) logError(ctx *UserContext, msg string, err error) {
+	log.Printf("[Error][%s] %s due to %s", ctx.UserId, msg, err)
+	atomic.AddInt64(&s.counterError, 1)
+	s.phases.Add(ctx, "errors", 1)
+}
+
+func (s *HttpRequestSession) logStatus(status int) {
+	s.statuses.Counter("responses", metrics.Labels{LabelStatus: strconv.Itoa(status)}).Inc()
+}
+
+// expectedStatus returns the status code requests must answer with, 0 means
+// any 2xx status.
+func expectedStatus(params map[string]string) (int, error) {
+	statusStr, ok := params[ParamHttpExpectedStatus]
+	if !ok {
+		return 0, nil
+	}
+	return strconv.Atoi(statusStr)
+}
+
+func (s *HttpRequestSession) Execute(ctx *UserContext) (err error) {
+	atomic.AddInt64(&s.counterInitiated, 1)
+	defer atomic.AddInt64(&s.counterInitiated, -1)
+
+	lease, err := s.endpoints.Select(ctx, ctx.Params[ParamHttpUrl])
+	if err != nil {
+		s.logError(ctx, "Invalid endpoint selection", err)
+		return err
+	}
+	defer func() { lease.Release(err) }()
+	url := lease.Target
+
+	method := ctx.Params[ParamHttpMethod]
+	if method == "" {
+		method = http.MethodGet
+	}
+	header := http.Header{}
+	if headersStr, ok := ctx.Params[ParamHttpHeaders]; ok {
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(headersStr), &headers); err != nil {
+			s.logError(ctx, "Invalid http headers", err)
+			return err
+		}
+		for key, value := range headers {
+			header.Set(key, value)
+		}
+	}
+	status, err := expectedStatus(ctx.Params)
+	if err != nil {
+		s.logError(ctx, "Invalid expected status", err)
+		return err
+	}
+	count := 1
+	if countStr, ok := ctx.Params[ParamHttpRequestCount]; ok {
+		if count, err = strconv.Atoi(countStr); err != nil {
+			s.logError(ctx, "Invalid request count", err)
+			return err
+		}
+	}
+	pacer, err := NewPacerFromParams(ctx.Params, 1)
+	if err != nil {
+		s.logError(ctx, "Invalid send rate", err)
+		return err
+	}
+
+	s.sendRate.Start(pacer)
+	defer s.sendRate.Stop(pacer)
+
+	phase := httpRequestPhase{
+		requests: s.phases.Counter(ctx, "requests"),
+		latency:  s.phases.Histogram(ctx, "latency"),
+	}
+	sent := 0
+	for sent < count {
+		n := pacer.Wait()
+		for i := 0; i < n && sent < count; i++ {
+			sent++
+			if err = s.request(ctx, &phase, method, url, header, status); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// httpRequestPhase holds the metrics of the user's phase.
+type httpRequestPhase struct {
+	requests *metrics.Counter
+	latency  *metrics.Histogram
+}
+
+func (s *HttpRequestSession) request(ctx *UserContext, phase *httpRequestPhase, method, url string, header http.Header, status int) error {
+	var body io.Reader
+	if bodyStr, ok := ctx.Params[ParamHttpBody]; ok {
+		body = strings.NewReader(bodyStr)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		s.logError(ctx, "Fail to construct request", err)
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	start := time.Now()
+	atomic.AddInt64(&s.counterRequests, 1)
+	phase.requests.Inc()
+	s.sendRate.Sent(1)
+	resp, err := s.client.Do(withConnectTrace(req, &s.connect))
+	if err != nil {
+		s.logError(ctx, "Fail to send request", err)
+		return err
+	}
+	// Drain the body so that the connection can be reused
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		s.logError(ctx, "Fail to read response", err)
+		return err
+	}
+
+	latency := int64(time.Now().Sub(start) / time.Millisecond)
+	s.latency.Record(latency)
+	phase.latency.Observe(latency)
+	s.logStatus(resp.StatusCode)
+
+	if (status == 0 && resp.StatusCode/100 != 2) || (status != 0 && resp.StatusCode != status) {
+		atomic.AddInt64(&s.counterStatus, 1)
+		s.logError(ctx, "Unexpected response status", errors.New(resp.Status))
+		return errors.New("unexpected response status " + resp.Status)
+	}
+
+	atomic.AddInt64(&s.counterCompleted, 1)
+	return nil
+}
+
+func (s *HttpRequestSession) Counters() map[string]int64 {
+	counters := map[string]int64{
+		"http:request:inprogress":            atomic.LoadInt64(&s.counterInitiated),
+		"http:request:requests":              atomic.LoadInt64(&s.counterRequests),
+		"http:request:completed":             atomic.LoadInt64(&s.counterCompleted),
+		"http:request:error":                 atomic.LoadInt64(&s.counterError),
+		"http:request:error:status":          atomic.LoadInt64(&s.counterStatus),
+		"http:request:sendrate:target":       int64(math.Round(s.sendRate.Target())),
+		"http:request:sendrate:target:milli": s.sendRate.TargetMilli(),
+		"http:request:sendrate:measured":     s.sendRate.Measured(),
+	}
+	if s.latency != nil {
+		s.latency.AddCounters(counters, "http:request:latency")
+	}
+	s.connect.AddCounters(counters, "http:request")
+	return counters
+}
+
+func (s *HttpRequestSession) Metrics() []metrics.Sample {
+	samples := append(s.endpoints.Samples(), s.connect.Samples()...)
+	samples = append(samples, s.statuses.Samples()...)
+	return append(samples, s.phases.Samples()...)
+}
@@ -0,0 +1,88 @@
+package sessions
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"microsoft.com/sigbench/metrics"
+)
+
+func TestHttpRequestSession(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != http.MethodPost || r.Header.Get("X-Test") != "1" || string(body) != "ping" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	params := map[string]string{
+		ParamHttpUrl:            server.URL,
+		ParamHttpMethod:         http.MethodPost,
+		ParamHttpHeaders:        `{"X-Test": "1"}`,
+		ParamHttpBody:           "ping",
+		ParamHttpExpectedStatus: "202",
+		ParamHttpRequestCount:   "3",
+		ParamSendRate:           "1000",
+	}
+	s := &HttpRequestSession{}
+	if err := s.Setup(params); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Execute(&UserContext{UserId: "u", Params: params}); err != nil {
+		t.Fatal("Expect requests to succeed but got", err)
+	}
+
+	counters := s.Counters()
+	if counters["http:request:completed"] != 3 {
+		t.Fatal("Expect 3 completed requests but got", counters)
+	}
+	if statuses := metrics.Flatten(s.Metrics()); statuses["responses{status=202}"] != 3 {
+		t.Fatal("Expect 3 accepted responses but got", statuses)
+	}
+
+	params[ParamHttpExpectedStatus] = "200"
+	if err := s.Execute(&UserContext{UserId: "u", Params: params}); err == nil {
+		t.Fatal("Expect unexpected status to fail")
+	}
+	if s.Counters()["http:request:error:status"] != 1 {
+		t.Fatal("Expect one unexpected status")
+	}
+}
+
+func TestHttpRequestSessionSetupClosesIdle(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	params := map[string]string{ParamHttpUrl: server.URL}
+	s := &HttpRequestSession{}
+	if err := s.Setup(params); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Execute(&UserContext{UserId: "u", Params: params}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next job closes the idle connection of the previous one
+	if err := s.Setup(params); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expect the idle connection to be closed")
+	}
+}
@@ -0,0 +1,51 @@
+package sessions
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+var DefaultLatencyBounds = []int64{100, 500, 1000}
+
+// LatencyHistogram counts latencies in milliseconds into buckets separated by
+// the given upper bounds, plus one overflow bucket.
+type LatencyHistogram struct {
+	bounds []int64
+	counts []int64
+}
+
+func NewLatencyHistogram(bounds ...int64) *LatencyHistogram {
+	if len(bounds) == 0 {
+		bounds = DefaultLatencyBounds
+	}
+	return &LatencyHistogram{
+		bounds: bounds,
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+func (h *LatencyHistogram) Reset() {
+	for i := range h.counts {
+		atomic.StoreInt64(&h.counts[i], 0)
+	}
+}
+
+func (h *LatencyHistogram) Record(latency int64) {
+	for i, bound := range h.bounds {
+		if latency < bound {
+			atomic.AddInt64(&h.counts[i], 1)
+			return
+		}
+	}
+	atomic.AddInt64(&h.counts[len(h.bounds)], 1)
+}
+
+// AddCounters writes the buckets into counters using the same key format as
+// the sessions, e.g. "<prefix>:<100" and "<prefix>:>=1000".
+func (h *LatencyHistogram) AddCounters(counters map[string]int64, prefix string) {
+	for i, bound := range h.bounds {
+		counters[prefix+":<"+strconv.FormatInt(bound, 10)] = atomic.LoadInt64(&h.counts[i])
+	}
+	last := h.bounds[len(h.bounds)-1]
+	counters[prefix+":>="+strconv.FormatInt(last, 10)] = atomic.LoadInt64(&h.counts[len(h.bounds)])
+}
@@ -0,0 +1,219 @@
+package sessions
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PacerModeConstant = "constant"
+	PacerModePoisson  = "poisson"
+	PacerModeBurst    = "burst"
+)
+
+// Pacer decides when a sender session should send its next message(s).
+// Sends are scheduled against absolute deadlines so that the long-term rate
+// matches the target even if individual sends are slow.
+type Pacer struct {
+	rate      float64
+	mode      string
+	burstSize int
+	next      time.Time
+	rand      *rand.Rand
+}
+
+func NewPacer(rate float64, mode string, burstSize int) (*Pacer, error) {
+	if rate <= 0 {
+		return nil, errors.New("send rate must be positive")
+	}
+	if burstSize < 1 {
+		burstSize = 1
+	}
+
+	switch mode {
+	case "":
+		mode = PacerModeConstant
+	case PacerModeConstant, PacerModePoisson, PacerModeBurst:
+	default:
+		return nil, errors.New("unknown send mode: " + mode)
+	}
+
+	return &Pacer{
+		rate:      rate,
+		mode:      mode,
+		burstSize: burstSize,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+// NewPacerFromParams builds a pacer from session params. The legacy
+// publishInterval param (in microseconds) is honored when sendRate is absent.
+func NewPacerFromParams(params map[string]string, defaultRate float64) (*Pacer, error) {
+	rate := defaultRate
+	if rateStr, ok := params[ParamSendRate]; ok {
+		r, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil {
+			return nil, err
+		}
+		rate = r
+	} else if intervalStr, ok := params[ParamPublishInterval]; ok {
+		interval, err := strconv.Atoi(intervalStr)
+		if err != nil {
+			return nil, err
+		}
+		if interval <= 0 {
+			return nil, errors.New("publish interval must be positive")
+		}
+		rate = float64(time.Second/time.Microsecond) / float64(interval)
+	}
+
+	burstSize := 1
+	if burstStr, ok := params[ParamBurstSize]; ok {
+		b, err := strconv.Atoi(burstStr)
+		if err != nil {
+			return nil, err
+		}
+		burstSize = b
+	}
+
+	return NewPacer(rate, params[ParamSendMode], burstSize)
+}
+
+// Rate returns the target messages per second.
+func (p *Pacer) Rate() float64 {
+	return p.rate
+}
+
+// batch returns the number of messages to send at one slot.
+func (p *Pacer) batch() int {
+	if p.mode == PacerModeBurst {
+		return p.burstSize
+	}
+	return 1
+}
+
+// interval returns the time between the current slot and the next one.
+func (p *Pacer) interval() time.Duration {
+	secs := 1 / p.rate
+	switch p.mode {
+	case PacerModePoisson:
+		secs = p.rand.ExpFloat64() / p.rate
+	case PacerModeBurst:
+		secs = float64(p.burstSize) / p.rate
+	}
+	return time.Duration(secs * float64(time.Second))
+}
+
+// Wait blocks until the next send slot and returns how many messages should
+// be sent in it. The first call returns immediately.
+func (p *Pacer) Wait() int {
+	return p.WaitUntil(time.Time{})
+}
+
+// WaitUntil is like Wait but never sleeps past deadline, so that a sender
+// with a slow rate stops on time. The zero deadline means no deadline.
+func (p *Pacer) WaitUntil(deadline time.Time) int {
+	now := time.Now()
+	if p.next.IsZero() {
+		p.next = now
+	}
+	d := p.next.Sub(now)
+	if !deadline.IsZero() && deadline.Sub(now) < d {
+		d = deadline.Sub(now)
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+	p.next = p.next.Add(p.interval())
+	return p.batch()
+}
+
+// RateMeter counts events per wall-clock second.
+type RateMeter struct {
+	lock    sync.Mutex
+	sec     int64
+	curCnt  int64
+	lastCnt int64
+}
+
+func (m *RateMeter) Reset() {
+	m.lock.Lock()
+	m.sec = 0
+	m.curCnt = 0
+	m.lastCnt = 0
+	m.lock.Unlock()
+}
+
+// roll moves the current bucket forward to the given second. Must be called
+// with lock held.
+func (m *RateMeter) roll(sec int64) {
+	if sec == m.sec {
+		return
+	}
+	if sec == m.sec+1 {
+		m.lastCnt = m.curCnt
+	} else {
+		m.lastCnt = 0
+	}
+	m.curCnt = 0
+	m.sec = sec
+}
+
+func (m *RateMeter) Add(n int) {
+	m.lock.Lock()
+	m.roll(time.Now().Unix())
+	m.curCnt += int64(n)
+	m.lock.Unlock()
+}
+
+// Rate returns the number of events during the last full second.
+func (m *RateMeter) Rate() int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.roll(time.Now().Unix())
+	return m.lastCnt
+}
+
+// SendRateCounter tracks the aggregated target send rate of all active
+// senders of a session together with the rate measured over the last second.
+type SendRateCounter struct {
+	targetMilli int64
+	meter       RateMeter
+}
+
+func (c *SendRateCounter) Reset() {
+	atomic.StoreInt64(&c.targetMilli, 0)
+	c.meter.Reset()
+}
+
+func (c *SendRateCounter) Start(p *Pacer) {
+	atomic.AddInt64(&c.targetMilli, int64(p.Rate()*1000))
+}
+
+func (c *SendRateCounter) Stop(p *Pacer) {
+	atomic.AddInt64(&c.targetMilli, -int64(p.Rate()*1000))
+}
+
+func (c *SendRateCounter) Sent(n int) {
+	c.meter.Add(n)
+}
+
+// Target returns the sum of target rates in messages per second.
+func (c *SendRateCounter) Target() float64 {
+	return float64(atomic.LoadInt64(&c.targetMilli)) / 1000
+}
+
+// TargetMilli returns the sum of target rates in messages per 1000 seconds,
+// for counters which can't hold fractional rates.
+func (c *SendRateCounter) TargetMilli() int64 {
+	return atomic.LoadInt64(&c.targetMilli)
+}
+
+// Measured returns the number of messages sent during the last full second.
+func (c *SendRateCounter) Measured() int64 {
+	return c.meter.Rate()
+}
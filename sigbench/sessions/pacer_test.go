@@ -0,0 +1,128 @@
+package sessions
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPacer(t *testing.T) {
+	t.Run("constant", func(t *testing.T) {
+		p, err := NewPacer(4, PacerModeConstant, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := p.batch(); n != 1 {
+			t.Fatal("Constant batch should be 1 but", n)
+		}
+		if d := p.interval(); d != 250*time.Millisecond {
+			t.Fatal("Constant interval should be 250ms but", d)
+		}
+	})
+
+	t.Run("burst", func(t *testing.T) {
+		p, err := NewPacer(4, PacerModeBurst, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := p.batch(); n != 10 {
+			t.Fatal("Burst batch should be 10 but", n)
+		}
+		if d := p.interval(); d != 2500*time.Millisecond {
+			t.Fatal("Burst interval should be 2.5s but", d)
+		}
+	})
+
+	t.Run("poisson", func(t *testing.T) {
+		p, err := NewPacer(100, PacerModePoisson, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := time.Duration(0)
+		for i := 0; i < 10000; i++ {
+			total += p.interval()
+		}
+		if mean := total / 10000; mean < 9*time.Millisecond || mean > 11*time.Millisecond {
+			t.Fatal("Poisson mean interval should be around 10ms but", mean)
+		}
+	})
+
+	t.Run("publishInterval", func(t *testing.T) {
+		p, err := NewPacerFromParams(map[string]string{ParamPublishInterval: "500000"}, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := p.Rate(); r != 2 {
+			t.Fatal("Rate should be 2 but", r)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		if _, err := NewPacer(0, PacerModeConstant, 1); err == nil {
+			t.Fatal("Zero rate should be rejected")
+		}
+		if _, err := NewPacer(1, "foobar", 1); err == nil {
+			t.Fatal("Unknown mode should be rejected")
+		}
+	})
+}
+
+func TestPacerWaitUntil(t *testing.T) {
+	p, err := NewPacer(0.1, PacerModeConstant, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Wait()
+
+	start := time.Now()
+	deadline := start.Add(50 * time.Millisecond)
+	p.WaitUntil(deadline)
+	if elapsed := time.Now().Sub(start); elapsed > time.Second {
+		t.Fatal("Expect to stop at the deadline but waited", elapsed)
+	}
+}
+
+func TestSendRateCounter(t *testing.T) {
+	var c SendRateCounter
+	c.Reset()
+	p, _ := NewPacer(0.25, PacerModeConstant, 1)
+	c.Start(p)
+	c.Start(p)
+	if target := c.Target(); target != 0.5 {
+		t.Fatal("Target should be 0.5 but", target)
+	}
+	if milli := c.TargetMilli(); milli != 500 {
+		t.Fatal("Target milli should be 500 but", milli)
+	}
+	c.Stop(p)
+	c.Stop(p)
+	if target := c.Target(); target != 0 {
+		t.Fatal("Target should be 0 but", target)
+	}
+}
+
+func TestRateMeter(t *testing.T) {
+	var m RateMeter
+	m.Reset()
+	m.roll(100)
+	m.curCnt = 5
+
+	m.roll(100)
+	if m.curCnt != 5 || m.lastCnt != 0 {
+		t.Fatal("Expect the same second to keep counting but got", m.curCnt, m.lastCnt)
+	}
+	m.roll(101)
+	if m.curCnt != 0 || m.lastCnt != 5 {
+		t.Fatal("Expect the last second to hold 5 but got", m.curCnt, m.lastCnt)
+	}
+	m.curCnt = 7
+	m.roll(103)
+	if m.lastCnt != 0 {
+		t.Fatal("Expect an idle second to reset the rate but got", m.lastCnt)
+	}
+
+	m.Reset()
+	m.Add(3)
+	if rate := m.Rate(); rate != 0 && rate != 3 {
+		t.Fatal("Expect the rate of at most one second but got", rate)
+	}
+}
@@ -0,0 +1,51 @@
+package sessions
+
+import "microsoft.com/sigbench/metrics"
+
+// PhaseMetrics records metrics of a session by the phase of the user, on top
+// of the totals of the session, so that e.g. the users of a ramp-up phase
+// don't pollute the numbers of a steady phase. Users without a phase are
+// only counted in the totals.
+type PhaseMetrics struct {
+	registry metrics.Registry
+}
+
+func (p *PhaseMetrics) Reset() {
+	p.registry.Reset()
+}
+
+// Counter returns the counter name of the user's phase. Sessions look it up
+// once per user and use it for every message, which spares them the registry
+// lock. Users without a phase get a counter which is not reported.
+func (p *PhaseMetrics) Counter(ctx *UserContext, name string) *metrics.Counter {
+	if ctx.Phase == "" {
+		return &metrics.Counter{}
+	}
+	return p.registry.Counter(name, metrics.Labels{metrics.LabelPhase: ctx.Phase})
+}
+
+// Histogram returns the latency histogram name of the user's phase in
+// milliseconds, with DefaultLatencyBounds if no bounds are given. Like
+// Counter, it is looked up once per user.
+func (p *PhaseMetrics) Histogram(ctx *UserContext, name string, bounds ...int64) *metrics.Histogram {
+	if len(bounds) == 0 {
+		bounds = DefaultLatencyBounds
+	}
+	if ctx.Phase == "" {
+		return metrics.NewHistogram(bounds...)
+	}
+	return p.registry.Histogram(name, metrics.Labels{metrics.LabelPhase: ctx.Phase}, bounds...)
+}
+
+// Add adds n to the counter name of the user's phase, for occasional events
+// like errors.
+func (p *PhaseMetrics) Add(ctx *UserContext, name string, n int64) {
+	if ctx.Phase == "" {
+		return
+	}
+	p.Counter(ctx, name).Add(n)
+}
+
+func (p *PhaseMetrics) Samples() []metrics.Sample {
+	return p.registry.Samples()
+}
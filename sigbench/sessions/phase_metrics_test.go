@@ -0,0 +1,31 @@
+package sessions
+
+import (
+	"testing"
+
+	"microsoft.com/sigbench/metrics"
+)
+
+func TestPhaseMetrics(t *testing.T) {
+	var p PhaseMetrics
+	p.Reset()
+	p.Add(&UserContext{Phase: "ramp"}, "errors", 1)
+	p.Add(&UserContext{Phase: "steady"}, "errors", 2)
+	p.Add(&UserContext{}, "errors", 4)
+	p.Histogram(&UserContext{Phase: "steady"}, "latency").Observe(150)
+	p.Counter(&UserContext{}, "messages:recv").Inc()
+	p.Histogram(&UserContext{}, "latency").Observe(150)
+
+	counters := metrics.Flatten(p.Samples())
+	if counters["errors{phase=ramp}"] != 1 || counters["errors{phase=steady}"] != 2 || counters["errors"] != 0 {
+		t.Fatal("Unexpected counters", counters)
+	}
+	if counters["latency{phase=steady}:<500"] != 1 || counters["latency:<500"] != 0 || counters["messages:recv"] != 0 {
+		t.Fatal("Unexpected latency", counters)
+	}
+
+	p.Reset()
+	if samples := p.Samples(); len(samples) != 0 {
+		t.Fatal("Expect no samples after reset but got", samples)
+	}
+}
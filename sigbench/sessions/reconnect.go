@@ -0,0 +1,219 @@
+package sessions
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	ReconnectPolicyNone        = "none"
+	ReconnectPolicyImmediate   = "immediate"
+	ReconnectPolicyFixed       = "fixed"
+	ReconnectPolicyExponential = "exponential"
+)
+
+// ReconnectPolicy decides whether and when a session reconnects after its
+// connection dropped.
+type ReconnectPolicy struct {
+	policy      string
+	delay       time.Duration
+	maxDelay    time.Duration
+	maxAttempts int
+
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+func NewReconnectPolicyFromParams(params map[string]string) (*ReconnectPolicy, error) {
+	p := &ReconnectPolicy{
+		policy:      params[ParamReconnectPolicy],
+		delay:       time.Second,
+		maxDelay:    30 * time.Second,
+		maxAttempts: 10,
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	switch p.policy {
+	case "":
+		p.policy = ReconnectPolicyNone
+	case ReconnectPolicyNone, ReconnectPolicyImmediate, ReconnectPolicyFixed, ReconnectPolicyExponential:
+	default:
+		return nil, errors.New("unknown reconnect policy: " + p.policy)
+	}
+
+	if msStr, ok := params[ParamReconnectDelayMs]; ok {
+		ms, err := strconv.Atoi(msStr)
+		if err != nil {
+			return nil, err
+		}
+		p.delay = time.Duration(ms) * time.Millisecond
+	}
+	if msStr, ok := params[ParamReconnectMaxDelayMs]; ok {
+		ms, err := strconv.Atoi(msStr)
+		if err != nil {
+			return nil, err
+		}
+		p.maxDelay = time.Duration(ms) * time.Millisecond
+	}
+	if attemptsStr, ok := params[ParamReconnectMaxAttempts]; ok {
+		attempts, err := strconv.Atoi(attemptsStr)
+		if err != nil {
+			return nil, err
+		}
+		p.maxAttempts = attempts
+	}
+
+	return p, nil
+}
+
+func (p *ReconnectPolicy) Enabled() bool {
+	return p.policy != ReconnectPolicyNone
+}
+
+// Delay returns how long to wait before the given attempt, counting from 0.
+func (p *ReconnectPolicy) Delay(attempt int) time.Duration {
+	switch p.policy {
+	case ReconnectPolicyFixed:
+		return p.delay
+	case ReconnectPolicyExponential:
+		d := p.delay
+		for i := 0; i < attempt && d < p.maxDelay; i++ {
+			d *= 2
+		}
+		if d > p.maxDelay {
+			d = p.maxDelay
+		}
+		// Equal jitter: keep half of the backoff and randomize the other half
+		// so that dropped clients do not come back in lockstep.
+		half := int64(d / 2)
+		if half <= 0 {
+			return d
+		}
+		p.lock.Lock()
+		jitter := p.rand.Int63n(half)
+		p.lock.Unlock()
+		return time.Duration(half + jitter)
+	default:
+		return 0
+	}
+}
+
+// Reconnect calls dial until it succeeds or the attempts are exhausted.
+func (p *ReconnectPolicy) Reconnect(counters *ReconnectCounters, dial func() error) error {
+	if !p.Enabled() {
+		return errors.New("reconnect disabled")
+	}
+
+	start := time.Now()
+	var err error
+	for attempt := 0; p.maxAttempts <= 0 || attempt < p.maxAttempts; attempt++ {
+		time.Sleep(p.Delay(attempt))
+
+		atomic.AddInt64(&counters.cntAttempts, 1)
+		if err = dial(); err == nil {
+			atomic.AddInt64(&counters.cntSuccess, 1)
+			counters.histogram().Record(int64(time.Now().Sub(start) / time.Millisecond))
+			return nil
+		}
+	}
+
+	atomic.AddInt64(&counters.cntFailed, 1)
+	return err
+}
+
+// ReconnectCounters aggregates reconnects of all users of a session.
+type ReconnectCounters struct {
+	cntDisconnected int64
+	cntAttempts     int64
+	cntSuccess      int64
+	cntFailed       int64
+	cntDropped      int64
+	latencyOnce     sync.Once
+	latency         *LatencyHistogram
+}
+
+// histogram returns the reconnect latency histogram, created once and reset
+// in place afterwards so that it can be read while a job is set up.
+func (c *ReconnectCounters) histogram() *LatencyHistogram {
+	c.latencyOnce.Do(func() {
+		c.latency = NewLatencyHistogram(1000, 5000, 10000, 30000)
+	})
+	return c.latency
+}
+
+func (c *ReconnectCounters) Reset() {
+	atomic.StoreInt64(&c.cntDisconnected, 0)
+	atomic.StoreInt64(&c.cntAttempts, 0)
+	atomic.StoreInt64(&c.cntSuccess, 0)
+	atomic.StoreInt64(&c.cntFailed, 0)
+	atomic.StoreInt64(&c.cntDropped, 0)
+	c.histogram().Reset()
+}
+
+func (c *ReconnectCounters) Disconnected() {
+	atomic.AddInt64(&c.cntDisconnected, 1)
+}
+
+func (c *ReconnectCounters) AddCounters(counters map[string]int64, prefix string) {
+	counters[prefix+":disconnected"] = atomic.LoadInt64(&c.cntDisconnected)
+	counters[prefix+":dropped"] = atomic.LoadInt64(&c.cntDropped)
+	counters[prefix+":reconnect:attempts"] = atomic.LoadInt64(&c.cntAttempts)
+	counters[prefix+":reconnect:success"] = atomic.LoadInt64(&c.cntSuccess)
+	counters[prefix+":reconnect:failed"] = atomic.LoadInt64(&c.cntFailed)
+	c.histogram().AddCounters(counters, prefix+":reconnect:time")
+}
+
+// ConnectionDropper forcibly closes a fraction of connections at a fixed
+// moment after the job started, simulating a server restart storm.
+type ConnectionDropper struct {
+	selected bool
+	at       time.Time
+}
+
+func NewConnectionDropperFromParams(ctx *UserContext) (*ConnectionDropper, error) {
+	d := &ConnectionDropper{}
+
+	fractionStr, ok := ctx.Params[ParamDropFraction]
+	if !ok {
+		return d, nil
+	}
+	fraction, err := strconv.ParseFloat(fractionStr, 64)
+	if err != nil {
+		return nil, err
+	}
+	secs, err := strconv.Atoi(ctx.Params[ParamDropAfterSecs])
+	if err != nil {
+		return nil, err
+	}
+
+	d.selected = rand.Float64() < fraction
+	d.at = ctx.JobStart.Add(time.Duration(secs) * time.Second)
+	return d, nil
+}
+
+// Schedule arranges for c to be closed at the drop moment if this user was
+// selected. The returned function cancels the drop and must be called once
+// the connection is done. It reports whether the connection was dropped.
+func (d *ConnectionDropper) Schedule(c *websocket.Conn, counters *ReconnectCounters) func() bool {
+	wait := d.at.Sub(time.Now())
+	if !d.selected || wait <= 0 {
+		return func() bool { return false }
+	}
+
+	dropped := int32(0)
+	timer := time.AfterFunc(wait, func() {
+		atomic.StoreInt32(&dropped, 1)
+		atomic.AddInt64(&counters.cntDropped, 1)
+		c.UnderlyingConn().Close()
+	})
+	return func() bool {
+		timer.Stop()
+		return atomic.LoadInt32(&dropped) == 1
+	}
+}
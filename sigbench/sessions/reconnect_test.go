@@ -0,0 +1,162 @@
+package sessions
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReconnectPolicyDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   map[string]string
+		attempt  int
+		min, max time.Duration
+	}{
+		{"none", map[string]string{}, 3, 0, 0},
+		{"immediate", map[string]string{ParamReconnectPolicy: "immediate"}, 3, 0, 0},
+		{"fixed", map[string]string{ParamReconnectPolicy: "fixed", ParamReconnectDelayMs: "200"}, 3, 200 * time.Millisecond, 200 * time.Millisecond},
+		{"exponential first", map[string]string{ParamReconnectPolicy: "exponential", ParamReconnectDelayMs: "100"}, 0, 50 * time.Millisecond, 100 * time.Millisecond},
+		{"exponential third", map[string]string{ParamReconnectPolicy: "exponential", ParamReconnectDelayMs: "100"}, 2, 200 * time.Millisecond, 400 * time.Millisecond},
+		{"exponential capped", map[string]string{ParamReconnectPolicy: "exponential", ParamReconnectDelayMs: "100", ParamReconnectMaxDelayMs: "1000"}, 20, 500 * time.Millisecond, time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := NewReconnectPolicyFromParams(test.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 100; i++ {
+				if d := p.Delay(test.attempt); d < test.min || d > test.max {
+					t.Fatal("Expect delay within", test.min, test.max, "but got", d)
+				}
+			}
+		})
+	}
+
+	for _, params := range []map[string]string{
+		{ParamReconnectPolicy: "sometimes"},
+		{ParamReconnectPolicy: "fixed", ParamReconnectDelayMs: "soon"},
+		{ParamReconnectPolicy: "fixed", ParamReconnectMaxAttempts: "many"},
+	} {
+		if _, err := NewReconnectPolicyFromParams(params); err == nil {
+			t.Fatal("Expect error for", params)
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   map[string]string
+		failures int
+		err      bool
+		attempts int64
+		success  int64
+		failed   int64
+	}{
+		{"disabled", map[string]string{}, 0, true, 0, 0, 0},
+		{"first attempt", map[string]string{ParamReconnectPolicy: "immediate"}, 0, false, 1, 1, 0},
+		{"after failures", map[string]string{ParamReconnectPolicy: "immediate"}, 2, false, 3, 1, 0},
+		{"exhausted", map[string]string{ParamReconnectPolicy: "immediate", ParamReconnectMaxAttempts: "3"}, 5, true, 3, 0, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := NewReconnectPolicyFromParams(test.params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var counters ReconnectCounters
+			counters.Reset()
+
+			failures := test.failures
+			err = p.Reconnect(&counters, func() error {
+				if failures > 0 {
+					failures--
+					return errors.New("refused")
+				}
+				return nil
+			})
+			if (err != nil) != test.err {
+				t.Fatal("Unexpected error", err)
+			}
+
+			c := make(map[string]int64)
+			counters.AddCounters(c, "test")
+			if c["test:reconnect:attempts"] != test.attempts || c["test:reconnect:success"] != test.success || c["test:reconnect:failed"] != test.failed {
+				t.Fatal("Unexpected counters", c)
+			}
+			if c["test:reconnect:time:<1000"] != test.success {
+				t.Fatal("Expect reconnect time of every success but got", c)
+			}
+		})
+	}
+}
+
+func TestConnectionDropper(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		params  map[string]string
+		dropped int64
+	}{
+		{"disabled", map[string]string{}, 0},
+		{"selected", map[string]string{ParamDropFraction: "1", ParamDropAfterSecs: "0"}, 1},
+		{"not selected", map[string]string{ParamDropFraction: "0", ParamDropAfterSecs: "0"}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The drop moment is relative to the job start
+			ctx := &UserContext{JobStart: time.Now().Add(100 * time.Millisecond), Params: test.params}
+			d, err := NewConnectionDropperFromParams(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			var counters ReconnectCounters
+			counters.Reset()
+			cancel := d.Schedule(c, &counters)
+			defer cancel()
+
+			c.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			_, _, err = c.ReadMessage()
+			if netErr, ok := err.(interface{ Timeout() bool }); test.dropped == 0 && (!ok || !netErr.Timeout()) {
+				t.Fatal("Expect the connection to stay open but got", err)
+			}
+
+			counter := make(map[string]int64)
+			counters.AddCounters(counter, "test")
+			if counter["test:dropped"] != test.dropped {
+				t.Fatal("Unexpected dropped count", counter)
+			}
+		})
+	}
+
+	if _, err := NewConnectionDropperFromParams(&UserContext{Params: map[string]string{ParamDropFraction: "half"}}); err == nil {
+		t.Fatal("Expect error for an invalid fraction")
+	}
+}
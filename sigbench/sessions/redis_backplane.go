@@ -0,0 +1,414 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	RedisModeStandalone = "standalone"
+	RedisModeSentinel   = "sentinel"
+	RedisModeCluster    = "cluster"
+)
+
+const redisClusterSlots = 16384
+
+// redisMaxRedirects bounds the MOVED and ASK redirects followed by a command.
+const redisMaxRedirects = 5
+
+// RedisBackplane hands out connections to a standalone redis, the master
+// of a Sentinel-managed group or the cluster node serving a key.
+type RedisBackplane struct {
+	key             string
+	mode            string
+	hosts           []string
+	sentinelMaster  string
+	options         []redis.DialOption
+	sentinelOptions []redis.DialOption
+	maxIdle         int
+	maxActive       int
+
+	// Standalone and sentinel
+	pool *redis.Pool
+
+	// Cluster, loaded on first use and updated by MOVED redirects. A failed
+	// load is retried by the next Get.
+	clusterLock sync.RWMutex
+	slots       []string
+	pools       map[string]*redis.Pool
+}
+
+// redisBackplaneKey identifies the session params a backplane was built
+// from.
+func redisBackplaneKey(params map[string]string) string {
+	data, _ := json.Marshal(params)
+	return string(data)
+}
+
+// SetupRedisBackplane returns b if it was built from the same params, so that
+// pools and cluster discovery survive between jobs, or closes it and builds a
+// new one otherwise.
+func SetupRedisBackplane(b *RedisBackplane, params map[string]string) (*RedisBackplane, error) {
+	if b != nil {
+		if b.key == redisBackplaneKey(params) {
+			return b, nil
+		}
+		b.Close()
+	}
+	return NewRedisBackplane(params)
+}
+
+func NewRedisBackplane(params map[string]string) (*RedisBackplane, error) {
+	b := &RedisBackplane{
+		key:            redisBackplaneKey(params),
+		mode:           params[ParamRedisMode],
+		hosts:          strings.Split(params[ParamHost], ","),
+		sentinelMaster: params[ParamRedisSentinelMaster],
+		maxIdle:        3,
+	}
+	if b.mode == "" {
+		b.mode = RedisModeStandalone
+	}
+	if b.sentinelMaster == "" {
+		b.sentinelMaster = "mymaster"
+	}
+
+	for param, value := range map[string]*int{
+		ParamRedisMaxIdle:   &b.maxIdle,
+		ParamRedisMaxActive: &b.maxActive,
+	} {
+		if str, ok := params[param]; ok {
+			n, err := strconv.Atoi(str)
+			if err != nil {
+				return nil, err
+			}
+			*value = n
+		}
+	}
+
+	factory, err := ConnectionFactoryFromParams(params)
+	if err != nil {
+		return nil, err
+	}
+	b.options = []redis.DialOption{
+		redis.DialNetDial(func(network, addr string) (net.Conn, error) {
+			return factory.netDialer().Dial(network, addr)
+		}),
+	}
+	if useTLSStr, ok := params[ParamRedisTLS]; ok {
+		useTLS, err := strconv.ParseBool(useTLSStr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig, err := NewTLSConfigFromParams(params)
+		if err != nil {
+			return nil, err
+		}
+		b.options = append(b.options, redis.DialUseTLS(useTLS))
+		if tlsConfig != nil {
+			b.options = append(b.options, redis.DialTLSConfig(tlsConfig))
+		}
+	}
+	b.sentinelOptions = b.options
+	if password := params[ParamRedisSentinelPassword]; password != "" {
+		b.sentinelOptions = append(b.sentinelOptions[:len(b.sentinelOptions):len(b.sentinelOptions)], redis.DialPassword(password))
+	}
+	if password := params[ParamPassword]; password != "" {
+		b.options = append(b.options, redis.DialPassword(password))
+	}
+
+	switch b.mode {
+	case RedisModeStandalone:
+		b.pool = b.newPool(func() (string, error) {
+			return b.hosts[0], nil
+		})
+	case RedisModeSentinel:
+		// The master is resolved on every dial so that new connections
+		// follow a failover
+		b.pool = b.newPool(b.sentinelMasterAddr)
+	case RedisModeCluster:
+	default:
+		return nil, errors.New("unknown redis mode: " + b.mode)
+	}
+
+	return b, nil
+}
+
+func (b *RedisBackplane) newPool(addr func() (string, error)) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     b.maxIdle,
+		MaxActive:   b.maxActive,
+		Wait:        b.maxActive > 0,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			address, err := addr()
+			if err != nil {
+				return nil, err
+			}
+			return redis.Dial("tcp", address, b.options...)
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+// sentinelMasterAddr asks the sentinels in turn for the master address.
+func (b *RedisBackplane) sentinelMasterAddr() (string, error) {
+	var err error
+	for _, sentinel := range b.hosts {
+		var c redis.Conn
+		if c, err = redis.Dial("tcp", sentinel, b.sentinelOptions...); err != nil {
+			continue
+		}
+		var addr []string
+		addr, err = redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", b.sentinelMaster))
+		c.Close()
+		if err != nil {
+			continue
+		}
+		if len(addr) != 2 {
+			err = fmt.Errorf("unexpected master address %v", addr)
+			continue
+		}
+		return net.JoinHostPort(addr[0], addr[1]), nil
+	}
+	return "", fmt.Errorf("fail to resolve master %s from sentinels: %s", b.sentinelMaster, err)
+}
+
+// loadClusterSlots maps every slot to the master serving it using the first
+// seed node which answers. Must be called with clusterLock held for writing.
+func (b *RedisBackplane) loadClusterSlots() error {
+	var err error
+	for _, seed := range b.hosts {
+		var c redis.Conn
+		if c, err = redis.Dial("tcp", seed, b.options...); err != nil {
+			continue
+		}
+		var ranges []interface{}
+		ranges, err = redis.Values(c.Do("CLUSTER", "SLOTS"))
+		c.Close()
+		if err != nil {
+			continue
+		}
+
+		seedHost, _, _ := net.SplitHostPort(seed)
+		slots, err := parseRedisClusterSlots(ranges, seedHost)
+		if err != nil {
+			return err
+		}
+
+		b.slots = slots
+		b.pools = make(map[string]*redis.Pool)
+		for _, addr := range slots {
+			if addr != "" {
+				b.nodePool(addr)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("fail to load cluster slots: %s", err)
+}
+
+// parseRedisClusterSlots parses a CLUSTER SLOTS reply into the master address
+// of every slot. Nodes announcing an empty ip are on seedHost.
+func parseRedisClusterSlots(ranges []interface{}, seedHost string) ([]string, error) {
+	slots := make([]string, redisClusterSlots)
+	for _, r := range ranges {
+		fields, err := redis.Values(r, nil)
+		if err != nil || len(fields) < 3 {
+			return nil, fmt.Errorf("unexpected slot range %v", r)
+		}
+		start, err := redis.Int(fields[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		end, err := redis.Int(fields[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		master, err := redis.Values(fields[2], nil)
+		if err != nil || len(master) < 2 {
+			return nil, fmt.Errorf("unexpected slot master %v", fields[2])
+		}
+		ip, err := redis.String(master[0], nil)
+		if err != nil {
+			return nil, err
+		}
+		port, err := redis.Int(master[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		if ip == "" {
+			ip = seedHost
+		}
+		if start < 0 || end >= redisClusterSlots || start > end {
+			return nil, fmt.Errorf("invalid slot range %d-%d", start, end)
+		}
+
+		addr := net.JoinHostPort(ip, strconv.Itoa(port))
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = addr
+		}
+	}
+	return slots, nil
+}
+
+// nodePool returns the pool of the cluster node at addr. Must be called with
+// clusterLock held for writing.
+func (b *RedisBackplane) nodePool(addr string) *redis.Pool {
+	pool, ok := b.pools[addr]
+	if !ok {
+		pool = b.newPool(func() (string, error) {
+			return addr, nil
+		})
+		b.pools[addr] = pool
+	}
+	return pool
+}
+
+// node returns a connection to the cluster node at addr, recording it as the
+// master of slot if moved is set.
+func (b *RedisBackplane) node(addr string, slot int, moved bool) redis.Conn {
+	b.clusterLock.Lock()
+	defer b.clusterLock.Unlock()
+	if moved {
+		b.slots[slot] = addr
+	}
+	return b.nodePool(addr).Get()
+}
+
+// Get returns a connection to the node serving key. Callers must close it.
+// In cluster mode, commands run with Do follow MOVED and ASK redirects, while
+// pub/sub works on any node.
+func (b *RedisBackplane) Get(key string) (redis.Conn, error) {
+	if b.mode != RedisModeCluster {
+		return b.pool.Get(), nil
+	}
+
+	b.clusterLock.RLock()
+	loaded := b.slots != nil
+	b.clusterLock.RUnlock()
+	if !loaded {
+		b.clusterLock.Lock()
+		var err error
+		if b.slots == nil {
+			err = b.loadClusterSlots()
+		}
+		b.clusterLock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	b.clusterLock.RLock()
+	addr := b.slots[RedisSlot(key)]
+	var pool *redis.Pool
+	if addr != "" {
+		pool = b.pools[addr]
+	}
+	b.clusterLock.RUnlock()
+	if pool == nil {
+		return nil, fmt.Errorf("slot of %s is not served", key)
+	}
+	return &redisClusterConn{Conn: pool.Get(), backplane: b}, nil
+}
+
+func (b *RedisBackplane) Close() error {
+	if b.pool != nil {
+		return b.pool.Close()
+	}
+	b.clusterLock.Lock()
+	defer b.clusterLock.Unlock()
+	for _, pool := range b.pools {
+		pool.Close()
+	}
+	return nil
+}
+
+// parseRedisRedirect parses a MOVED or ASK error into its kind, slot and the
+// address of the node to ask instead.
+func parseRedisRedirect(err error) (string, int, string, bool) {
+	redisErr, ok := err.(redis.Error)
+	if !ok {
+		return "", 0, "", false
+	}
+	fields := strings.Fields(string(redisErr))
+	if len(fields) != 3 || fields[0] != "MOVED" && fields[0] != "ASK" {
+		return "", 0, "", false
+	}
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil || slot < 0 || slot >= redisClusterSlots {
+		return "", 0, "", false
+	}
+	return fields[0], slot, fields[2], true
+}
+
+// redisClusterConn is a connection to a cluster node which follows MOVED and
+// ASK redirects, so that keys keep working while slots migrate. It must not
+// be used concurrently.
+type redisClusterConn struct {
+	redis.Conn
+	backplane *RedisBackplane
+}
+
+func (c *redisClusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(cmd, args...)
+	for i := 0; i < redisMaxRedirects; i++ {
+		kind, slot, addr, ok := parseRedisRedirect(err)
+		if !ok {
+			break
+		}
+		if kind == "MOVED" {
+			// The slot moved for good, so stay on the new node
+			c.Conn.Close()
+			c.Conn = c.backplane.node(addr, slot, true)
+			reply, err = c.Conn.Do(cmd, args...)
+			continue
+		}
+
+		// The slot is migrating, only this command goes to the new node
+		conn := c.backplane.node(addr, slot, false)
+		if _, err = conn.Do("ASKING"); err == nil {
+			reply, err = conn.Do(cmd, args...)
+		}
+		conn.Close()
+	}
+	return reply, err
+}
+
+// RedisSlot returns the cluster slot of key, hashing only the hash tag
+// between the first { and the following } if there is a non-empty one.
+func RedisSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16([]byte(key)) % redisClusterSlots)
+}
+
+// crc16 implements CRC16-XMODEM as used by redis cluster.
+func crc16(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,237 @@
+package sessions
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestRedisSlot(t *testing.T) {
+	cases := map[string]int{
+		"123456789":            12739,
+		"foo":                  12182,
+		"{user1000}.following": RedisSlot("user1000"),
+		"{user1000}.followers": RedisSlot("user1000"),
+		"foo{}{bar}":           RedisSlot("foo{}{bar}"),
+	}
+	for key, slot := range cases {
+		if got := RedisSlot(key); got != slot {
+			t.Error("Expect slot", slot, "for", key, "but got", got)
+		}
+	}
+	if RedisSlot("foo{}{bar}") == RedisSlot("bar") {
+		t.Error("Expect empty hash tag to hash the whole key")
+	}
+}
+
+func TestParseRedisClusterSlots(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{int64(0), int64(8191), []interface{}{[]byte("10.0.0.1"), int64(7000), []byte("id1")}},
+		[]interface{}{int64(8192), int64(16383), []interface{}{[]byte(""), int64(7001), []byte("id2")}},
+	}
+	slots, err := parseRedisClusterSlots(reply, "10.0.0.9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slots[0] != "10.0.0.1:7000" || slots[8191] != "10.0.0.1:7000" || slots[16383] != "10.0.0.9:7001" {
+		t.Fatal("Unexpected slot mapping", slots[0], slots[8191], slots[16383])
+	}
+
+	if _, err = parseRedisClusterSlots([]interface{}{[]interface{}{int64(0)}}, ""); err == nil {
+		t.Fatal("Expect error for malformed reply")
+	}
+}
+
+func TestNewRedisBackplane(t *testing.T) {
+	if _, err := NewRedisBackplane(map[string]string{ParamHost: "localhost:6379", ParamRedisMode: "ring"}); err == nil {
+		t.Fatal("Expect error for unknown mode")
+	}
+	b, err := NewRedisBackplane(map[string]string{ParamHost: "localhost:6379", ParamRedisMaxActive: "8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if b.pool.MaxActive != 8 || !b.pool.Wait || b.pool.MaxIdle != 3 {
+		t.Fatal("Expect configured pool sizes but got", b.pool.MaxActive, b.pool.Wait, b.pool.MaxIdle)
+	}
+}
+
+// fakeRedisNode answers commands by name with raw RESP replies, recording
+// the commands it received.
+type fakeRedisNode struct {
+	addr     string
+	replies  map[string]string
+	lock     sync.Mutex
+	commands []string
+}
+
+func startFakeRedisNode(t *testing.T, replies map[string]string) *fakeRedisNode {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	n := &fakeRedisNode{addr: l.Addr().String(), replies: replies}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go n.serve(c)
+		}
+	}()
+	return n
+}
+
+func (n *fakeRedisNode) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		// Commands are arrays of bulk strings
+		header, err := r.ReadString('\n')
+		if err != nil || !strings.HasPrefix(header, "*") {
+			return
+		}
+		argc, _ := strconv.Atoi(strings.TrimSpace(header[1:]))
+		args := make([]string, argc)
+		for i := range args {
+			r.ReadString('\n')
+			line, _ := r.ReadString('\n')
+			args[i] = strings.TrimSpace(line)
+		}
+		n.lock.Lock()
+		n.commands = append(n.commands, strings.Join(args, " "))
+		reply, ok := n.replies[args[0]]
+		n.lock.Unlock()
+		if !ok {
+			reply = "+OK\r\n"
+		}
+		c.Write([]byte(reply))
+	}
+}
+
+func (n *fakeRedisNode) setReply(command, reply string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.replies[command] = reply
+}
+
+func (n *fakeRedisNode) received() []string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return append([]string(nil), n.commands...)
+}
+
+// clusterSlotsReply serves all slots from addr.
+func clusterSlotsReply(addr string) string {
+	host, port, _ := net.SplitHostPort(addr)
+	return "*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n$" + strconv.Itoa(len(host)) + "\r\n" + host + "\r\n:" + port + "\r\n"
+}
+
+func TestRedisClusterRedirects(t *testing.T) {
+	target := startFakeRedisNode(t, map[string]string{"GET": "$5\r\nmoved\r\n"})
+	slot := strconv.Itoa(RedisSlot("key"))
+
+	t.Run("MOVED", func(t *testing.T) {
+		seed := startFakeRedisNode(t, nil)
+		seed.replies = map[string]string{
+			"CLUSTER": clusterSlotsReply(seed.addr),
+			"GET":     "-MOVED " + slot + " " + target.addr + "\r\n",
+		}
+		b, err := NewRedisBackplane(map[string]string{ParamHost: seed.addr, ParamRedisMode: RedisModeCluster})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+
+		conn, err := b.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if reply, err := redis.String(conn.Do("GET", "key")); err != nil || reply != "moved" {
+			t.Fatal("Expect the reply of the new node but got", reply, err)
+		}
+		if b.slots[RedisSlot("key")] != target.addr {
+			t.Fatal("Expect the slot to be updated but got", b.slots[RedisSlot("key")])
+		}
+	})
+
+	t.Run("ASK", func(t *testing.T) {
+		seed := startFakeRedisNode(t, nil)
+		seed.replies = map[string]string{
+			"CLUSTER": clusterSlotsReply(seed.addr),
+			"GET":     "-ASK " + slot + " " + target.addr + "\r\n",
+		}
+		b, err := NewRedisBackplane(map[string]string{ParamHost: seed.addr, ParamRedisMode: RedisModeCluster})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+
+		conn, err := b.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if reply, err := redis.String(conn.Do("GET", "key")); err != nil || reply != "moved" {
+			t.Fatal("Expect the reply of the new node but got", reply, err)
+		}
+		if b.slots[RedisSlot("key")] != seed.addr {
+			t.Fatal("Expect the slot to stay but got", b.slots[RedisSlot("key")])
+		}
+		commands := target.received()
+		if len(commands) < 2 || commands[len(commands)-2] != "ASKING" {
+			t.Fatal("Expect ASKING before the command but got", commands)
+		}
+	})
+}
+
+func TestRedisClusterRetryLoad(t *testing.T) {
+	seed := startFakeRedisNode(t, map[string]string{"CLUSTER": "-ERR not ready\r\n"})
+	b, err := NewRedisBackplane(map[string]string{ParamHost: seed.addr, ParamRedisMode: RedisModeCluster})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if _, err = b.Get("key"); err == nil {
+		t.Fatal("Expect error while the cluster is not ready")
+	}
+
+	// A later job gets the slots once the cluster answers
+	seed.setReply("CLUSTER", clusterSlotsReply(seed.addr))
+	conn, err := b.Get("key")
+	if err != nil {
+		t.Fatal("Expect the slots to be loaded again but got", err)
+	}
+	conn.Close()
+}
+
+func TestSetupRedisBackplane(t *testing.T) {
+	params := map[string]string{ParamHost: "localhost:6379"}
+	b, err := SetupRedisBackplane(nil, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reused, _ := SetupRedisBackplane(b, map[string]string{ParamHost: "localhost:6379"}); reused != b {
+		t.Fatal("Expect the backplane to be reused for the same params")
+	}
+	other, err := SetupRedisBackplane(b, map[string]string{ParamHost: "localhost:6380"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if other == b {
+		t.Fatal("Expect a new backplane for other params")
+	}
+	if conn := b.pool.Get(); conn.Err() == nil {
+		t.Fatal("Expect the previous backplane to be closed")
+	}
+}
@@ -4,16 +4,91 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"math"
 	"strconv"
 	"sync/atomic"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
+	"microsoft.com/sigbench/metrics"
 )
 
+const redisPubSubChannelPrefix = "sigbench:"
+
+// LabelChannel labels the delivery latency of each redis channel.
+const LabelChannel = "channel"
+
+const (
+	RedisRolePubSub     = "pubsub"
+	RedisRolePublisher  = "publisher"
+	RedisRoleSubscriber = "subscriber"
+)
+
+// RedisPubSubTopology decides which channel each user publishes and
+// subscribes to, and whether it does both.
+type RedisPubSubTopology struct {
+	Channels              int
+	SubscribersPerChannel int
+	Pattern               string
+	Role                  string
+}
+
+func NewRedisPubSubTopologyFromParams(params map[string]string) (*RedisPubSubTopology, error) {
+	role, err := redisRole(params)
+	if err != nil {
+		return nil, err
+	}
+	t := &RedisPubSubTopology{
+		Channels: 1,
+		Pattern:  params[ParamRedisPattern],
+		Role:     role,
+	}
+	for param, value := range map[string]*int{
+		ParamRedisChannels:    &t.Channels,
+		ParamRedisSubscribers: &t.SubscribersPerChannel,
+	} {
+		if str, ok := params[param]; ok {
+			n, err := strconv.Atoi(str)
+			if err != nil {
+				return nil, err
+			}
+			*value = n
+		}
+	}
+	if t.Channels <= 0 {
+		return nil, errors.New("channel count must be positive")
+	}
+	return t, nil
+}
+
+// redisRole returns whether users of the redis sessions publish, subscribe
+// or both.
+func redisRole(params map[string]string) (string, error) {
+	switch role := params[ParamRedisRole]; role {
+	case "":
+		return RedisRolePubSub, nil
+	case RedisRolePubSub, RedisRolePublisher, RedisRoleSubscriber:
+		return role, nil
+	default:
+		return "", errors.New("unknown redis role: " + role)
+	}
+}
+
+// Channel returns the channel of the userIdx-th user of all agents. Users fill
+// channels one after another with SubscribersPerChannel users each, or are
+// spread round-robin if it is not set.
+func (t *RedisPubSubTopology) Channel(userIdx int64) string {
+	idx := userIdx
+	if t.SubscribersPerChannel > 0 {
+		idx /= int64(t.SubscribersPerChannel)
+	}
+	return redisPubSubChannelPrefix + strconv.FormatInt(idx%int64(t.Channels), 10)
+}
+
 type RedisPubSub struct {
-	pool *redis.Pool
+	backplane *RedisBackplane
 
+	userIdx                  int64
 	cntInProgress            int64
 	cntConnected             int64
 	cntError                 int64
@@ -25,10 +100,15 @@ type RedisPubSub struct {
 	cntLatencyLessThan500ms  int64
 	cntLatencyLessThan1000ms int64
 	cntLatencyMoreThan1000ms int64
+	sendRate                 SendRateCounter
+	sequence                 SequenceCounters
+	channels                 metrics.Registry
+	phases                   PhaseMetrics
 }
 
 type RedisPubSubMessage struct {
 	Uid       string
+	Seq       int64
 	Timestamp int64
 }
 
@@ -41,6 +121,7 @@ func (s *RedisPubSub) Setup(sessionParams map[string]string) error {
 		return err
 	}
 
+	s.userIdx = 0
 	s.cntInProgress = 0
 	s.cntConnected = 0
 	s.cntError = 0
@@ -52,47 +133,28 @@ func (s *RedisPubSub) Setup(sessionParams map[string]string) error {
 	s.cntLatencyLessThan500ms = 0
 	s.cntLatencyLessThan1000ms = 0
 	s.cntLatencyMoreThan1000ms = 0
+	s.sendRate.Reset()
+	s.sequence.Reset()
+	s.channels.Reset()
+	s.phases.Reset()
 	return nil
 }
 
 func (s *RedisPubSub) setupRedisPool(sessionParams map[string]string) error {
-	if s.pool != nil {
-		s.pool.Close()
-	}
-
-	s.pool = &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", sessionParams[ParamHost])
-			if err != nil {
-				return nil, err
-			}
-
-			if password, ok := sessionParams[ParamPassword]; ok && password != "" {
-				if _, err := c.Do("AUTH", sessionParams[ParamPassword]); err != nil {
-					c.Close()
-					return nil, err
-				}
-			}
-
-			return c, nil
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			return err
-		},
-	}
-
-	return nil
+	// The previous backplane is closed unless it is reused
+	backplane, err := SetupRedisBackplane(s.backplane, sessionParams)
+	s.backplane = backplane
+	return err
 }
 
 func (s *RedisPubSub) logError(ctx *UserContext, msg string, err error) {
 	log.Printf("[Error][%s] %s due to %s", ctx.UserId, msg, err)
 	atomic.AddInt64(&s.cntError, 1)
+	s.phases.Add(ctx, "errors", 1)
 }
 
-func (s *RedisPubSub) logLatency(latency int64) {
+func (s *RedisPubSub) logLatency(phaseLatency *metrics.Histogram, latency int64) {
+	phaseLatency.Observe(latency)
 	// log.Println("Latency: ", latency)
 	if latency < 100 {
 		atomic.AddInt64(&s.cntLatencyLessThan100ms, 1)
@@ -105,104 +167,193 @@ func (s *RedisPubSub) logLatency(latency int64) {
 	}
 }
 
+// subscribe subscribes to the pattern of the topology if there is one or to
+// channel otherwise.
+func (s *RedisPubSub) subscribe(topology *RedisPubSubTopology, channel string) (*redis.PubSubConn, error) {
+	conn, err := s.backplane.Get(channel)
+	if err != nil {
+		return nil, err
+	}
+	sc := &redis.PubSubConn{Conn: conn}
+	if topology.Pattern != "" {
+		err = sc.PSubscribe(topology.Pattern)
+	} else {
+		err = sc.Subscribe(channel)
+	}
+	if err != nil {
+		sc.Close()
+		return nil, err
+	}
+	return sc, nil
+}
+
 func (s *RedisPubSub) Execute(ctx *UserContext) error {
 	atomic.AddInt64(&s.cntInProgress, 1)
 	defer atomic.AddInt64(&s.cntInProgress, -1)
 
+	// Metrics of the user's phase, looked up once for all messages
+	phaseRecv := s.phases.Counter(ctx, "messages:recv")
+	phaseSend := s.phases.Counter(ctx, "messages:send")
+	phaseLatency := s.phases.Histogram(ctx, "latency")
+
+	topology, err := NewRedisPubSubTopologyFromParams(ctx.Params)
+	if err != nil {
+		s.logError(ctx, "Invalid topology", err)
+		return err
+	}
+	channel := topology.Channel(ctx.GlobalIndex(atomic.AddInt64(&s.userIdx, 1) - 1))
+
 	broadcastDurationSecs := 10
 	if secsStr, ok := ctx.Params[ParamBroadcastDurationSecs]; ok {
 		if secs, err := strconv.Atoi(secsStr); err == nil {
 			broadcastDurationSecs = secs
 		}
 	}
-	publishInterval, err := strconv.Atoi(ctx.Params[ParamPublishInterval])
+	pacer, err := NewPacerFromParams(ctx.Params, 1)
 	if err != nil {
-		s.logError(ctx, "Invalid publish interval", err)
+		s.logError(ctx, "Invalid send rate", err)
 		return err
 	}
-	totalMsgCnt := broadcastDurationSecs * 1000 * 1000 / publishInterval
+	recvTimeout := recvTimeout(ctx.Params)
+	tracker := NewSequenceTracker()
+	tracker.Follow(ctx.UserId, 0)
 
-	startChan := make(chan struct{})
-	recvChan := make(chan int64, totalMsgCnt)
+	recvSignal := make(chan struct{}, 1)
+	recvSelf := int64(0)
 	exit := int64(0)
 
-	go func() {
-		sc := redis.PubSubConn{Conn: s.pool.Get()}
-		defer sc.Close()
-
-		if err := sc.Subscribe("sigbench"); err != nil {
+	if topology.Role != RedisRolePublisher {
+		sc, err := s.subscribe(topology, channel)
+		if err != nil {
 			s.logError(ctx, "Fail to subscribe", err)
-			return
+			return err
 		}
+		defer sc.Close()
 
-		close(startChan)
+		go func() {
+			// Latency histogram of each channel received from
+			channelLatency := make(map[string]*metrics.Histogram)
+			for atomic.LoadInt64(&exit) == 0 {
+				var data []byte
+				var recvChannel string
+				switch n := sc.Receive().(type) {
+				case redis.Message:
+					data, recvChannel = n.Data, n.Channel
+				case redis.PMessage:
+					data, recvChannel = n.Data, n.Channel
+				case error:
+					if n.Error() != "redigo: connection closed" {
+						s.logError(ctx, "Received error message", n)
+					}
+					return
+				default:
+					continue
+				}
 
-		for atomic.LoadInt64(&exit) == 0 {
-			switch n := sc.Receive().(type) {
-			case redis.Message:
 				atomic.AddInt64(&s.cntMessagesRecv, 1)
+				phaseRecv.Inc()
 
 				var msg RedisPubSubMessage
-				err := json.Unmarshal(n.Data, &msg)
+				err := json.Unmarshal(data, &msg)
 				if err != nil {
 					s.logError(ctx, "Fail to unmarshal message", err)
 					continue
 				}
 
-				if msg.Uid == ctx.UserId {
-					recvChan <- (time.Now().UnixNano() - msg.Timestamp) / 1000000
+				result := tracker.Track(msg.Uid, msg.Seq)
+				s.sequence.Record(result)
+				if result.Duplicate {
+					continue
+				}
+
+				latency := (time.Now().UnixNano() - msg.Timestamp) / 1000000
+				h, ok := channelLatency[recvChannel]
+				if !ok {
+					h = s.channels.Histogram("channel:latency", metrics.Labels{LabelChannel: recvChannel}, DefaultLatencyBounds...)
+					channelLatency[recvChannel] = h
 				}
-			case error:
-				if n.Error() != "redigo: connection closed" {
-					s.logError(ctx, "Received error message", n)
+				h.Observe(latency)
+				if topology.Role == RedisRoleSubscriber {
+					s.logLatency(phaseLatency, latency)
+				} else if msg.Uid == ctx.UserId {
+					s.logLatency(phaseLatency, latency)
+					atomic.AddInt64(&recvSelf, 1)
+					select {
+					case recvSignal <- struct{}{}:
+					default:
+					}
 				}
-				return
 			}
-
-		}
-	}()
-
-	<-startChan
+		}()
+	}
+	defer atomic.StoreInt64(&exit, 1)
 
 	atomic.AddInt64(&s.cntConnected, 1)
 	defer atomic.AddInt64(&s.cntConnected, -1)
 
-	for i := 0; i < totalMsgCnt; i++ {
-		msg := &RedisPubSubMessage{
-			Uid:       ctx.UserId,
-			Timestamp: time.Now().UnixNano(),
-		}
+	if topology.Role == RedisRoleSubscriber {
+		time.Sleep(time.Duration(listenDurationSecs(ctx.Params)) * time.Second)
+		atomic.AddInt64(&s.cntSuccess, 1)
+		return nil
+	}
 
-		msgEncoded, err := json.Marshal(msg)
-		if err != nil {
-			s.logError(ctx, "Fail to marshal message", err)
-			return err
-		}
+	s.sendRate.Start(pacer)
+	defer s.sendRate.Stop(pacer)
 
-		pconn := s.pool.Get()
-		_, err = pconn.Do("PUBLISH", "sigbench", msgEncoded)
-		if err != nil {
-			s.logError(ctx, "Fail to publish message", err)
-			pconn.Close()
-			return err
+	sent := int64(0)
+	deadline := time.Now().Add(time.Duration(broadcastDurationSecs) * time.Second)
+	for {
+		n := pacer.WaitUntil(deadline)
+		if !time.Now().Before(deadline) {
+			break
 		}
-		pconn.Flush()
-		pconn.Close()
 
-		atomic.AddInt64(&s.cntMessagesSend, 1)
+		for i := 0; i < n; i++ {
+			msg := &RedisPubSubMessage{
+				Uid:       ctx.UserId,
+				Seq:       sent,
+				Timestamp: time.Now().UnixNano(),
+			}
 
-		time.Sleep(time.Duration(publishInterval) * time.Microsecond)
+			msgEncoded, err := json.Marshal(msg)
+			if err != nil {
+				s.logError(ctx, "Fail to marshal message", err)
+				return err
+			}
+
+			pconn, err := s.backplane.Get(channel)
+			if err != nil {
+				s.logError(ctx, "Fail to connect", err)
+				return err
+			}
+			_, err = pconn.Do("PUBLISH", channel, msgEncoded)
+			if err != nil {
+				s.logError(ctx, "Fail to publish message", err)
+				pconn.Close()
+				return err
+			}
+			pconn.Flush()
+			pconn.Close()
+
+			sent++
+			atomic.AddInt64(&s.cntMessagesSend, 1)
+			phaseSend.Inc()
+			s.sendRate.Sent(1)
+		}
 	}
 
-	defer atomic.StoreInt64(&exit, 1)
+	if topology.Role == RedisRolePublisher {
+		atomic.AddInt64(&s.cntSuccess, 1)
+		return nil
+	}
 
-	timeoutChan := time.After(time.Minute)
-	for i := 0; i < totalMsgCnt; i++ {
+	timeoutChan := time.After(recvTimeout)
+	for atomic.LoadInt64(&recvSelf) < sent {
 		select {
-		case latency := <-recvChan:
-			s.logLatency(latency)
+		case <-recvSignal:
 		case <-timeoutChan:
-			log.Printf("[Error][%s] Fail to receive all messages within timeout. Current i: %d", ctx.UserId, i)
+			s.sequence.Record(tracker.Finish(ctx.UserId, sent))
+			log.Printf("[Error][%s] Fail to receive all messages within timeout. Received: %d/%d", ctx.UserId, atomic.LoadInt64(&recvSelf), sent)
 			atomic.AddInt64(&s.cntErrorNotRecvAll, 1)
 			return errors.New("fail to receive all messages within timeout")
 		}
@@ -214,17 +365,28 @@ func (s *RedisPubSub) Execute(ctx *UserContext) error {
 }
 
 func (s *RedisPubSub) Counters() map[string]int64 {
-	return map[string]int64{
-		"redis:pubsub:inprogress":       atomic.LoadInt64(&s.cntInProgress),
-		"redis:pubsub:connected":        atomic.LoadInt64(&s.cntConnected),
-		"redis:pubsub:success":          atomic.LoadInt64(&s.cntSuccess),
-		"redis:pubsub:error":            atomic.LoadInt64(&s.cntError),
-		"redis:pubsub:error:notrecvall": atomic.LoadInt64(&s.cntErrorNotRecvAll),
-		"redis:pubsub:messages:recv":    atomic.LoadInt64(&s.cntMessagesRecv),
-		"redis:pubsub:messages:send":    atomic.LoadInt64(&s.cntMessagesSend),
-		"redis:pubsub:latency:<100":     atomic.LoadInt64(&s.cntLatencyLessThan100ms),
-		"redis:pubsub:latency:<500":     atomic.LoadInt64(&s.cntLatencyLessThan500ms),
-		"redis:pubsub:latency:<1000":    atomic.LoadInt64(&s.cntLatencyLessThan1000ms),
-		"redis:pubsub:latency:>=1000":   atomic.LoadInt64(&s.cntLatencyMoreThan1000ms),
+	counters := map[string]int64{
+		"redis:pubsub:inprogress":            atomic.LoadInt64(&s.cntInProgress),
+		"redis:pubsub:connected":             atomic.LoadInt64(&s.cntConnected),
+		"redis:pubsub:success":               atomic.LoadInt64(&s.cntSuccess),
+		"redis:pubsub:error":                 atomic.LoadInt64(&s.cntError),
+		"redis:pubsub:error:notrecvall":      atomic.LoadInt64(&s.cntErrorNotRecvAll),
+		"redis:pubsub:messages:recv":         atomic.LoadInt64(&s.cntMessagesRecv),
+		"redis:pubsub:messages:send":         atomic.LoadInt64(&s.cntMessagesSend),
+		"redis:pubsub:latency:<100":          atomic.LoadInt64(&s.cntLatencyLessThan100ms),
+		"redis:pubsub:latency:<500":          atomic.LoadInt64(&s.cntLatencyLessThan500ms),
+		"redis:pubsub:latency:<1000":         atomic.LoadInt64(&s.cntLatencyLessThan1000ms),
+		"redis:pubsub:latency:>=1000":        atomic.LoadInt64(&s.cntLatencyMoreThan1000ms),
+		"redis:pubsub:sendrate:target":       int64(math.Round(s.sendRate.Target())),
+		"redis:pubsub:sendrate:target:milli": s.sendRate.TargetMilli(),
+		"redis:pubsub:sendrate:measured":     s.sendRate.Measured(),
+		"redis:pubsub:messages:lost":         s.sequence.Lost(),
+		"redis:pubsub:messages:duplicated":   s.sequence.Duplicated(),
+		"redis:pubsub:messages:outoforder":   s.sequence.OutOfOrder(),
 	}
+	return counters
+}
+
+func (s *RedisPubSub) Metrics() []metrics.Sample {
+	return append(s.channels.Samples(), s.phases.Samples()...)
 }
@@ -0,0 +1,61 @@
+package sessions
+
+import "testing"
+
+func TestRedisPubSubTopologyChannel(t *testing.T) {
+	topology, err := NewRedisPubSubTopologyFromParams(map[string]string{
+		ParamRedisChannels:    "3",
+		ParamRedisSubscribers: "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"sigbench:0", "sigbench:0", "sigbench:1", "sigbench:1", "sigbench:2", "sigbench:2", "sigbench:0"}
+	for i, channel := range expected {
+		if got := topology.Channel(int64(i)); got != channel {
+			t.Error("Expect user", i, "on", channel, "but got", got)
+		}
+	}
+
+	topology.SubscribersPerChannel = 0
+	if topology.Channel(4) != "sigbench:1" {
+		t.Error("Expect round-robin channels but got", topology.Channel(4))
+	}
+	if topology.Role != RedisRolePubSub {
+		t.Error("Expect default role pubsub but got", topology.Role)
+	}
+}
+
+func TestRedisPubSubTopologyAgents(t *testing.T) {
+	topology, err := NewRedisPubSubTopologyFromParams(map[string]string{
+		ParamRedisChannels:    "2",
+		ParamRedisSubscribers: "2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2 agents with 2 users each fill the 2 channels with 2 subscribers
+	subscribers := make(map[string]int)
+	for agentIdx := 0; agentIdx < 2; agentIdx++ {
+		ctx := &UserContext{AgentIdx: agentIdx, AgentCount: 2}
+		for userIdx := int64(0); userIdx < 2; userIdx++ {
+			subscribers[topology.Channel(ctx.GlobalIndex(userIdx))]++
+		}
+	}
+	if subscribers["sigbench:0"] != 2 || subscribers["sigbench:1"] != 2 {
+		t.Error("Expect 2 subscribers on each channel but got", subscribers)
+	}
+}
+
+func TestRedisPubSubTopologyInvalid(t *testing.T) {
+	for _, params := range []map[string]string{
+		{ParamRedisChannels: "0"},
+		{ParamRedisChannels: "x"},
+		{ParamRedisRole: "observer"},
+	} {
+		if _, err := NewRedisPubSubTopologyFromParams(params); err == nil {
+			t.Error("Expect error for", params)
+		}
+	}
+}
@@ -0,0 +1,549 @@
+package sessions
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"microsoft.com/sigbench/metrics"
+)
+
+const (
+	redisStreamDefaultKey  = "sigbench:stream"
+	redisStreamGroupPrefix = "sigbench:"
+	redisStreamReadCount   = 100
+)
+
+// RedisStreamEntry is an entry read from a stream. Fields is nil for entries
+// which were deleted while pending.
+type RedisStreamEntry struct {
+	Id     string
+	Fields map[string]string
+}
+
+// parseRedisStreamEntries parses a list of [id, [field, value, ...]] as
+// returned by XRANGE, XCLAIM and within XREADGROUP replies.
+func parseRedisStreamEntries(reply interface{}) ([]RedisStreamEntry, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]RedisStreamEntry, 0, len(values))
+	for _, v := range values {
+		entryValues, err := redis.Values(v, nil)
+		if err != nil || len(entryValues) != 2 {
+			return nil, fmt.Errorf("unexpected stream entry %v", v)
+		}
+		id, err := redis.String(entryValues[0], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := RedisStreamEntry{Id: id}
+		if entryValues[1] != nil {
+			if entry.Fields, err = redis.StringMap(entryValues[1], nil); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// parseRedisStreamRead parses the entries of the only stream in an XREAD or
+// XREADGROUP reply. A nil reply means the read timed out.
+func parseRedisStreamRead(reply interface{}) ([]RedisStreamEntry, error) {
+	if reply == nil {
+		return nil, nil
+	}
+	streams, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(streams) == 0 {
+		return nil, nil
+	}
+	stream, err := redis.Values(streams[0], nil)
+	if err != nil || len(stream) != 2 {
+		return nil, fmt.Errorf("unexpected stream %v", streams[0])
+	}
+	return parseRedisStreamEntries(stream[1])
+}
+
+// RedisStreams produces timestamped entries to a stream and consumes them
+// through consumer groups. Consumers of the same group share the entries,
+// every group receives all of them.
+type RedisStreams struct {
+	backplane *RedisBackplane
+
+	userIdx            int64
+	cntInProgress      int64
+	cntConnected       int64
+	cntError           int64
+	cntSuccess         int64
+	cntEntriesProduced int64
+	cntEntriesConsumed int64
+	cntEntriesAcked    int64
+	cntRedelivered     int64
+	latency            *LatencyHistogram
+	sendRate           SendRateCounter
+	sequence           SequenceCounters
+
+	lock     sync.Mutex
+	trackers map[string]*SequenceTracker
+	pending  map[string]int64
+
+	phases PhaseMetrics
+}
+
+func (s *RedisStreams) Name() string {
+	return "Redis:Streams"
+}
+
+func (s *RedisStreams) Setup(sessionParams map[string]string) error {
+	s.userIdx = 0
+	s.cntInProgress = 0
+	s.cntConnected = 0
+	s.cntError = 0
+	s.cntSuccess = 0
+	s.cntEntriesProduced = 0
+	s.cntEntriesConsumed = 0
+	s.cntEntriesAcked = 0
+	s.cntRedelivered = 0
+	s.latency = NewLatencyHistogram()
+	s.sendRate.Reset()
+	s.sequence.Reset()
+	s.trackers = make(map[string]*SequenceTracker)
+	s.pending = make(map[string]int64)
+	s.phases.Reset()
+
+	// The previous backplane is closed unless it is reused
+	backplane, err := SetupRedisBackplane(s.backplane, sessionParams)
+	s.backplane = backplane
+	return err
+}
+
+func (s *RedisStreams) logError(ctx *UserContext, msg string, err error) {
+	log.Printf("[Error][%s] %s due to %s", ctx.UserId, msg, err)
+	atomic.AddInt64(&s.cntError, 1)
+	s.phases.Add(ctx, "errors", 1)
+}
+
+// tracker returns the sequence tracker shared by the consumers of group,
+// since each of them only sees part of the entries. It needs all consumers of
+// the group on this agent, see redisStreamGroup. The consumers handle their
+// entries concurrently, so the tracker only counts gaps. An entry tracked
+// after a later one of another consumer fills the gap, or falls before the
+// baseline of its producer, and is not a duplicate: a group gets each entry
+// once and redeliveries are not tracked.
+func (s *RedisStreams) tracker(group string) *SequenceTracker {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t, ok := s.trackers[group]
+	if !ok {
+		t = NewSequenceTracker()
+		s.trackers[group] = t
+	}
+	return t
+}
+
+func (s *RedisStreams) setPending(group string, count int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pending[group] = count
+}
+
+// redisStreamGroup assigns the localIdx-th user of the agent to one of groups.
+// Each group is kept on a single agent when there are enough of them, so that
+// the agent sees all entries the group consumes and can check their sequence.
+// Otherwise the groups span the agents, shared is true and the agent running
+// the first user of a group is its owner.
+func redisStreamGroup(ctx *UserContext, localIdx, groups int64) (group int64, shared, owner bool) {
+	agents := int64(ctx.AgentCount)
+	if agents <= 1 {
+		return localIdx % groups, false, true
+	}
+	if groups < agents {
+		group = ctx.GlobalIndex(localIdx) % groups
+		return group, true, group == int64(ctx.AgentIdx)
+	}
+	// The agent owns the groups congruent to its index
+	owned := (groups - int64(ctx.AgentIdx) + agents - 1) / agents
+	return (localIdx%owned)*agents + int64(ctx.AgentIdx), false, true
+}
+
+// redisStreamsConsumer reads entries of a group as one consumer until it is
+// stopped and the stream is drained.
+type redisStreamsConsumer struct {
+	session        *RedisStreams
+	ctx            *UserContext
+	conn           redis.Conn
+	stream         string
+	group          string
+	tracker        *SequenceTracker
+	lastSeq        map[string]int64
+	phaseRecv      *metrics.Counter
+	phaseLatency   *metrics.Histogram
+	reportPending  bool
+	claimIdleMs    int64
+	skipAck        float64
+	drainTimeout   time.Duration
+	stop           chan struct{}
+	lastSampleTime time.Time
+}
+
+func (c *redisStreamsConsumer) createGroup() error {
+	_, err := c.conn.Do("XGROUP", "CREATE", c.stream, c.group, "$", "MKSTREAM")
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+// handle processes entries and acknowledges them, except the fraction left
+// pending on first delivery to exercise redelivery. Redelivered entries were
+// checked on their first delivery and are only counted.
+func (c *redisStreamsConsumer) handle(entries []RedisStreamEntry, redelivered bool) error {
+	s := c.session
+	ids := make([]interface{}, 0, len(entries)+2)
+	ids = append(ids, c.stream, c.group)
+	for _, entry := range entries {
+		atomic.AddInt64(&s.cntEntriesConsumed, 1)
+		c.phaseRecv.Inc()
+		if redelivered {
+			atomic.AddInt64(&s.cntRedelivered, 1)
+		} else if entry.Fields != nil {
+			uid := entry.Fields["u"]
+			seq, err := strconv.ParseInt(entry.Fields["s"], 10, 64)
+			if err != nil {
+				s.logError(c.ctx, "Invalid entry sequence", err)
+				continue
+			}
+			timestamp, err := strconv.ParseInt(entry.Fields["ts"], 10, 64)
+			if err != nil {
+				s.logError(c.ctx, "Invalid entry timestamp", err)
+				continue
+			}
+
+			// A consumer gets the entries of a producer in stream order,
+			// unlike the consumers of a group taken together
+			last, ok := c.lastSeq[uid]
+			result := SequenceResult{
+				OutOfOrder: ok && seq < last,
+				Duplicate:  ok && seq == last,
+			}
+			if !ok || seq > last {
+				c.lastSeq[uid] = seq
+			}
+			if c.tracker != nil {
+				result.Lost = c.tracker.Track(uid, seq).Lost
+			}
+			s.sequence.Record(result)
+			duplicate := result.Duplicate
+			if !duplicate {
+				latency := (time.Now().UnixNano() - timestamp) / 1000000
+				s.latency.Record(latency)
+				c.phaseLatency.Observe(latency)
+			}
+		}
+
+		if !redelivered && c.skipAck > 0 && rand.Float64() < c.skipAck {
+			continue
+		}
+		ids = append(ids, entry.Id)
+	}
+
+	if len(ids) == 2 {
+		return nil
+	}
+	acked, err := redis.Int64(c.conn.Do("XACK", ids...))
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&s.cntEntriesAcked, acked)
+	return nil
+}
+
+// claim takes over entries which stayed pending longer than claimIdleMs,
+// e.g. of consumers which left without acknowledging them.
+func (c *redisStreamsConsumer) claim() error {
+	reply, err := redis.Values(c.conn.Do("XAUTOCLAIM", c.stream, c.group, c.ctx.UserId, c.claimIdleMs, "0-0", "COUNT", redisStreamReadCount))
+	if err != nil {
+		return err
+	}
+	if len(reply) < 2 {
+		return fmt.Errorf("unexpected claim reply %v", reply)
+	}
+	entries, err := parseRedisStreamEntries(reply[1])
+	if err != nil {
+		return err
+	}
+	return c.handle(entries, true)
+}
+
+// samplePending records the number of entries of the group delivered but not
+// yet acknowledged.
+func (c *redisStreamsConsumer) samplePending() error {
+	summary, err := redis.Values(c.conn.Do("XPENDING", c.stream, c.group))
+	if err != nil {
+		return err
+	}
+	if len(summary) == 0 {
+		return fmt.Errorf("unexpected pending reply %v", summary)
+	}
+	pending, err := redis.Int64(summary[0], nil)
+	if err != nil {
+		return err
+	}
+	c.session.setPending(c.group, pending)
+	return nil
+}
+
+func (c *redisStreamsConsumer) run() error {
+	var drainDeadline time.Time
+	for {
+		if time.Now().Sub(c.lastSampleTime) >= time.Second {
+			c.lastSampleTime = time.Now()
+			if c.claimIdleMs > 0 {
+				if err := c.claim(); err != nil {
+					return err
+				}
+			}
+			if c.reportPending {
+				if err := c.samplePending(); err != nil {
+					return err
+				}
+			}
+		}
+
+		reply, err := c.conn.Do("XREADGROUP", "GROUP", c.group, c.ctx.UserId, "COUNT", redisStreamReadCount, "BLOCK", 1000, "STREAMS", c.stream, ">")
+		if err != nil {
+			return err
+		}
+		entries, err := parseRedisStreamRead(reply)
+		if err != nil {
+			return err
+		}
+		if err = c.handle(entries, false); err != nil {
+			return err
+		}
+
+		select {
+		case <-c.stop:
+			if drainDeadline.IsZero() {
+				drainDeadline = time.Now().Add(c.drainTimeout)
+			}
+			if len(entries) == 0 {
+				return nil
+			}
+			if time.Now().After(drainDeadline) {
+				return errors.New("fail to drain the stream within timeout")
+			}
+		default:
+		}
+	}
+}
+
+func (s *RedisStreams) Execute(ctx *UserContext) error {
+	atomic.AddInt64(&s.cntInProgress, 1)
+	defer atomic.AddInt64(&s.cntInProgress, -1)
+
+	role, err := redisRole(ctx.Params)
+	if err != nil {
+		s.logError(ctx, "Invalid role", err)
+		return err
+	}
+	stream := ctx.Params[ParamRedisStream]
+	if stream == "" {
+		stream = redisStreamDefaultKey
+	}
+	groups := int64(1)
+	maxLen := int64(0)
+	claimIdleMs := int64(0)
+	for param, value := range map[string]*int64{
+		ParamRedisStreamGroups:  &groups,
+		ParamRedisStreamMaxLen:  &maxLen,
+		ParamRedisStreamClaimMs: &claimIdleMs,
+	} {
+		if str, ok := ctx.Params[param]; ok {
+			if *value, err = strconv.ParseInt(str, 10, 64); err != nil {
+				s.logError(ctx, "Invalid stream params", err)
+				return err
+			}
+		}
+	}
+	if groups <= 0 {
+		err = errors.New("group count must be positive")
+		s.logError(ctx, "Invalid stream params", err)
+		return err
+	}
+	skipAck := float64(0)
+	if str, ok := ctx.Params[ParamRedisStreamSkipAck]; ok {
+		if skipAck, err = strconv.ParseFloat(str, 64); err != nil {
+			s.logError(ctx, "Invalid stream params", err)
+			return err
+		}
+	}
+	groupIdx, shared, owner := redisStreamGroup(ctx, atomic.AddInt64(&s.userIdx, 1)-1, groups)
+	group := redisStreamGroupPrefix + strconv.FormatInt(groupIdx, 10)
+
+	broadcastDurationSecs := 10
+	if secsStr, ok := ctx.Params[ParamBroadcastDurationSecs]; ok {
+		if secs, err := strconv.Atoi(secsStr); err == nil {
+			broadcastDurationSecs = secs
+		}
+	}
+	pacer, err := NewPacerFromParams(ctx.Params, 1)
+	if err != nil {
+		s.logError(ctx, "Invalid send rate", err)
+		return err
+	}
+
+	var consumer *redisStreamsConsumer
+	consumerDone := make(chan error, 1)
+	if role != RedisRolePublisher {
+		conn, err := s.backplane.Get(stream)
+		if err != nil {
+			s.logError(ctx, "Fail to connect", err)
+			return err
+		}
+		defer conn.Close()
+
+		consumer = &redisStreamsConsumer{
+			session:       s,
+			ctx:           ctx,
+			conn:          conn,
+			stream:        stream,
+			group:         group,
+			lastSeq:       make(map[string]int64),
+			phaseRecv:     s.phases.Counter(ctx, "messages:recv"),
+			phaseLatency:  s.phases.Histogram(ctx, "latency"),
+			reportPending: owner,
+			claimIdleMs:   claimIdleMs,
+			skipAck:       skipAck,
+			drainTimeout:  recvTimeout(ctx.Params),
+			stop:          make(chan struct{}),
+		}
+		// Agents sharing a group only see part of its entries
+		if !shared {
+			consumer.tracker = s.tracker(group)
+		}
+		if err = consumer.createGroup(); err != nil {
+			s.logError(ctx, "Fail to create consumer group", err)
+			return err
+		}
+		go func() {
+			consumerDone <- consumer.run()
+		}()
+	}
+
+	atomic.AddInt64(&s.cntConnected, 1)
+	defer atomic.AddInt64(&s.cntConnected, -1)
+
+	if role == RedisRoleSubscriber {
+		time.Sleep(time.Duration(listenDurationSecs(ctx.Params)) * time.Second)
+	} else {
+		if err = s.produce(ctx, pacer, stream, maxLen, broadcastDurationSecs); err != nil {
+			if consumer != nil {
+				close(consumer.stop)
+				<-consumerDone
+			}
+			return err
+		}
+	}
+
+	if consumer != nil {
+		close(consumer.stop)
+		if err = <-consumerDone; err != nil {
+			s.logError(ctx, "Fail to consume entries", err)
+			return err
+		}
+	}
+
+	atomic.AddInt64(&s.cntSuccess, 1)
+	return nil
+}
+
+func (s *RedisStreams) produce(ctx *UserContext, pacer *Pacer, stream string, maxLen int64, durationSecs int) error {
+	conn, err := s.backplane.Get(stream)
+	if err != nil {
+		s.logError(ctx, "Fail to connect", err)
+		return err
+	}
+	defer conn.Close()
+
+	s.sendRate.Start(pacer)
+	defer s.sendRate.Stop(pacer)
+
+	phaseSend := s.phases.Counter(ctx, "messages:send")
+	sent := int64(0)
+	deadline := time.Now().Add(time.Duration(durationSecs) * time.Second)
+	for {
+		n := pacer.WaitUntil(deadline)
+		if !time.Now().Before(deadline) {
+			return nil
+		}
+
+		for i := 0; i < n; i++ {
+			args := []interface{}{stream}
+			if maxLen > 0 {
+				args = append(args, "MAXLEN", "~", maxLen)
+			}
+			args = append(args, "*", "u", ctx.UserId, "s", sent, "ts", time.Now().UnixNano())
+			if _, err = conn.Do("XADD", args...); err != nil {
+				s.logError(ctx, "Fail to add entry", err)
+				return err
+			}
+
+			sent++
+			atomic.AddInt64(&s.cntEntriesProduced, 1)
+			phaseSend.Inc()
+			s.sendRate.Sent(1)
+		}
+	}
+}
+
+func (s *RedisStreams) Counters() map[string]int64 {
+	counters := map[string]int64{
+		"redis:streams:inprogress":            atomic.LoadInt64(&s.cntInProgress),
+		"redis:streams:connected":             atomic.LoadInt64(&s.cntConnected),
+		"redis:streams:success":               atomic.LoadInt64(&s.cntSuccess),
+		"redis:streams:error":                 atomic.LoadInt64(&s.cntError),
+		"redis:streams:entries:produced":      atomic.LoadInt64(&s.cntEntriesProduced),
+		"redis:streams:entries:consumed":      atomic.LoadInt64(&s.cntEntriesConsumed),
+		"redis:streams:entries:acked":         atomic.LoadInt64(&s.cntEntriesAcked),
+		"redis:streams:entries:redelivered":   atomic.LoadInt64(&s.cntRedelivered),
+		"redis:streams:sendrate:target":       int64(math.Round(s.sendRate.Target())),
+		"redis:streams:sendrate:target:milli": s.sendRate.TargetMilli(),
+		"redis:streams:sendrate:measured":     s.sendRate.Measured(),
+		"redis:streams:messages:lost":         s.sequence.Lost(),
+		"redis:streams:messages:duplicated":   s.sequence.Duplicated(),
+		"redis:streams:messages:outoforder":   s.sequence.OutOfOrder(),
+	}
+
+	s.lock.Lock()
+	pending := int64(0)
+	for _, count := range s.pending {
+		pending += count
+	}
+	s.lock.Unlock()
+	counters["redis:streams:entries:pending"] = pending
+
+	if s.latency != nil {
+		s.latency.AddCounters(counters, "redis:streams:latency")
+	}
+	return counters
+}
+
+func (s *RedisStreams) Metrics() []metrics.Sample {
+	return s.phases.Samples()
+}
@@ -0,0 +1,172 @@
+package sessions
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestParseRedisStreamRead(t *testing.T) {
+	reply := []interface{}{
+		[]interface{}{
+			[]byte("sigbench:stream"),
+			[]interface{}{
+				[]interface{}{[]byte("1-0"), []interface{}{[]byte("u"), []byte("user1"), []byte("s"), []byte("0"), []byte("ts"), []byte("100")}},
+				[]interface{}{[]byte("2-0"), nil},
+			},
+		},
+	}
+	entries, err := parseRedisStreamRead(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatal("Expect 2 entries but got", len(entries))
+	}
+	if entries[0].Id != "1-0" || entries[0].Fields["u"] != "user1" || entries[0].Fields["ts"] != "100" {
+		t.Error("Unexpected entry", entries[0])
+	}
+	if entries[1].Id != "2-0" || entries[1].Fields != nil {
+		t.Error("Expect deleted entry without fields but got", entries[1])
+	}
+
+	if entries, err = parseRedisStreamRead(nil); err != nil || entries != nil {
+		t.Error("Expect no entries on timeout but got", entries, err)
+	}
+	if _, err = parseRedisStreamRead([]interface{}{[]interface{}{[]byte("sigbench:stream")}}); err == nil {
+		t.Error("Expect error for malformed reply")
+	}
+}
+
+func TestRedisStreamGroup(t *testing.T) {
+	tests := []struct {
+		name       string
+		agentIdx   int
+		agentCount int
+		groups     int64
+		expected   []int64
+		shared     bool
+	}{
+		{"single agent", 0, 1, 2, []int64{0, 1, 0}, false},
+		{"first agent", 0, 2, 3, []int64{0, 2, 0}, false},
+		{"second agent", 1, 2, 3, []int64{1, 1, 1}, false},
+		{"shared first", 1, 3, 2, []int64{1, 0, 1}, true},
+		{"shared", 2, 3, 2, []int64{0, 1, 0}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := &UserContext{AgentIdx: test.agentIdx, AgentCount: test.agentCount}
+			for localIdx, expected := range test.expected {
+				group, shared, owner := redisStreamGroup(ctx, int64(localIdx), test.groups)
+				if group != expected || shared != test.shared {
+					t.Fatal("Expect group", expected, test.shared, "for user", localIdx, "but got", group, shared)
+				}
+				// Only one agent samples the pending entries of a shared group
+				if owner != (!shared || group == int64(test.agentIdx)) {
+					t.Fatal("Unexpected owner", owner, "of group", group)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisStreamsHandleRedelivered(t *testing.T) {
+	node := startFakeRedisNode(t, map[string]string{"XACK": ":2\r\n"})
+	conn, err := redis.Dial("tcp", node.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := &RedisStreams{latency: NewLatencyHistogram()}
+	c := &redisStreamsConsumer{
+		session: s,
+		ctx:     &UserContext{UserId: "user1"},
+		conn:    conn,
+		stream:  redisStreamDefaultKey,
+		group:   "sigbench:0",
+		tracker: NewSequenceTracker(),
+		lastSeq: make(map[string]int64),
+
+		phaseRecv:    s.phases.Counter(&UserContext{}, "messages:recv"),
+		phaseLatency: s.phases.Histogram(&UserContext{}, "latency"),
+	}
+	entry := func(id string, seq int) RedisStreamEntry {
+		return RedisStreamEntry{Id: id, Fields: map[string]string{
+			"u":  "user2",
+			"s":  strconv.Itoa(seq),
+			"ts": strconv.FormatInt(time.Now().UnixNano(), 10),
+		}}
+	}
+
+	if err = c.handle([]RedisStreamEntry{entry("1-0", 0), entry("2-0", 1)}, false); err != nil {
+		t.Fatal(err)
+	}
+	// Claimed entries were checked on their first delivery
+	if err = c.handle([]RedisStreamEntry{entry("1-0", 0), entry("2-0", 1)}, true); err != nil {
+		t.Fatal(err)
+	}
+
+	counters := s.Counters()
+	if counters["redis:streams:entries:consumed"] != 4 || counters["redis:streams:entries:redelivered"] != 2 || counters["redis:streams:entries:acked"] != 4 {
+		t.Error("Unexpected entry counters", counters)
+	}
+	if counters["redis:streams:messages:duplicated"] != 0 || counters["redis:streams:messages:lost"] != 0 {
+		t.Error("Expect no sequence errors but got", counters)
+	}
+	if counters["redis:streams:latency:<100"] != 2 {
+		t.Error("Expect the latency of the first deliveries but got", counters)
+	}
+}
+
+func TestRedisStreamsHandleConcurrentConsumers(t *testing.T) {
+	node := startFakeRedisNode(t, map[string]string{"XACK": ":2\r\n"})
+	s := &RedisStreams{latency: NewLatencyHistogram()}
+	tracker := NewSequenceTracker()
+	consumer := func() *redisStreamsConsumer {
+		conn, err := redis.Dial("tcp", node.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return &redisStreamsConsumer{
+			session: s,
+			ctx:     &UserContext{UserId: "user1"},
+			conn:    conn,
+			stream:  redisStreamDefaultKey,
+			group:   "sigbench:0",
+			tracker: tracker,
+			lastSeq: make(map[string]int64),
+
+			phaseRecv:    s.phases.Counter(&UserContext{}, "messages:recv"),
+			phaseLatency: s.phases.Histogram(&UserContext{}, "latency"),
+		}
+	}
+	entry := func(id string, seq int) RedisStreamEntry {
+		return RedisStreamEntry{Id: id, Fields: map[string]string{
+			"u":  "user2",
+			"s":  strconv.Itoa(seq),
+			"ts": strconv.FormatInt(time.Now().UnixNano(), 10),
+		}}
+	}
+
+	// The second consumer handles its batch before the first one
+	a, b := consumer(), consumer()
+	if err := b.handle([]RedisStreamEntry{entry("3-0", 2), entry("4-0", 3)}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.handle([]RedisStreamEntry{entry("1-0", 0), entry("2-0", 1)}, false); err != nil {
+		t.Fatal(err)
+	}
+	// Older and repeated entries within a consumer
+	if err := a.handle([]RedisStreamEntry{entry("5-0", 0), entry("6-0", 4), entry("7-0", 4)}, false); err != nil {
+		t.Fatal(err)
+	}
+
+	counters := s.Counters()
+	if counters["redis:streams:messages:lost"] != 0 || counters["redis:streams:messages:outoforder"] != 1 || counters["redis:streams:messages:duplicated"] != 1 {
+		t.Error("Expect only the consumer's own reordering and duplicate but got", counters)
+	}
+}
@@ -0,0 +1,195 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+const (
+	ScriptActionConnect    = "connect"
+	ScriptActionInvoke     = "invoke"
+	ScriptActionWait       = "wait"
+	ScriptActionSleep      = "sleep"
+	ScriptActionJoinGroup  = "joinGroup"
+	ScriptActionLoop       = "loop"
+	ScriptActionDisconnect = "disconnect"
+)
+
+// ScriptUserIdPlaceholder is replaced by the user id in invocation arguments,
+// group names and wait patterns.
+const ScriptUserIdPlaceholder = "$userId"
+
+// ScriptStep is one step of a scripted scenario. Only the fields relevant to
+// its action are used.
+type ScriptStep struct {
+	// Name marks the moment the step finished so that later steps can be
+	// timed against it.
+	Name   string
+	Action string
+
+	// Since names an earlier step; the time between that step and this one is
+	// reported under this step's name.
+	Since string
+
+	// invoke and joinGroup
+	Method    string
+	Arguments []interface{}
+	NoWait    bool
+
+	// joinGroup
+	Group string
+
+	// wait, patterns are regular expressions
+	Target    string
+	Argument  string
+	TimeoutMs int
+
+	// sleep
+	DurationMs int
+
+	// loop
+	Count int
+	Steps []ScriptStep
+}
+
+// LoadScript reads the scenario steps from the script parameter or, if it
+// is absent, from the file named by scriptFile. No script yields nil steps.
+func LoadScript(params map[string]string) ([]ScriptStep, error) {
+	content := params[ParamScript]
+	if content == "" {
+		path := params[ParamScriptFile]
+		if path == "" {
+			return nil, nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("fail to read script file: %s", err)
+		}
+		content = string(data)
+	}
+
+	var steps []ScriptStep
+	if err := json.Unmarshal([]byte(content), &steps); err != nil {
+		return nil, fmt.Errorf("fail to decode script: %s", err)
+	}
+	if err := validateScript(steps, make(map[string]bool)); err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+// validateScript checks the steps in order; named holds the names of the
+// steps which may precede them.
+func validateScript(steps []ScriptStep, named map[string]bool) error {
+	for i, step := range steps {
+		where := fmt.Sprintf("step %d (%s)", i, step.Action)
+
+		switch step.Action {
+		case ScriptActionConnect, ScriptActionDisconnect:
+		case ScriptActionInvoke:
+			if step.Method == "" {
+				return errors.New(where + ": method is required")
+			}
+		case ScriptActionJoinGroup:
+			if step.Group == "" {
+				return errors.New(where + ": group is required")
+			}
+		case ScriptActionWait:
+			if step.Target == "" && step.Argument == "" {
+				return errors.New(where + ": target or argument pattern is required")
+			}
+			for _, pattern := range []string{step.Target, step.Argument} {
+				if _, err := compileScriptPattern(pattern, "user"); err != nil {
+					return fmt.Errorf("%s: invalid pattern: %s", where, err)
+				}
+			}
+		case ScriptActionSleep:
+			if step.DurationMs < 0 {
+				return errors.New(where + ": duration must not be negative")
+			}
+		case ScriptActionLoop:
+			if step.Count <= 0 {
+				return errors.New(where + ": count must be positive")
+			}
+			if err := validateScript(step.Steps, named); err != nil {
+				return fmt.Errorf("%s: %s", where, err)
+			}
+		default:
+			return errors.New(where + ": unknown action")
+		}
+
+		if step.Since != "" {
+			if step.Name == "" {
+				return errors.New(where + ": timed step must be named")
+			}
+			if !named[step.Since] {
+				return fmt.Errorf("%s: no earlier step named %s", where, step.Since)
+			}
+		}
+		if step.Name != "" {
+			named[step.Name] = true
+		}
+	}
+	return nil
+}
+
+// scriptTimers returns the names of all timed steps.
+func scriptTimers(steps []ScriptStep) []string {
+	var timers []string
+	for _, step := range steps {
+		if step.Since != "" {
+			timers = append(timers, step.Name)
+		}
+		timers = append(timers, scriptTimers(step.Steps)...)
+	}
+	return timers
+}
+
+func compileScriptPattern(pattern, userId string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(strings.Replace(pattern, ScriptUserIdPlaceholder, regexp.QuoteMeta(userId), -1))
+}
+
+// expandScriptArguments substitutes the user id into string arguments.
+func expandScriptArguments(args []interface{}, userId string) []interface{} {
+	expanded := make([]interface{}, len(args))
+	for i, arg := range args {
+		if str, ok := arg.(string); ok {
+			arg = strings.Replace(str, ScriptUserIdPlaceholder, userId, -1)
+		}
+		expanded[i] = arg
+	}
+	return expanded
+}
+
+// matchScriptInvocation reports whether an incoming invocation matches the
+// target pattern and has an argument matching the argument pattern. Nil
+// patterns match anything.
+func matchScriptInvocation(msg *SignalRCoreHubInvocation, target, argument *regexp.Regexp) bool {
+	if target != nil && !target.MatchString(msg.Target) {
+		return false
+	}
+	if argument == nil {
+		return true
+	}
+	for _, arg := range msg.Arguments {
+		str, ok := arg.(string)
+		if !ok {
+			data, err := json.Marshal(arg)
+			if err != nil {
+				continue
+			}
+			str = string(data)
+		}
+		if argument.MatchString(str) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package sessions
+
+import (
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"microsoft.com/sigbench/fakeserver"
+	"microsoft.com/sigbench/metrics"
+)
+
+func TestLoadScript(t *testing.T) {
+	t.Run("no script", func(t *testing.T) {
+		steps, err := LoadScript(map[string]string{})
+		if err != nil || steps != nil {
+			t.Fatal("Expect no steps but got", steps, err)
+		}
+	})
+
+	t.Run("timers", func(t *testing.T) {
+		steps, err := LoadScript(map[string]string{
+			ParamScript: `[
+				{"Action": "connect", "Name": "connected"},
+				{"Action": "loop", "Count": 2, "Steps": [
+					{"Action": "invoke", "Method": "send", "Arguments": ["$userId", "hi"], "Name": "sent"},
+					{"Action": "wait", "Target": "^broadcastMessage$", "Argument": "^$userId$", "Name": "echoed", "Since": "sent"}
+				]},
+				{"Action": "disconnect", "Name": "done", "Since": "connected"}
+			]`,
+		})
+		if err != nil {
+			t.Fatal("Expect valid script but got", err)
+		}
+		timers := scriptTimers(steps)
+		if len(timers) != 2 || timers[0] != "echoed" || timers[1] != "done" {
+			t.Fatal("Expect timers echoed and done but got", timers)
+		}
+	})
+
+	invalid := map[string]string{
+		"unknown action":   `[{"Action": "jump"}]`,
+		"missing method":   `[{"Action": "invoke"}]`,
+		"missing pattern":  `[{"Action": "wait"}]`,
+		"bad pattern":      `[{"Action": "wait", "Target": "("}]`,
+		"empty loop":       `[{"Action": "loop"}]`,
+		"unnamed timer":    `[{"Action": "connect", "Name": "a"}, {"Action": "sleep", "Since": "a"}]`,
+		"timer from later": `[{"Action": "sleep", "Name": "b", "Since": "a"}, {"Action": "connect", "Name": "a"}]`,
+	}
+	for name, script := range invalid {
+		if _, err := LoadScript(map[string]string{ParamScript: script}); err == nil {
+			t.Error("Expect error for", name)
+		}
+	}
+}
+
+func TestMatchScriptInvocation(t *testing.T) {
+	msg := &SignalRCoreHubInvocation{
+		Type:      SignalRCoreTypeInvocation,
+		Target:    "broadcastMessage",
+		Arguments: []interface{}{"user-1", float64(42)},
+	}
+
+	argument, _ := compileScriptPattern("^$userId$", "user-1")
+	if !matchScriptInvocation(msg, regexp.MustCompile("^broadcast"), argument) {
+		t.Fatal("Expect target and user id argument to match")
+	}
+	if !matchScriptInvocation(msg, nil, regexp.MustCompile("^42$")) {
+		t.Fatal("Expect number argument to match")
+	}
+	if matchScriptInvocation(msg, regexp.MustCompile("^echo$"), nil) {
+		t.Fatal("Expect other target not to match")
+	}
+	argument, _ = compileScriptPattern("^$userId$", "user-2")
+	if matchScriptInvocation(msg, nil, argument) {
+		t.Fatal("Expect other user id not to match")
+	}
+}
+
+func TestScriptErrorCountedOnce(t *testing.T) {
+	ts := httptest.NewServer(fakeserver.NewSignalRCoreServer(""))
+	defer ts.Close()
+
+	params := map[string]string{
+		ParamHost: strings.TrimPrefix(ts.URL, "http://"),
+		ParamScript: `[
+			{"Action": "connect"},
+			{"Action": "loop", "Count": 2, "Steps": [
+				{"Action": "loop", "Count": 2, "Steps": [
+					{"Action": "invoke", "Method": "unknown"}
+				]}
+			]}
+		]`,
+	}
+	s := &SignalRCoreScript{}
+	if err := s.Setup(params); err != nil {
+		t.Fatal(err)
+	}
+	err := s.Execute(&UserContext{UserId: "user0", Params: params})
+	if err == nil || !strings.HasPrefix(err.Error(), "loop step: loop step: invoke step: invocation failed") {
+		t.Fatal("Expect the failing step in the error but got", err)
+	}
+	if counters := s.Counters(); counters["signalrcore:script:error"] != 1 {
+		t.Fatal("Expect the error to be counted once but got", counters)
+	}
+}
+
+func TestScriptInvokeForgetsPending(t *testing.T) {
+	ts := httptest.NewServer(fakeserver.NewSignalRCoreServer(""))
+	defer ts.Close()
+
+	params := map[string]string{ParamHost: strings.TrimPrefix(ts.URL, "http://")}
+	s := &SignalRCoreScript{}
+	s.Setup(params)
+	endpoint, err := NewEndpoint(strings.TrimPrefix(ts.URL, "http://"), params, &s.connect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &UserContext{UserId: "user0", Params: params}
+	r := &scriptRun{
+		s:           s,
+		ctx:         ctx,
+		endpoint:    endpoint,
+		recvTimeout: time.Second,
+
+		phaseRecv:    s.phases.Counter(ctx, "messages:recv"),
+		phaseSend:    s.phases.Counter(ctx, "messages:send"),
+		phaseLatency: s.phases.Histogram(ctx, "latency"),
+	}
+	defer r.close()
+	if err = r.connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.invoke("disconnect", []interface{}{}, false, time.Second); err == nil {
+		t.Fatal("Expect error when the connection drops")
+	}
+	r.pendingLock.Lock()
+	pending := len(r.pending)
+	r.pendingLock.Unlock()
+	if pending != 0 {
+		t.Fatal("Expect no pending invocations but got", pending)
+	}
+}
+
+func TestScriptTimers(t *testing.T) {
+	ts := httptest.NewServer(fakeserver.NewSignalRCoreServer(""))
+	defer ts.Close()
+
+	params := map[string]string{
+		ParamHost: strings.TrimPrefix(ts.URL, "http://"),
+		ParamScript: `[
+			{"Action": "connect", "Name": "connected"},
+			{"Action": "disconnect", "Name": "done", "Since": "connected"}
+		]`,
+	}
+	s := &SignalRCoreScript{}
+	if err := s.Setup(params); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Execute(&UserContext{UserId: "user0", Params: params}); err != nil {
+		t.Fatal(err)
+	}
+	if timers := metrics.Flatten(s.Metrics()); timers["timer{timer=done}:<100"] != 1 {
+		t.Fatal("Expect the timer labeled with its step but got", timers)
+	}
+}
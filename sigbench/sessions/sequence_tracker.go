@@ -0,0 +1,169 @@
+package sessions
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// SequenceResult describes how a received sequence number relates to the ones
+// seen before from the same sender. Lost is negative when a message that was
+// considered lost arrives late.
+type SequenceResult struct {
+	Lost       int64
+	OutOfOrder bool
+	Duplicate  bool
+}
+
+// DefaultSequenceWindow is how far behind the newest sequence number of a
+// sender missing messages are remembered.
+const DefaultSequenceWindow = 10000
+
+type senderSequence struct {
+	next    int64
+	missing map[int64]struct{}
+}
+
+// SequenceTracker follows the sequence numbers received from each sender to
+// detect lost, duplicated and out-of-order messages. Sequence numbers of a
+// sender are expected to increase by 1. Since users may join in the middle of
+// a broadcast, the first message seen from a sender sets its baseline unless
+// the sender was registered with Follow.
+//
+// Missing messages are only remembered within a sliding window behind the
+// newest sequence number, so that memory stays bounded over long runs. A
+// message arriving later than the window is reported out of order but stays
+// counted as lost, since it can't be told apart from a duplicate.
+type SequenceTracker struct {
+	Window int64
+
+	lock    sync.Mutex
+	senders map[string]*senderSequence
+}
+
+func NewSequenceTracker() *SequenceTracker {
+	return &SequenceTracker{
+		Window:  DefaultSequenceWindow,
+		senders: make(map[string]*senderSequence),
+	}
+}
+
+func (t *SequenceTracker) sender(id string, next int64) *senderSequence {
+	seq, ok := t.senders[id]
+	if !ok {
+		seq = &senderSequence{
+			next:    next,
+			missing: make(map[int64]struct{}),
+		}
+		t.senders[id] = seq
+	}
+	return seq
+}
+
+// Follow registers a sender whose first sequence number is known in advance,
+// so that losses at the head of its sequence are detected as well.
+func (t *SequenceTracker) Follow(sender string, next int64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.sender(sender, next)
+}
+
+func (t *SequenceTracker) Track(sender string, seq int64) SequenceResult {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s := t.sender(sender, seq)
+	if seq == s.next {
+		s.next++
+		return SequenceResult{}
+	}
+
+	if seq > s.next {
+		from := s.next
+		if from < seq-t.Window {
+			from = seq - t.Window
+		}
+		for i := from; i < seq; i++ {
+			s.missing[i] = struct{}{}
+		}
+		lost := seq - s.next
+		s.next = seq + 1
+		t.prune(s)
+		return SequenceResult{Lost: lost}
+	}
+
+	if seq < s.next-t.Window {
+		return SequenceResult{OutOfOrder: true}
+	}
+
+	if _, ok := s.missing[seq]; ok {
+		delete(s.missing, seq)
+		return SequenceResult{Lost: -1, OutOfOrder: true}
+	}
+
+	return SequenceResult{Duplicate: true}
+}
+
+// prune forgets missing messages which fell out of the window.
+func (t *SequenceTracker) prune(s *senderSequence) {
+	if int64(len(s.missing)) <= t.Window {
+		return
+	}
+	for i := range s.missing {
+		if i < s.next-t.Window {
+			delete(s.missing, i)
+		}
+	}
+}
+
+// Finish reports messages at the tail of a sender's sequence that never
+// arrived, given the total number of messages the sender is known to have sent.
+func (t *SequenceTracker) Finish(sender string, total int64) SequenceResult {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	s := t.sender(sender, 0)
+	if total <= s.next {
+		return SequenceResult{}
+	}
+	lost := total - s.next
+	s.next = total
+	return SequenceResult{Lost: lost}
+}
+
+// SequenceCounters aggregates sequence results of all users of a session.
+type SequenceCounters struct {
+	cntLost       int64
+	cntDuplicated int64
+	cntOutOfOrder int64
+}
+
+func (c *SequenceCounters) Reset() {
+	atomic.StoreInt64(&c.cntLost, 0)
+	atomic.StoreInt64(&c.cntDuplicated, 0)
+	atomic.StoreInt64(&c.cntOutOfOrder, 0)
+}
+
+func (c *SequenceCounters) Record(r SequenceResult) {
+	if r.Lost != 0 {
+		atomic.AddInt64(&c.cntLost, r.Lost)
+	}
+	if r.Duplicate {
+		atomic.AddInt64(&c.cntDuplicated, 1)
+	}
+	if r.OutOfOrder {
+		atomic.AddInt64(&c.cntOutOfOrder, 1)
+	}
+}
+
+func (c *SequenceCounters) Lost() int64 {
+	return atomic.LoadInt64(&c.cntLost)
+}
+
+func (c *SequenceCounters) Duplicated() int64 {
+	return atomic.LoadInt64(&c.cntDuplicated)
+}
+
+func (c *SequenceCounters) OutOfOrder() int64 {
+	return atomic.LoadInt64(&c.cntOutOfOrder)
+}
@@ -0,0 +1,89 @@
+package sessions
+
+import "testing"
+
+func TestSequenceTracker(t *testing.T) {
+	t.Run("in order", func(t *testing.T) {
+		tracker := NewSequenceTracker()
+		for i := int64(0); i < 5; i++ {
+			if r := tracker.Track("a", i); r != (SequenceResult{}) {
+				t.Fatal("Expect no anomaly but got", r)
+			}
+		}
+	})
+
+	t.Run("joined late", func(t *testing.T) {
+		tracker := NewSequenceTracker()
+		if r := tracker.Track("a", 42); r != (SequenceResult{}) {
+			t.Fatal("Expect first message to set baseline but got", r)
+		}
+		if r := tracker.Track("a", 43); r != (SequenceResult{}) {
+			t.Fatal("Expect no anomaly but got", r)
+		}
+	})
+
+	t.Run("followed head loss", func(t *testing.T) {
+		tracker := NewSequenceTracker()
+		tracker.Follow("a", 0)
+		if r := tracker.Track("a", 2); r.Lost != 2 {
+			t.Fatal("Expect 2 lost but got", r)
+		}
+	})
+
+	t.Run("gap filled late", func(t *testing.T) {
+		tracker := NewSequenceTracker()
+		tracker.Track("a", 0)
+		if r := tracker.Track("a", 3); r.Lost != 2 {
+			t.Fatal("Expect 2 lost but got", r)
+		}
+		if r := tracker.Track("a", 1); r.Lost != -1 || !r.OutOfOrder {
+			t.Fatal("Expect late arrival but got", r)
+		}
+		if r := tracker.Track("a", 1); !r.Duplicate {
+			t.Fatal("Expect duplicate but got", r)
+		}
+	})
+
+	t.Run("senders are independent", func(t *testing.T) {
+		tracker := NewSequenceTracker()
+		tracker.Track("a", 0)
+		if r := tracker.Track("b", 0); r != (SequenceResult{}) {
+			t.Fatal("Expect no anomaly but got", r)
+		}
+	})
+
+	t.Run("tail loss", func(t *testing.T) {
+		tracker := NewSequenceTracker()
+		tracker.Follow("a", 0)
+		tracker.Track("a", 0)
+		tracker.Track("a", 1)
+		if r := tracker.Finish("a", 5); r.Lost != 3 {
+			t.Fatal("Expect 3 lost but got", r)
+		}
+	})
+
+	t.Run("window", func(t *testing.T) {
+		tracker := NewSequenceTracker()
+		tracker.Window = 10
+		tracker.Track("a", 0)
+		if r := tracker.Track("a", 1000); r.Lost != 999 {
+			t.Fatal("Expect 999 lost but got", r)
+		}
+		if n := len(tracker.senders["a"].missing); n != 10 {
+			t.Fatal("Expect 10 missing messages remembered but got", n)
+		}
+		if r := tracker.Track("a", 995); r.Lost != -1 || !r.OutOfOrder {
+			t.Fatal("Expect late arrival within the window but got", r)
+		}
+		if r := tracker.Track("a", 5); r.Lost != 0 || !r.OutOfOrder {
+			t.Fatal("Expect late arrival beyond the window to stay lost but got", r)
+		}
+
+		for i := int64(1001); i < 1100; i += 2 {
+			tracker.Track("a", i)
+		}
+		if n := len(tracker.senders["a"].missing); n > 2*10 {
+			t.Fatal("Expect missing messages to be pruned but got", n)
+		}
+	})
+}
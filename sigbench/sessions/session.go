@@ -3,6 +3,8 @@ package sessions
 import (
 	"log"
 	"sync/atomic"
+
+	"microsoft.com/sigbench/metrics"
 )
 
 type Session interface {
@@ -12,11 +14,28 @@ type Session interface {
 	Counters() map[string]int64
 }
 
+// MetricsSession is a session which also reports labeled metrics. The agent
+// adds the session label to them.
+type MetricsSession interface {
+	Session
+	Metrics() []metrics.Sample
+}
+
 var SessionMap = map[string]Session{
-	"signalrcore:echo":             &SignalRCoreEcho{},
-	"signalrcore:broadcast:sender": &SignalRCoreBroadcastSender{},
-	"signalrfx:broadcast:sender":   &SignalRFxBroadcastSender{},
-	"redis:pubsub":                 &RedisPubSub{},
+	"signalrcore:echo":               &SignalRCoreEcho{},
+	"signalrcore:broadcast:sender":   &SignalRCoreBroadcastSender{},
+	"signalrcore:broadcast:receiver": &SignalRCoreBroadcastReceiver{},
+	"signalrcore:invoke":             &SignalRCoreInvoke{},
+	"signalrcore:stream":             &SignalRCoreStream{},
+	"signalrcore:stream:upload":      &SignalRCoreStreamUpload{},
+	"signalrcore:script":             &SignalRCoreScript{},
+	"signalrfx:broadcast:sender":     &SignalRFxBroadcastSender{},
+	"signalrfx:broadcast:receiver":   &SignalRFxBroadcastReceiver{},
+	"redis:pubsub":                   &RedisPubSub{},
+	"redis:streams":                  &RedisStreams{},
+	"ws:echo":                        NewWsEcho(),
+	"ws:broadcast":                   NewWsBroadcast(),
+	"http:request":                   &HttpRequestSession{},
 }
 
 type DummySession struct {
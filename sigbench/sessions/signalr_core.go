@@ -1,9 +1,22 @@
 package sessions
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
 
 const SignalRCoreTerminator = '\x1e'
 
+const (
+	SignalRCoreTypeInvocation       = 1
+	SignalRCoreTypeStreamItem       = 2
+	SignalRCoreTypeCompletion       = 3
+	SignalRCoreTypeStreamInvocation = 4
+	SignalRCoreTypeCancelInvocation = 5
+)
+
 type SignalRCoreHandshakeResp struct {
 	AvailableTransports []string `json:"availableTransports"`
 	ConnectionId        string   `json:"connectionId"`
@@ -17,6 +30,34 @@ type SignalRCoreInvocation struct {
 	Arguments    []string `json:"arguments"`
 }
 
+// SignalRCoreHubInvocation is an invocation whose arguments are arbitrary
+// JSON values rather than strings.
+type SignalRCoreHubInvocation struct {
+	InvocationId string        `json:"invocationId,omitempty"`
+	Type         int           `json:"type"`
+	Target       string        `json:"target"`
+	Arguments    []interface{} `json:"arguments"`
+	StreamIds    []string      `json:"streamIds,omitempty"`
+}
+
+type SignalRCoreStreamItem struct {
+	Type         int         `json:"type"`
+	InvocationId string      `json:"invocationId"`
+	Item         interface{} `json:"item"`
+}
+
+type SignalRCoreCancelInvocation struct {
+	Type         int    `json:"type"`
+	InvocationId string `json:"invocationId"`
+}
+
+type SignalRCoreCompletion struct {
+	Type         int             `json:"type"`
+	InvocationId string          `json:"invocationId"`
+	Result       json.RawMessage `json:"result,omitempty"`
+	Error        string          `json:"error,omitempty"`
+}
+
 func SerializeSignalRCoreMessage(body interface{}) ([]byte, error) {
 	msg, err := json.Marshal(body)
 	if err != nil {
@@ -25,3 +66,49 @@ func SerializeSignalRCoreMessage(body interface{}) ([]byte, error) {
 
 	return append(msg, SignalRCoreTerminator), nil
 }
+
+// DialSignalRCore negotiates a connection id with the chat hub on endpoint, opens
+// the websocket transport and completes the JSON protocol handshake. The
+// negotiate response is returned so that callers can inspect its headers.
+// Pings are sent at the interval configured in params.
+func DialSignalRCore(endpoint *Endpoint, params map[string]string, counters *SignalRCoreProtocolCounters) (*SignalRCoreConn, *http.Response, error) {
+	start := time.Now()
+	handshakeReq, err := http.NewRequest(http.MethodOptions, endpoint.HttpUrl("/chat"), nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to construct handshake request: %s", err)
+	}
+
+	handshakeResp, err := endpoint.Do(handshakeReq)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to obtain connection id: %s", err)
+	}
+	defer handshakeResp.Body.Close()
+
+	decoder := json.NewDecoder(handshakeResp.Body)
+	var handshakeContent SignalRCoreHandshakeResp
+	if err = decoder.Decode(&handshakeContent); err != nil {
+		return nil, handshakeResp, fmt.Errorf("fail to decode connection id: %s", err)
+	}
+	endpoint.Record(ConnectStageNegotiate, time.Now().Sub(start))
+	endpoint.RecordBackend(handshakeResp)
+
+	conn, _, err := endpoint.DialWebsocket("/chat?id=" + handshakeContent.ConnectionId)
+	if err != nil {
+		return nil, handshakeResp, fmt.Errorf("fail to connect to websocket: %s", err)
+	}
+
+	c := newSignalRCoreConn(conn, counters)
+	handshakeStart := time.Now()
+	if err = c.handshake(); err != nil {
+		c.Close()
+		return nil, handshakeResp, err
+	}
+	endpoint.Record(ConnectStageHandshakeAck, time.Now().Sub(handshakeStart))
+	endpoint.Record(ConnectStageTotal, time.Now().Sub(start))
+
+	if interval := signalRCorePingInterval(params); interval > 0 {
+		go c.keepAlive(interval)
+	}
+
+	return c, handshakeResp, nil
+}
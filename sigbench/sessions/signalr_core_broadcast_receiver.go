@@ -0,0 +1,259 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"microsoft.com/sigbench/metrics"
+)
+
+type SignalRCoreBroadcastReceiver struct {
+	cntInProgress            int64
+	cntConnected             int64
+	cntError                 int64
+	cntCloseError            int64
+	cntSuccess               int64
+	cntMessagesRecv          int64
+	cntMessagesRecvSender    int64
+	cntLatencyLessThan100ms  int64
+	cntLatencyLessThan500ms  int64
+	cntLatencyLessThan1000ms int64
+	cntLatencyMoreThan1000ms int64
+	sequence                 SequenceCounters
+	reconnect                ReconnectCounters
+	protocol                 SignalRCoreProtocolCounters
+	connect                  ConnectCounters
+	endpoints                EndpointSelector
+	phases                   PhaseMetrics
+}
+
+func (s *SignalRCoreBroadcastReceiver) Name() string {
+	return "SignalRCore:Broadcast:Receiver"
+}
+
+func (s *SignalRCoreBroadcastReceiver) Setup(map[string]string) error {
+	s.endpoints.Reset()
+	s.phases.Reset()
+	s.cntInProgress = 0
+	s.cntConnected = 0
+	s.cntError = 0
+	s.cntCloseError = 0
+	s.cntSuccess = 0
+	s.cntMessagesRecv = 0
+	s.cntMessagesRecvSender = 0
+	s.cntLatencyLessThan100ms = 0
+	s.cntLatencyLessThan500ms = 0
+	s.cntLatencyLessThan1000ms = 0
+	s.cntLatencyMoreThan1000ms = 0
+	s.sequence.Reset()
+	s.reconnect.Reset()
+	s.protocol.Reset()
+	s.connect.Reset()
+	return nil
+}
+
+func (s *SignalRCoreBroadcastReceiver) logError(ctx *UserContext, msg string, err error) {
+	log.Printf("[Error][%s] %s due to %s", ctx.UserId, msg, err)
+	atomic.AddInt64(&s.cntError, 1)
+	s.phases.Add(ctx, "errors", 1)
+}
+
+func (s *SignalRCoreBroadcastReceiver) logLatency(phaseLatency *metrics.Histogram, latency int64) {
+	phaseLatency.Observe(latency)
+	if latency < 100 {
+		atomic.AddInt64(&s.cntLatencyLessThan100ms, 1)
+	} else if latency < 500 {
+		atomic.AddInt64(&s.cntLatencyLessThan500ms, 1)
+	} else if latency < 1000 {
+		atomic.AddInt64(&s.cntLatencyLessThan1000ms, 1)
+	} else {
+		atomic.AddInt64(&s.cntLatencyMoreThan1000ms, 1)
+	}
+}
+
+func (s *SignalRCoreBroadcastReceiver) Execute(ctx *UserContext) (err error) {
+	atomic.AddInt64(&s.cntInProgress, 1)
+	defer atomic.AddInt64(&s.cntInProgress, -1)
+
+	// Metrics of the user's phase, looked up once for all messages
+	phaseRecv := s.phases.Counter(ctx, "messages:recv")
+	phaseLatency := s.phases.Histogram(ctx, "latency")
+
+	lease, err := s.endpoints.Select(ctx, ctx.Params[ParamHost])
+	if err != nil {
+		s.logError(ctx, "Invalid endpoint selection", err)
+		return err
+	}
+	defer func() { lease.Release(err) }()
+	host := lease.Target
+
+	endpoint, err := NewEndpoint(host, ctx.Params, &s.connect)
+	if err != nil {
+		s.logError(ctx, "Invalid endpoint params", err)
+		return err
+	}
+
+	listenDurationSecs := listenDurationSecs(ctx.Params)
+	tag := senderTag(ctx.Params)
+	tracker := NewSequenceTracker()
+
+	reconnectPolicy, err := NewReconnectPolicyFromParams(ctx.Params)
+	if err != nil {
+		s.logError(ctx, "Invalid reconnect policy", err)
+		return err
+	}
+	dropper, err := NewConnectionDropperFromParams(ctx)
+	if err != nil {
+		s.logError(ctx, "Invalid drop params", err)
+		return err
+	}
+
+	var c *SignalRCoreConn
+	var closeChan chan struct{}
+	// Why the reader stopped, set before closeChan is closed
+	var readErr error
+
+	connect := func() error {
+		conn, _, err := DialSignalRCore(endpoint, ctx.Params, &s.protocol)
+		if err != nil {
+			return err
+		}
+
+		c = conn
+		closeChan = make(chan struct{})
+
+		go func(c *SignalRCoreConn, closeChan chan struct{}) {
+			defer c.Close()
+			defer close(closeChan)
+			for {
+				msg, err := c.ReadFrame()
+				if err != nil {
+					readErr = err
+					return
+				}
+
+				var content SignalRCoreInvocation
+				err = json.Unmarshal(msg, &content)
+				if err != nil {
+					readErr = fmt.Errorf("fail to decode incoming message: %s", err)
+					return
+				}
+
+				atomic.AddInt64(&s.cntMessagesRecv, 1)
+				phaseRecv.Inc()
+
+				if content.Type == 1 && content.Target == "broadcastMessage" && len(content.Arguments) > 1 {
+					payload, err := DecodeBroadcastPayload(content.Arguments[1])
+					if err != nil || payload.Tag != tag {
+						continue
+					}
+
+					result := tracker.Track(content.Arguments[0], payload.Seq)
+					s.sequence.Record(result)
+					if result.Duplicate {
+						continue
+					}
+
+					atomic.AddInt64(&s.cntMessagesRecvSender, 1)
+					s.logLatency(phaseLatency, (time.Now().UnixNano()-payload.Timestamp)/1000000)
+				}
+			}
+		}(c, closeChan)
+
+		return nil
+	}
+
+	if err = connect(); err != nil {
+		s.logError(ctx, "Fail to connect", err)
+		return err
+	}
+
+	listenDeadline := time.After(time.Duration(listenDurationSecs) * time.Second)
+	dropped := false
+	for {
+		atomic.AddInt64(&s.cntConnected, 1)
+		cancelDrop := dropper.Schedule(c.Conn, &s.reconnect)
+
+		select {
+		case <-listenDeadline:
+			cancelDrop()
+			err = s.close(ctx, c, closeChan)
+			atomic.AddInt64(&s.cntConnected, -1)
+			return err
+		case <-closeChan:
+			dropped = cancelDrop()
+			atomic.AddInt64(&s.cntConnected, -1)
+			s.reconnect.Disconnected()
+		}
+
+		// Connection dropped before listen duration elapsed. Only the drops
+		// of the fault injection are expected.
+		if !dropped {
+			s.logError(ctx, "Connection closed before listen duration elapsed", readErr)
+		}
+		if !reconnectPolicy.Enabled() {
+			if dropped {
+				return nil
+			}
+			return errors.New("connection closed before listen duration elapsed")
+		}
+		if err = reconnectPolicy.Reconnect(&s.reconnect, connect); err != nil {
+			s.logError(ctx, "Fail to reconnect", err)
+			return err
+		}
+	}
+}
+
+func (s *SignalRCoreBroadcastReceiver) close(ctx *UserContext, c *SignalRCoreConn, closeChan chan struct{}) error {
+	defer c.Close()
+
+	err := c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		s.logError(ctx, "Fail to close websocket gracefully", err)
+		return err
+	}
+
+	// Wait close response
+	select {
+	case <-time.After(1 * time.Minute):
+		log.Println("Warning: Fail to receive close message")
+		atomic.AddInt64(&s.cntCloseError, 1)
+	case <-closeChan:
+		atomic.AddInt64(&s.cntSuccess, 1)
+	}
+
+	return nil
+}
+
+func (s *SignalRCoreBroadcastReceiver) Counters() map[string]int64 {
+	counters := map[string]int64{
+		"signalrcore:broadcast:receiver:inprogress":          atomic.LoadInt64(&s.cntInProgress),
+		"signalrcore:broadcast:receiver:connected":           atomic.LoadInt64(&s.cntConnected),
+		"signalrcore:broadcast:receiver:success":             atomic.LoadInt64(&s.cntSuccess),
+		"signalrcore:broadcast:receiver:error":               atomic.LoadInt64(&s.cntError),
+		"signalrcore:broadcast:receiver:closeerror":          atomic.LoadInt64(&s.cntCloseError),
+		"signalrcore:broadcast:receiver:messages:recv":       atomic.LoadInt64(&s.cntMessagesRecv),
+		"signalrcore:broadcast:receiver:messages:sender":     atomic.LoadInt64(&s.cntMessagesRecvSender),
+		"signalrcore:broadcast:receiver:latency:<100":        atomic.LoadInt64(&s.cntLatencyLessThan100ms),
+		"signalrcore:broadcast:receiver:latency:<500":        atomic.LoadInt64(&s.cntLatencyLessThan500ms),
+		"signalrcore:broadcast:receiver:latency:<1000":       atomic.LoadInt64(&s.cntLatencyLessThan1000ms),
+		"signalrcore:broadcast:receiver:latency:>=1000":      atomic.LoadInt64(&s.cntLatencyMoreThan1000ms),
+		"signalrcore:broadcast:receiver:messages:lost":       s.sequence.Lost(),
+		"signalrcore:broadcast:receiver:messages:duplicated": s.sequence.Duplicated(),
+		"signalrcore:broadcast:receiver:messages:outoforder": s.sequence.OutOfOrder(),
+	}
+	s.reconnect.AddCounters(counters, "signalrcore:broadcast:receiver")
+	s.connect.AddCounters(counters, "signalrcore:broadcast:receiver")
+	s.protocol.AddCounters(counters, "signalrcore:broadcast:receiver")
+	return counters
+}
+
+func (s *SignalRCoreBroadcastReceiver) Metrics() []metrics.Sample {
+	samples := append(s.endpoints.Samples(), s.connect.Samples()...)
+	return append(samples, s.phases.Samples()...)
+}
@@ -4,20 +4,16 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
-	"net/http"
+	"math"
 	"strconv"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"microsoft.com/sigbench/util"
-	"strings"
+	"microsoft.com/sigbench/metrics"
 )
 
-const MaxInstances = 256
-
 type SignalRCoreBroadcastSender struct {
-	userIdx                  int64
 	cntInProgress            int64
 	cntConnected             int64
 	cntError                 int64
@@ -29,7 +25,13 @@ type SignalRCoreBroadcastSender struct {
 	cntLatencyLessThan500ms  int64
 	cntLatencyLessThan1000ms int64
 	cntLatencyMoreThan1000ms int64
-	cntInstances             []int64
+	sendRate                 SendRateCounter
+	sequence                 SequenceCounters
+	reconnect                ReconnectCounters
+	protocol                 SignalRCoreProtocolCounters
+	connect                  ConnectCounters
+	endpoints                EndpointSelector
+	phases                   PhaseMetrics
 }
 
 func (s *SignalRCoreBroadcastSender) Name() string {
@@ -37,7 +39,8 @@ func (s *SignalRCoreBroadcastSender) Name() string {
 }
 
 func (s *SignalRCoreBroadcastSender) Setup(map[string]string) error {
-	s.userIdx = 0
+	s.endpoints.Reset()
+	s.phases.Reset()
 	s.cntInProgress = 0
 	s.cntConnected = 0
 	s.cntError = 0
@@ -49,16 +52,22 @@ func (s *SignalRCoreBroadcastSender) Setup(map[string]string) error {
 	s.cntLatencyLessThan500ms = 0
 	s.cntLatencyLessThan1000ms = 0
 	s.cntLatencyMoreThan1000ms = 0
-	s.cntInstances = make([]int64, MaxInstances, MaxInstances)
+	s.sendRate.Reset()
+	s.sequence.Reset()
+	s.reconnect.Reset()
+	s.protocol.Reset()
+	s.connect.Reset()
 	return nil
 }
 
 func (s *SignalRCoreBroadcastSender) logError(ctx *UserContext, msg string, err error) {
 	log.Printf("[Error][%s] %s due to %s", ctx.UserId, msg, err)
 	atomic.AddInt64(&s.cntError, 1)
+	s.phases.Add(ctx, "errors", 1)
 }
 
-func (s *SignalRCoreBroadcastSender) logLatency(latency int64) {
+func (s *SignalRCoreBroadcastSender) logLatency(phaseLatency *metrics.Histogram, latency int64) {
+	phaseLatency.Observe(latency)
 	// log.Println("Latency: ", latency)
 	if latency < 100 {
 		atomic.AddInt64(&s.cntLatencyLessThan100ms, 1)
@@ -71,23 +80,28 @@ func (s *SignalRCoreBroadcastSender) logLatency(latency int64) {
 	}
 }
 
-func (s *SignalRCoreBroadcastSender) logHostInstance(ctx *UserContext, hostName string) error {
-	hostInstanceId, err := util.GetVMSSInstanceId(hostName)
+func (s *SignalRCoreBroadcastSender) Execute(ctx *UserContext) (err error) {
+	atomic.AddInt64(&s.cntInProgress, 1)
+	defer atomic.AddInt64(&s.cntInProgress, -1)
+
+	// Metrics of the user's phase, looked up once for all messages
+	phaseRecv := s.phases.Counter(ctx, "messages:recv")
+	phaseSend := s.phases.Counter(ctx, "messages:send")
+	phaseLatency := s.phases.Histogram(ctx, "latency")
+
+	lease, err := s.endpoints.Select(ctx, ctx.Params[ParamHost])
 	if err != nil {
-		s.logError(ctx, "Fail to decode host name "+hostName, err)
+		s.logError(ctx, "Invalid endpoint selection", err)
 		return err
 	}
-	atomic.AddInt64(&s.cntInstances[hostInstanceId], 1)
-	return nil
-}
-
-func (s *SignalRCoreBroadcastSender) Execute(ctx *UserContext) error {
-	atomic.AddInt64(&s.cntInProgress, 1)
-	defer atomic.AddInt64(&s.cntInProgress, -1)
+	defer func() { lease.Release(err) }()
+	host := lease.Target
 
-	// Select a host using round-robin
-	hosts := strings.Split(ctx.Params[ParamHost], ",")
-	host := hosts[atomic.AddInt64(&s.userIdx, 1)%int64(len(hosts))]
+	endpoint, err := NewEndpoint(host, ctx.Params, &s.connect)
+	if err != nil {
+		s.logError(ctx, "Invalid endpoint params", err)
+		return err
+	}
 
 	broadcastDurationSecs := 10
 	if secsStr, ok := ctx.Params[ParamBroadcastDurationSecs]; ok {
@@ -96,123 +110,200 @@ func (s *SignalRCoreBroadcastSender) Execute(ctx *UserContext) error {
 		}
 	}
 
-	handshakeReq, err := http.NewRequest(http.MethodOptions, "http://"+host+"/chat", nil)
+	pacer, err := NewPacerFromParams(ctx.Params, 1)
 	if err != nil {
-		s.logError(ctx, "Fail to construct handshake request", err)
-		return err
-	}
-
-	handshakeResp, err := http.DefaultClient.Do(handshakeReq)
-	if err != nil {
-		s.logError(ctx, "Fail to obtain connection id", err)
-		return err
-	}
-	defer handshakeResp.Body.Close()
-
-	// Record host instance
-	if err = s.logHostInstance(ctx, handshakeResp.Header.Get("X-HostName")); err != nil {
+		s.logError(ctx, "Invalid send rate", err)
 		return err
 	}
+	tag := senderTag(ctx.Params)
+	recvTimeout := recvTimeout(ctx.Params)
+	tracker := NewSequenceTracker()
+	tracker.Follow(ctx.UserId, 0)
 
-	decoder := json.NewDecoder(handshakeResp.Body)
-	var handshakeContent SignalRCoreHandshakeResp
-	err = decoder.Decode(&handshakeContent)
+	reconnectPolicy, err := NewReconnectPolicyFromParams(ctx.Params)
 	if err != nil {
-		s.logError(ctx, "Fail to decode connection id", err)
+		s.logError(ctx, "Invalid reconnect policy", err)
 		return err
 	}
-
-	wsUrl := "ws://" + host + "/chat?id=" + handshakeContent.ConnectionId
-	c, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	dropper, err := NewConnectionDropperFromParams(ctx)
 	if err != nil {
-		s.logError(ctx, "Fail to connect to websocket", err)
+		s.logError(ctx, "Invalid drop params", err)
 		return err
 	}
-	defer c.Close()
 
-	closeChan := make(chan struct{})
-	recvChan := make(chan int64, broadcastDurationSecs)
+	var c *SignalRCoreConn
+	var closeChan chan struct{}
+	recvSignal := make(chan struct{}, 1)
+	recvSelf := int64(0)
 
-	go func() {
-		defer c.Close()
-		defer close(closeChan)
-		for {
-			_, msgWithTerm, err := c.ReadMessage()
-			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
-					s.logError(ctx, "Fail to read incoming message", err)
-				}
-				return
-			}
+	connect := func() error {
+		conn, _, err := DialSignalRCore(endpoint, ctx.Params, &s.protocol)
+		if err != nil {
+			return err
+		}
 
-			msg := msgWithTerm[:len(msgWithTerm)-1]
-			var content SignalRCoreInvocation
-			err = json.Unmarshal(msg, &content)
-			if err != nil {
-				s.logError(ctx, "Fail to decode incoming message", err)
-				return
-			}
+		c = conn
+		closeChan = make(chan struct{})
 
-			atomic.AddInt64(&s.cntMessagesRecv, 1)
+		go func(c *SignalRCoreConn, closeChan chan struct{}) {
+			defer c.Close()
+			defer close(closeChan)
+			for {
+				msg, err := c.ReadFrame()
+				if err != nil {
+					if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
+						s.logError(ctx, "Fail to read incoming message", err)
+					}
+					return
+				}
 
-			if content.Type == 1 && content.Target == "broadcastMessage" && content.Arguments[0] == ctx.UserId {
-				sendStart, err := strconv.ParseInt(content.Arguments[1], 10, 64)
+				var content SignalRCoreInvocation
+				err = json.Unmarshal(msg, &content)
 				if err != nil {
-					s.logError(ctx, "Fail to decode start timestamp", err)
-					continue
+					s.logError(ctx, "Fail to decode incoming message", err)
+					return
 				}
 
-				recvChan <- (time.Now().UnixNano() - sendStart) / 1000000
+				atomic.AddInt64(&s.cntMessagesRecv, 1)
+				phaseRecv.Inc()
+
+				if content.Type == 1 && content.Target == "broadcastMessage" && len(content.Arguments) > 1 {
+					payload, err := DecodeBroadcastPayload(content.Arguments[1])
+					if err != nil || payload.Tag != tag {
+						continue
+					}
+
+					result := tracker.Track(content.Arguments[0], payload.Seq)
+					s.sequence.Record(result)
+					if content.Arguments[0] != ctx.UserId || result.Duplicate {
+						continue
+					}
+
+					s.logLatency(phaseLatency, (time.Now().UnixNano()-payload.Timestamp)/1000000)
+					atomic.AddInt64(&recvSelf, 1)
+					select {
+					case recvSignal <- struct{}{}:
+					default:
+					}
+				}
 			}
-		}
-	}()
+		}(c, closeChan)
 
-	err = c.WriteMessage(websocket.TextMessage, []byte("{\"protocol\":\"json\"}\x1e"))
-	if err != nil {
-		s.logError(ctx, "Fail to set protocol", err)
+		return nil
+	}
+
+	if err = connect(); err != nil {
+		s.logError(ctx, "Fail to connect", err)
 		return err
 	}
+	defer func() {
+		c.Close()
+	}()
 
+	connected := true
 	atomic.AddInt64(&s.cntConnected, 1)
-	defer atomic.AddInt64(&s.cntConnected, -1)
-
-	for i := 0; i < broadcastDurationSecs; i++ {
-		// Send message
-		msg, err := SerializeSignalRCoreMessage(&SignalRCoreInvocation{
-			Type:         1,
-			InvocationId: "0",
-			Target:       "send",
-			Arguments: []string{
-				ctx.UserId,
-				strconv.FormatInt(time.Now().UnixNano(), 10),
-			},
-			NonBlocking: false,
-		})
-		if err != nil {
-			s.logError(ctx, "Fail to serialize signalr core message", err)
-			return err
+	cancelDrop := dropper.Schedule(c.Conn, &s.reconnect)
+	defer func() {
+		cancelDrop()
+		if connected {
+			atomic.AddInt64(&s.cntConnected, -1)
 		}
+	}()
 
-		err = c.WriteMessage(websocket.TextMessage, msg)
-		if err != nil {
-			s.logError(ctx, "Fail to send broadcast message", err)
+	reconnect := func() error {
+		cancelDrop()
+		connected = false
+		atomic.AddInt64(&s.cntConnected, -1)
+		s.reconnect.Disconnected()
+
+		if err := reconnectPolicy.Reconnect(&s.reconnect, connect); err != nil {
 			return err
 		}
 
-		atomic.AddInt64(&s.cntMessagesSend, 1)
+		connected = true
+		atomic.AddInt64(&s.cntConnected, 1)
+		cancelDrop = dropper.Schedule(c.Conn, &s.reconnect)
+		return nil
+	}
+
+	s.sendRate.Start(pacer)
+	defer s.sendRate.Stop(pacer)
+
+	sent := int64(0)
+	deadline := time.Now().Add(time.Duration(broadcastDurationSecs) * time.Second)
+	for {
+		n := pacer.WaitUntil(deadline)
+		if !time.Now().Before(deadline) {
+			break
+		}
+
+		// Reconnect as soon as the connection is found dropped
+		select {
+		case <-closeChan:
+			if reconnectPolicy.Enabled() {
+				if err = reconnect(); err != nil {
+					s.logError(ctx, "Fail to reconnect", err)
+					return err
+				}
+			}
+		default:
+		}
 
-		time.Sleep(time.Second)
+		for i := 0; i < n; i++ {
+			payload, err := EncodeBroadcastPayload(&BroadcastPayload{
+				Tag:       tag,
+				Seq:       int64(sent),
+				Timestamp: time.Now().UnixNano(),
+			})
+			if err != nil {
+				s.logError(ctx, "Fail to encode payload", err)
+				return err
+			}
+
+			// Send message
+			msg, err := SerializeSignalRCoreMessage(&SignalRCoreInvocation{
+				Type:         1,
+				InvocationId: "0",
+				Target:       "send",
+				Arguments: []string{
+					ctx.UserId,
+					payload,
+				},
+				NonBlocking: false,
+			})
+			if err != nil {
+				s.logError(ctx, "Fail to serialize signalr core message", err)
+				return err
+			}
+
+			err = c.WriteMessage(websocket.TextMessage, msg)
+			if err != nil {
+				if !reconnectPolicy.Enabled() {
+					s.logError(ctx, "Fail to send broadcast message", err)
+					return err
+				}
+				if err = reconnect(); err != nil {
+					s.logError(ctx, "Fail to reconnect", err)
+					return err
+				}
+				continue
+			}
+
+			sent++
+			atomic.AddInt64(&s.cntMessagesSend, 1)
+			phaseSend.Inc()
+			s.sendRate.Sent(1)
+		}
 	}
 
-	timeoutChan := time.After(time.Minute)
-	for i := 0; i < broadcastDurationSecs; i++ {
+	timeoutChan := time.After(recvTimeout)
+	for atomic.LoadInt64(&recvSelf) < sent {
 		select {
-		case latency := <-recvChan:
-			s.logLatency(latency)
+		case <-recvSignal:
 		case <-timeoutChan:
+			s.sequence.Record(tracker.Finish(ctx.UserId, int64(sent)))
 			s.logError(ctx, "Fail to receive all self broadcast messages within timeout", nil)
 			return errors.New("fail receive all self broadcast messages within timeout")
-			break
 		}
 	}
 
@@ -236,24 +327,32 @@ func (s *SignalRCoreBroadcastSender) Execute(ctx *UserContext) error {
 
 func (s *SignalRCoreBroadcastSender) Counters() map[string]int64 {
 	counters := map[string]int64{
-		"signalrcore:broadcast:inprogress":     atomic.LoadInt64(&s.cntInProgress),
-		"signalrcore:broadcast:connected":      atomic.LoadInt64(&s.cntConnected),
-		"signalrcore:broadcast:success":        atomic.LoadInt64(&s.cntSuccess),
-		"signalrcore:broadcast:error":          atomic.LoadInt64(&s.cntError),
-		"signalrcore:broadcast:closeerror":     atomic.LoadInt64(&s.cntCloseError),
-		"signalrcore:broadcast:messages:recv":  atomic.LoadInt64(&s.cntMessagesRecv),
-		"signalrcore:broadcast:messages:send":  atomic.LoadInt64(&s.cntMessagesSend),
-		"signalrcore:broadcast:latency:<100":   atomic.LoadInt64(&s.cntLatencyLessThan100ms),
-		"signalrcore:broadcast:latency:<500":   atomic.LoadInt64(&s.cntLatencyLessThan500ms),
-		"signalrcore:broadcast:latency:<1000":  atomic.LoadInt64(&s.cntLatencyLessThan1000ms),
-		"signalrcore:broadcast:latency:>=1000": atomic.LoadInt64(&s.cntLatencyMoreThan1000ms),
-	}
-
-	for i := 0; i < MaxInstances; i++ {
-		if val := atomic.LoadInt64(&s.cntInstances[i]); val > 0 {
-			counters["signalrcore:broadcast:instancehit:"+strconv.Itoa(i)] = val
-		}
+		"signalrcore:broadcast:inprogress":            atomic.LoadInt64(&s.cntInProgress),
+		"signalrcore:broadcast:connected":             atomic.LoadInt64(&s.cntConnected),
+		"signalrcore:broadcast:success":               atomic.LoadInt64(&s.cntSuccess),
+		"signalrcore:broadcast:error":                 atomic.LoadInt64(&s.cntError),
+		"signalrcore:broadcast:closeerror":            atomic.LoadInt64(&s.cntCloseError),
+		"signalrcore:broadcast:messages:recv":         atomic.LoadInt64(&s.cntMessagesRecv),
+		"signalrcore:broadcast:messages:send":         atomic.LoadInt64(&s.cntMessagesSend),
+		"signalrcore:broadcast:latency:<100":          atomic.LoadInt64(&s.cntLatencyLessThan100ms),
+		"signalrcore:broadcast:latency:<500":          atomic.LoadInt64(&s.cntLatencyLessThan500ms),
+		"signalrcore:broadcast:latency:<1000":         atomic.LoadInt64(&s.cntLatencyLessThan1000ms),
+		"signalrcore:broadcast:latency:>=1000":        atomic.LoadInt64(&s.cntLatencyMoreThan1000ms),
+		"signalrcore:broadcast:sendrate:target":       int64(math.Round(s.sendRate.Target())),
+		"signalrcore:broadcast:sendrate:target:milli": s.sendRate.TargetMilli(),
+		"signalrcore:broadcast:sendrate:measured":     s.sendRate.Measured(),
+		"signalrcore:broadcast:messages:lost":         s.sequence.Lost(),
+		"signalrcore:broadcast:messages:duplicated":   s.sequence.Duplicated(),
+		"signalrcore:broadcast:messages:outoforder":   s.sequence.OutOfOrder(),
 	}
 
+	s.reconnect.AddCounters(counters, "signalrcore:broadcast")
+	s.connect.AddCounters(counters, "signalrcore:broadcast")
+	s.protocol.AddCounters(counters, "signalrcore:broadcast")
 	return counters
 }
+
+func (s *SignalRCoreBroadcastSender) Metrics() []metrics.Sample {
+	samples := append(s.endpoints.Samples(), s.connect.Samples()...)
+	return append(samples, s.phases.Samples()...)
+}
@@ -0,0 +1,276 @@
+package sessions_test
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"microsoft.com/sigbench/fakeserver"
+	"microsoft.com/sigbench/metrics"
+	"microsoft.com/sigbench/proxy"
+	"microsoft.com/sigbench/sessions"
+)
+
+func startFakeSignalRCore(t *testing.T) (*fakeserver.SignalRCoreServer, string) {
+	server := fakeserver.NewSignalRCoreServer("")
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	return server, strings.TrimPrefix(ts.URL, "http://")
+}
+
+func execute(t *testing.T, session sessions.Session, userId string, params map[string]string) {
+	if err := session.Setup(params); err != nil {
+		t.Fatal(err)
+	}
+	ctx := &sessions.UserContext{
+		UserId:   userId,
+		Phase:    "test",
+		JobStart: time.Now(),
+		Params:   params,
+	}
+	if err := session.Execute(ctx); err != nil {
+		t.Fatal("Expect session to succeed but got", err)
+	}
+}
+
+func TestSignalRCoreEchoEndToEnd(t *testing.T) {
+	_, host := startFakeSignalRCore(t)
+
+	session := &sessions.SignalRCoreEcho{}
+	execute(t, session, "user0", map[string]string{sessions.ParamHost: host})
+
+	counters := session.Counters()
+	if counters["signalrcore:echo:success"] != 1 || counters["signalrcore:echo:error"] != 0 {
+		t.Fatal("Expect one successful echo but got", counters)
+	}
+	phases := metrics.Flatten(session.Metrics())
+	if phases["messages:send{phase=test}"] != 1 || phases["messages:recv{phase=test}"] != 1 || phases["latency{phase=test}:<100"] != 1 {
+		t.Fatal("Expect the echo in the user's phase but got", phases)
+	}
+}
+
+func TestSignalRCoreBroadcastSenderEndToEnd(t *testing.T) {
+	_, host := startFakeSignalRCore(t)
+
+	session := &sessions.SignalRCoreBroadcastSender{}
+	execute(t, session, "user0", map[string]string{
+		sessions.ParamHost:                  host,
+		sessions.ParamBroadcastDurationSecs: "1",
+		sessions.ParamSendRate:              "20",
+	})
+
+	counters := session.Counters()
+	if counters["signalrcore:broadcast:success"] != 1 || counters["signalrcore:broadcast:error"] != 0 {
+		t.Fatal("Expect one successful sender but got", counters)
+	}
+	sent := counters["signalrcore:broadcast:messages:send"]
+	if sent == 0 || counters["signalrcore:broadcast:messages:recv"] < sent {
+		t.Fatal("Expect all sent messages to come back but got", counters)
+	}
+	if counters["signalrcore:broadcast:messages:lost"] != 0 {
+		t.Fatal("Expect no lost messages but got", counters)
+	}
+	if metrics.Flatten(session.Metrics())["backend:connections{instance="+fakeserver.DefaultHostName+"}"] != 1 {
+		t.Fatal("Expect the fake server instance to be hit but got", counters)
+	}
+}
+
+// startClosingForwarder forwards connections to host and closes each of them
+// after the given time, like a crashing server.
+func startClosingForwarder(t *testing.T, host string, after time.Duration) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			target, err := net.Dial("tcp", host)
+			if err != nil {
+				c.Close()
+				continue
+			}
+			go io.Copy(target, c)
+			go io.Copy(c, target)
+			time.AfterFunc(after, func() {
+				c.Close()
+				target.Close()
+			})
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestSignalRCoreBroadcastReceiverConnectionDropped(t *testing.T) {
+	_, host := startFakeSignalRCore(t)
+
+	t.Run("server", func(t *testing.T) {
+		params := map[string]string{
+			sessions.ParamHost:               startClosingForwarder(t, host, 500*time.Millisecond),
+			sessions.ParamListenDurationSecs: "10",
+		}
+		session := &sessions.SignalRCoreBroadcastReceiver{}
+		if err := session.Setup(params); err != nil {
+			t.Fatal(err)
+		}
+		if err := session.Execute(&sessions.UserContext{UserId: "user0", JobStart: time.Now(), Params: params}); err == nil {
+			t.Fatal("Expect error when the connection drops")
+		}
+		if counters := session.Counters(); counters["signalrcore:broadcast:receiver:error"] != 1 {
+			t.Fatal("Expect the drop to be counted as error but got", counters)
+		}
+	})
+
+	t.Run("dropper", func(t *testing.T) {
+		session := &sessions.SignalRCoreBroadcastReceiver{}
+		execute(t, session, "user0", map[string]string{
+			sessions.ParamHost:               host,
+			sessions.ParamListenDurationSecs: "10",
+			sessions.ParamDropFraction:       "1",
+			sessions.ParamDropAfterSecs:      "1",
+		})
+		counters := session.Counters()
+		if counters["signalrcore:broadcast:receiver:error"] != 0 || counters["signalrcore:broadcast:receiver:dropped"] != 1 {
+			t.Fatal("Expect the injected drop without error but got", counters)
+		}
+	})
+}
+
+func TestSignalRCoreEchoThroughProxy(t *testing.T) {
+	_, host := startFakeSignalRCore(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	p := proxy.NewProxy(host, true)
+	p.SetFaults(proxy.Faults{LatencyMs: 60})
+	go p.Serve(l)
+
+	session := &sessions.SignalRCoreEcho{}
+	execute(t, session, "user0", map[string]string{sessions.ParamHost: l.Addr().String()})
+
+	counters := session.Counters()
+	if counters["signalrcore:echo:success"] != 1 {
+		t.Fatal("Expect one successful echo but got", counters)
+	}
+	if counters["signalrcore:echo:connect:negotiate:<500"] != 1 {
+		t.Fatal("Expect the proxy latency in the negotiate stage but got", counters)
+	}
+}
+
+func TestSignalRCoreInvokeEndToEnd(t *testing.T) {
+	_, host := startFakeSignalRCore(t)
+
+	session := &sessions.SignalRCoreInvoke{}
+	execute(t, session, "user0", map[string]string{
+		sessions.ParamHost:               host,
+		sessions.ParamInvokeDurationSecs: "1",
+		sessions.ParamSendRate:           "20",
+	})
+
+	counters := session.Counters()
+	if counters["signalrcore:invoke:success"] != 1 || counters["signalrcore:invoke:error"] != 0 {
+		t.Fatal("Expect one successful user but got", counters)
+	}
+	invoked := counters["signalrcore:invoke:invoked"]
+	if invoked == 0 || counters["signalrcore:invoke:completed"] != invoked || counters["signalrcore:invoke:outstanding"] != 0 {
+		t.Fatal("Expect every invocation to complete but got", counters)
+	}
+	phases := metrics.Flatten(session.Metrics())
+	if phases["messages:send{phase=test}"] != invoked || phases["messages:recv{phase=test}"] != invoked {
+		t.Fatal("Expect the invocations in the user's phase but got", phases)
+	}
+}
+
+func TestSignalRCoreInvokeConnectionDropped(t *testing.T) {
+	_, host := startFakeSignalRCore(t)
+
+	params := map[string]string{
+		sessions.ParamHost:               host,
+		sessions.ParamInvokeMethod:       "disconnect",
+		sessions.ParamInvokeDurationSecs: "1",
+		sessions.ParamRecvTimeoutSecs:    "60",
+	}
+	session := &sessions.SignalRCoreInvoke{}
+	if err := session.Setup(params); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := session.Execute(&sessions.UserContext{UserId: "user0", Params: params}); err == nil {
+		t.Fatal("Expect error when the connection drops")
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 10*time.Second {
+		t.Fatal("Expect not to wait for the receive timeout but took", elapsed)
+	}
+
+	counters := session.Counters()
+	if counters["signalrcore:invoke:error:lost"] != 1 || counters["signalrcore:invoke:outstanding"] != 0 {
+		t.Fatal("Expect the outstanding invocation to be lost but got", counters)
+	}
+}
+
+func TestSignalRCoreStreamEndToEnd(t *testing.T) {
+	_, host := startFakeSignalRCore(t)
+
+	session := &sessions.SignalRCoreStream{}
+	execute(t, session, "user0", map[string]string{
+		sessions.ParamHost:       host,
+		sessions.ParamStreamArgs: "[5, 100]",
+	})
+
+	counters := session.Counters()
+	if counters["signalrcore:stream:success"] != 1 || counters["signalrcore:stream:completed"] != 1 || counters["signalrcore:stream:items:recv"] != 5 {
+		t.Fatal("Expect a completed stream of 5 items but got", counters)
+	}
+	if counters["signalrcore:stream:latency:first:<500"] != 1 || counters["signalrcore:stream:latency:item:<500"] != 4 {
+		t.Fatal("Expect the item delay in the latencies but got", counters)
+	}
+}
+
+func TestSignalRCoreStreamCancel(t *testing.T) {
+	server, host := startFakeSignalRCore(t)
+	server.StreamCompletions = 2
+
+	session := &sessions.SignalRCoreStream{}
+	execute(t, session, "user0", map[string]string{
+		sessions.ParamHost:              host,
+		sessions.ParamStreamArgs:        "[100, 10]",
+		sessions.ParamStreamCancelAfter: "3",
+	})
+
+	counters := session.Counters()
+	if counters["signalrcore:stream:success"] != 1 || counters["signalrcore:stream:cancelled"] != 1 {
+		t.Fatal("Expect a cancelled stream but got", counters)
+	}
+	if items := counters["signalrcore:stream:items:recv"]; items < 3 || items >= 100 {
+		t.Fatal("Expect the stream to stop after the cancel but got", counters)
+	}
+}
+
+func TestSignalRCoreStreamUploadEndToEnd(t *testing.T) {
+	_, host := startFakeSignalRCore(t)
+
+	session := &sessions.SignalRCoreStreamUpload{}
+	execute(t, session, "user0", map[string]string{
+		sessions.ParamHost:            host,
+		sessions.ParamStreamItemCount: "5",
+		sessions.ParamSendRate:        "50",
+	})
+
+	counters := session.Counters()
+	if counters["signalrcore:stream:upload:success"] != 1 || counters["signalrcore:stream:upload:completed"] != 1 {
+		t.Fatal("Expect a completed upload but got", counters)
+	}
+	if counters["signalrcore:stream:upload:items:send"] != 5 || counters["signalrcore:stream:upload:error:result"] != 0 {
+		t.Fatal("Expect 5 items uploaded but got", counters)
+	}
+}
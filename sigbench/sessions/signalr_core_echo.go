@@ -4,17 +4,21 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
-	"net/http"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"microsoft.com/sigbench/metrics"
 )
 
 type SignalRCoreEcho struct {
 	cntInProgress int64
 	cntError      int64
 	cntSuccess    int64
+	protocol      SignalRCoreProtocolCounters
+	connect       ConnectCounters
+	endpoints     EndpointSelector
+	phases        PhaseMetrics
 }
 
 func (s *SignalRCoreEcho) Name() string {
@@ -25,44 +29,43 @@ func (s *SignalRCoreEcho) Setup(map[string]string) error {
 	s.cntInProgress = 0
 	s.cntError = 0
 	s.cntSuccess = 0
+	s.protocol.Reset()
+	s.connect.Reset()
+	s.endpoints.Reset()
+	s.phases.Reset()
 	return nil
 }
 
-func (s *SignalRCoreEcho) logError(msg string, err error) {
+func (s *SignalRCoreEcho) logError(ctx *UserContext, msg string, err error) {
 	log.Println("Error: ", msg, " due to ", err)
 	atomic.AddInt64(&s.cntError, 1)
+	s.phases.Add(ctx, "errors", 1)
 }
 
-func (s *SignalRCoreEcho) Execute(ctx *UserContext) error {
+func (s *SignalRCoreEcho) Execute(ctx *UserContext) (err error) {
 	atomic.AddInt64(&s.cntInProgress, 1)
 	defer atomic.AddInt64(&s.cntInProgress, -1)
 
-	host := ctx.Params[ParamHost]
-	handshakeReq, err := http.NewRequest(http.MethodOptions, "http://"+host+"/chat", nil)
-	if err != nil {
-		s.logError("Fail to construct handshake request", err)
-		return err
-	}
+	// Metrics of the user's phase, looked up once for all messages
+	phaseRecv := s.phases.Counter(ctx, "messages:recv")
+	phaseSend := s.phases.Counter(ctx, "messages:send")
+	phaseLatency := s.phases.Histogram(ctx, "latency")
 
-	handshakeResp, err := http.DefaultClient.Do(handshakeReq)
+	lease, err := s.endpoints.Select(ctx, ctx.Params[ParamHost])
 	if err != nil {
-		s.logError("Fail to obtain connection id", err)
+		s.logError(ctx, "Invalid endpoint selection", err)
 		return err
 	}
-	defer handshakeResp.Body.Close()
+	defer func() { lease.Release(err) }()
 
-	decoder := json.NewDecoder(handshakeResp.Body)
-	var handshakeContent SignalRCoreHandshakeResp
-	err = decoder.Decode(&handshakeContent)
+	endpoint, err := NewEndpoint(lease.Target, ctx.Params, &s.connect)
 	if err != nil {
-		s.logError("Fail to decode connection id", err)
+		s.logError(ctx, "Invalid endpoint params", err)
 		return err
 	}
-
-	wsUrl := "ws://" + host + "/chat?id=" + handshakeContent.ConnectionId
-	c, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	c, _, err := DialSignalRCore(endpoint, ctx.Params, &s.protocol)
 	if err != nil {
-		s.logError("Fail to connect to websocket", err)
+		s.logError(ctx, "Fail to connect", err)
 		return err
 	}
 	defer c.Close()
@@ -73,50 +76,47 @@ func (s *SignalRCoreEcho) Execute(ctx *UserContext) error {
 	go func() {
 		defer close(doneChan)
 		for {
-			_, msgWithTerm, err := c.ReadMessage()
+			msg, err := c.ReadFrame()
 			if err != nil {
 				if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
-					s.logError("Fail to read incoming message", err)
+					s.logError(ctx, "Fail to read incoming message", err)
 				}
 				return
 			}
 
-			msg := msgWithTerm[:len(msgWithTerm)-1]
 			var content SignalRCoreInvocation
 			err = json.Unmarshal(msg, &content)
 			if err != nil {
-				s.logError("Fail to decode incoming message", err)
+				s.logError(ctx, "Fail to decode incoming message", err)
 				return
 			}
 
 			if content.Type == 1 && content.Target == "echo" && content.Arguments[1] == "foobar" {
+				phaseRecv.Inc()
 				close(echoReceivedChan)
 			}
 		}
 	}()
 
-	err = c.WriteMessage(websocket.TextMessage, []byte("{\"protocol\":\"json\"}\x1e"))
-	if err != nil {
-		s.logError("Fail to set protocol", err)
-		return err
-	}
-
+	start := time.Now()
 	err = c.WriteMessage(websocket.TextMessage, []byte("{\"type\":1,\"invocationId\":\"0\",\"target\":\"echo\",\"arguments\":[\"echo-client\",\"foobar\"],\"nonblocking\":false}\x1e"))
 	if err != nil {
-		s.logError("Fail to send echo", err)
+		s.logError(ctx, "Fail to send echo", err)
 		return err
 	}
+	phaseSend.Inc()
 
 	// Wait echo response
 	select {
 	case <-time.After(1 * time.Minute):
-		s.logError("Fail to receive echo within timeout", nil)
+		s.logError(ctx, "Fail to receive echo within timeout", nil)
 		return errors.New("fail to receive echo within timeout")
 	case <-echoReceivedChan:
+		phaseLatency.Observe(time.Since(start).Nanoseconds() / 1000000)
 		// Gracefully close
 		err = c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 		if err != nil {
-			s.logError("Fail to close websocket gracefully", err)
+			s.logError(ctx, "Fail to close websocket gracefully", err)
 			return err
 		}
 	}
@@ -124,7 +124,7 @@ func (s *SignalRCoreEcho) Execute(ctx *UserContext) error {
 	// Wait close response
 	select {
 	case <-time.After(1 * time.Minute):
-		s.logError("Fail to receive close message", nil)
+		s.logError(ctx, "Fail to receive close message", nil)
 		return errors.New("fail to receive close message")
 	case <-doneChan:
 		atomic.AddInt64(&s.cntSuccess, 1)
@@ -133,9 +133,17 @@ func (s *SignalRCoreEcho) Execute(ctx *UserContext) error {
 }
 
 func (s *SignalRCoreEcho) Counters() map[string]int64 {
-	return map[string]int64{
+	counters := map[string]int64{
 		"signalrcore:echo:inprogress": atomic.LoadInt64(&s.cntInProgress),
 		"signalrcore:echo:success":    atomic.LoadInt64(&s.cntSuccess),
 		"signalrcore:echo:error":      atomic.LoadInt64(&s.cntError),
 	}
+	s.protocol.AddCounters(counters, "signalrcore:echo")
+	s.connect.AddCounters(counters, "signalrcore:echo")
+	return counters
+}
+
+func (s *SignalRCoreEcho) Metrics() []metrics.Sample {
+	samples := append(s.endpoints.Samples(), s.connect.Samples()...)
+	return append(samples, s.phases.Samples()...)
 }
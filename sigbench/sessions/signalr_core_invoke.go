@@ -0,0 +1,317 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"microsoft.com/sigbench/metrics"
+)
+
+// SignalRCoreInvoke calls a hub method with unique invocation ids and waits
+// for the matching completion messages to measure round-trip latency.
+type SignalRCoreInvoke struct {
+	cntInProgress  int64
+	cntConnected   int64
+	cntError       int64
+	cntCloseError  int64
+	cntSuccess     int64
+	cntInvoked     int64
+	cntCompleted   int64
+	cntErrorResult int64
+	cntTimeout     int64
+	cntLost        int64
+	cntOutstanding int64
+	latency        *LatencyHistogram
+	sendRate       SendRateCounter
+	protocol       SignalRCoreProtocolCounters
+	connect        ConnectCounters
+	endpoints      EndpointSelector
+	phases         PhaseMetrics
+}
+
+func (s *SignalRCoreInvoke) Name() string {
+	return "SignalRCore:Invoke"
+}
+
+func (s *SignalRCoreInvoke) Setup(map[string]string) error {
+	s.endpoints.Reset()
+	s.phases.Reset()
+	s.cntInProgress = 0
+	s.cntConnected = 0
+	s.cntError = 0
+	s.cntCloseError = 0
+	s.cntSuccess = 0
+	s.cntInvoked = 0
+	s.cntCompleted = 0
+	s.cntErrorResult = 0
+	s.cntTimeout = 0
+	s.cntLost = 0
+	s.cntOutstanding = 0
+	s.latency = NewLatencyHistogram()
+	s.sendRate.Reset()
+	s.protocol.Reset()
+	s.connect.Reset()
+	return nil
+}
+
+func (s *SignalRCoreInvoke) logError(ctx *UserContext, msg string, err error) {
+	log.Printf("[Error][%s] %s due to %s", ctx.UserId, msg, err)
+	atomic.AddInt64(&s.cntError, 1)
+	s.phases.Add(ctx, "errors", 1)
+}
+
+func invokeArgs(params map[string]string) ([]interface{}, error) {
+	argsStr, ok := params[ParamInvokeArgs]
+	if !ok {
+		return []interface{}{"invoke-client", "foobar"}, nil
+	}
+
+	var args []interface{}
+	if err := json.Unmarshal([]byte(argsStr), &args); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+func (s *SignalRCoreInvoke) Execute(ctx *UserContext) (err error) {
+	atomic.AddInt64(&s.cntInProgress, 1)
+	defer atomic.AddInt64(&s.cntInProgress, -1)
+
+	// Metrics of the user's phase, looked up once for all messages
+	phaseRecv := s.phases.Counter(ctx, "messages:recv")
+	phaseSend := s.phases.Counter(ctx, "messages:send")
+	phaseLatency := s.phases.Histogram(ctx, "latency")
+
+	lease, err := s.endpoints.Select(ctx, ctx.Params[ParamHost])
+	if err != nil {
+		s.logError(ctx, "Invalid endpoint selection", err)
+		return err
+	}
+	defer func() { lease.Release(err) }()
+	host := lease.Target
+
+	endpoint, err := NewEndpoint(host, ctx.Params, &s.connect)
+	if err != nil {
+		s.logError(ctx, "Invalid endpoint params", err)
+		return err
+	}
+
+	method := ctx.Params[ParamInvokeMethod]
+	if method == "" {
+		method = "echo"
+	}
+	args, err := invokeArgs(ctx.Params)
+	if err != nil {
+		s.logError(ctx, "Invalid invoke args", err)
+		return err
+	}
+
+	invokeDurationSecs := 10
+	if secsStr, ok := ctx.Params[ParamInvokeDurationSecs]; ok {
+		if secs, err := strconv.Atoi(secsStr); err == nil {
+			invokeDurationSecs = secs
+		}
+	}
+
+	pacer, err := NewPacerFromParams(ctx.Params, 1)
+	if err != nil {
+		s.logError(ctx, "Invalid send rate", err)
+		return err
+	}
+	recvTimeout := recvTimeout(ctx.Params)
+
+	c, _, err := DialSignalRCore(endpoint, ctx.Params, &s.protocol)
+	if err != nil {
+		s.logError(ctx, "Fail to connect", err)
+		return err
+	}
+	defer c.Close()
+
+	// Invocation id -> start time of invocations waiting for completion
+	var outstandingLock sync.Mutex
+	outstanding := make(map[string]time.Time)
+	completedSignal := make(chan struct{}, 1)
+	closeChan := make(chan struct{})
+
+	go func() {
+		defer c.Close()
+		defer close(closeChan)
+		for {
+			msg, err := c.ReadFrame()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
+					s.logError(ctx, "Fail to read incoming message", err)
+				}
+				return
+			}
+
+			var content SignalRCoreCompletion
+			err = json.Unmarshal(msg, &content)
+			if err != nil {
+				s.logError(ctx, "Fail to decode incoming message", err)
+				return
+			}
+
+			if content.Type != SignalRCoreTypeCompletion {
+				continue
+			}
+
+			outstandingLock.Lock()
+			start, ok := outstanding[content.InvocationId]
+			delete(outstanding, content.InvocationId)
+			outstandingLock.Unlock()
+			if !ok {
+				continue
+			}
+
+			atomic.AddInt64(&s.cntOutstanding, -1)
+			atomic.AddInt64(&s.cntCompleted, 1)
+			latency := int64(time.Now().Sub(start) / time.Millisecond)
+			s.latency.Record(latency)
+			phaseLatency.Observe(latency)
+			phaseRecv.Inc()
+			if content.Error != "" {
+				atomic.AddInt64(&s.cntErrorResult, 1)
+			}
+
+			select {
+			case completedSignal <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	atomic.AddInt64(&s.cntConnected, 1)
+	defer atomic.AddInt64(&s.cntConnected, -1)
+
+	s.sendRate.Start(pacer)
+	defer s.sendRate.Stop(pacer)
+
+	invocationId := int64(0)
+	deadline := time.Now().Add(time.Duration(invokeDurationSecs) * time.Second)
+	for {
+		n := pacer.WaitUntil(deadline)
+		if !time.Now().Before(deadline) {
+			break
+		}
+
+		for i := 0; i < n; i++ {
+			invocationId++
+			id := strconv.FormatInt(invocationId, 10)
+			msg, err := SerializeSignalRCoreMessage(&SignalRCoreHubInvocation{
+				InvocationId: id,
+				Type:         SignalRCoreTypeInvocation,
+				Target:       method,
+				Arguments:    args,
+			})
+			if err != nil {
+				s.logError(ctx, "Fail to serialize signalr core message", err)
+				return err
+			}
+
+			outstandingLock.Lock()
+			outstanding[id] = time.Now()
+			outstandingLock.Unlock()
+			atomic.AddInt64(&s.cntOutstanding, 1)
+
+			err = c.WriteMessage(websocket.TextMessage, msg)
+			if err != nil {
+				s.logError(ctx, "Fail to send invocation", err)
+				outstandingLock.Lock()
+				delete(outstanding, id)
+				outstandingLock.Unlock()
+				atomic.AddInt64(&s.cntOutstanding, -1)
+				return err
+			}
+
+			atomic.AddInt64(&s.cntInvoked, 1)
+			phaseSend.Inc()
+			s.sendRate.Sent(1)
+		}
+	}
+
+	// Wait for all completions
+	dropOutstanding := func() int64 {
+		outstandingLock.Lock()
+		remaining := int64(len(outstanding))
+		outstanding = make(map[string]time.Time)
+		outstandingLock.Unlock()
+		atomic.AddInt64(&s.cntOutstanding, -remaining)
+		return remaining
+	}
+	timeoutChan := time.After(recvTimeout)
+	for {
+		outstandingLock.Lock()
+		remaining := len(outstanding)
+		outstandingLock.Unlock()
+		if remaining == 0 {
+			break
+		}
+
+		select {
+		case <-completedSignal:
+		case <-closeChan:
+			atomic.AddInt64(&s.cntLost, dropOutstanding())
+			s.logError(ctx, "Connection closed before all completions", nil)
+			return errors.New("connection closed before all completions")
+		case <-timeoutChan:
+			atomic.AddInt64(&s.cntTimeout, dropOutstanding())
+			s.logError(ctx, "Fail to receive all completions within timeout", nil)
+			return errors.New("fail to receive all completions within timeout")
+		}
+	}
+
+	err = c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		s.logError(ctx, "Fail to close websocket gracefully", err)
+		return err
+	}
+
+	// Wait close response
+	select {
+	case <-time.After(1 * time.Minute):
+		log.Println("Warning: Fail to receive close message")
+		atomic.AddInt64(&s.cntCloseError, 1)
+	case <-closeChan:
+		atomic.AddInt64(&s.cntSuccess, 1)
+	}
+
+	return nil
+}
+
+func (s *SignalRCoreInvoke) Counters() map[string]int64 {
+	counters := map[string]int64{
+		"signalrcore:invoke:inprogress":            atomic.LoadInt64(&s.cntInProgress),
+		"signalrcore:invoke:connected":             atomic.LoadInt64(&s.cntConnected),
+		"signalrcore:invoke:success":               atomic.LoadInt64(&s.cntSuccess),
+		"signalrcore:invoke:error":                 atomic.LoadInt64(&s.cntError),
+		"signalrcore:invoke:closeerror":            atomic.LoadInt64(&s.cntCloseError),
+		"signalrcore:invoke:invoked":               atomic.LoadInt64(&s.cntInvoked),
+		"signalrcore:invoke:completed":             atomic.LoadInt64(&s.cntCompleted),
+		"signalrcore:invoke:outstanding":           atomic.LoadInt64(&s.cntOutstanding),
+		"signalrcore:invoke:error:result":          atomic.LoadInt64(&s.cntErrorResult),
+		"signalrcore:invoke:error:timeout":         atomic.LoadInt64(&s.cntTimeout),
+		"signalrcore:invoke:error:lost":            atomic.LoadInt64(&s.cntLost),
+		"signalrcore:invoke:sendrate:target":       int64(math.Round(s.sendRate.Target())),
+		"signalrcore:invoke:sendrate:target:milli": s.sendRate.TargetMilli(),
+		"signalrcore:invoke:sendrate:measured":     s.sendRate.Measured(),
+	}
+	if s.latency != nil {
+		s.latency.AddCounters(counters, "signalrcore:invoke:latency")
+	}
+	s.protocol.AddCounters(counters, "signalrcore:invoke")
+	s.connect.AddCounters(counters, "signalrcore:invoke")
+	return counters
+}
+
+func (s *SignalRCoreInvoke) Metrics() []metrics.Sample {
+	samples := append(s.endpoints.Samples(), s.connect.Samples()...)
+	return append(samples, s.phases.Samples()...)
+}
@@ -0,0 +1,240 @@
+package sessions
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	SignalRCoreTypePing  = 6
+	SignalRCoreTypeClose = 7
+)
+
+const signalRCoreHandshakeTimeout = 1 * time.Minute
+
+var signalRCorePingFrame = []byte("{\"type\":6}\x1e")
+
+// SignalRCoreCloseError is returned by ReadFrame when the server sent a Close
+// message.
+type SignalRCoreCloseError struct {
+	Message string
+}
+
+func (e *SignalRCoreCloseError) Error() string {
+	if e.Message == "" {
+		return "server closed connection"
+	}
+	return "server closed connection: " + e.Message
+}
+
+type signalRCoreHeader struct {
+	Type  int    `json:"type"`
+	Error string `json:"error"`
+}
+
+// SplitSignalRCoreFrames splits a websocket message into the records it
+// batches. Every record must be followed by the terminator.
+func SplitSignalRCoreFrames(data []byte) ([][]byte, error) {
+	var frames [][]byte
+	for len(data) > 0 {
+		idx := bytes.IndexByte(data, SignalRCoreTerminator)
+		if idx < 0 {
+			return nil, errors.New("unterminated signalr core frame")
+		}
+		frames = append(frames, data[:idx])
+		data = data[idx+1:]
+	}
+	return frames, nil
+}
+
+// ParseSignalRCoreHandshakeResponse validates the reply to the protocol
+// handshake, which is an empty object unless the server rejected it.
+func ParseSignalRCoreHandshakeResponse(frame []byte) error {
+	var resp struct {
+		Type  *int   `json:"type"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(frame, &resp); err != nil {
+		return fmt.Errorf("fail to decode handshake response: %s", err)
+	}
+	if resp.Type != nil {
+		return fmt.Errorf("unexpected message of type %d before handshake response", *resp.Type)
+	}
+	if resp.Error != "" {
+		return errors.New("handshake rejected: " + resp.Error)
+	}
+	return nil
+}
+
+// signalRCorePingInterval returns how often clients send pings, 0 disables
+// them.
+func signalRCorePingInterval(params map[string]string) time.Duration {
+	if secsStr, ok := params[ParamPingIntervalSecs]; ok {
+		if secs, err := strconv.Atoi(secsStr); err == nil {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return 15 * time.Second
+}
+
+// SignalRCoreProtocolCounters aggregates keep-alive and close messages of all
+// users of a session.
+type SignalRCoreProtocolCounters struct {
+	cntPingSent       int64
+	cntPingRecv       int64
+	cntHandshakeError int64
+	cntCloseNormal    int64
+	cntCloseError     int64
+}
+
+func (c *SignalRCoreProtocolCounters) Reset() {
+	atomic.StoreInt64(&c.cntPingSent, 0)
+	atomic.StoreInt64(&c.cntPingRecv, 0)
+	atomic.StoreInt64(&c.cntHandshakeError, 0)
+	atomic.StoreInt64(&c.cntCloseNormal, 0)
+	atomic.StoreInt64(&c.cntCloseError, 0)
+}
+
+// closed counts a close message from the server. The error text comes from
+// the server, so it is logged rather than put into a counter name.
+func (c *SignalRCoreProtocolCounters) closed(reason string) {
+	if reason == "" {
+		atomic.AddInt64(&c.cntCloseNormal, 1)
+		return
+	}
+	log.Println("Warning: server closed connection:", reason)
+	atomic.AddInt64(&c.cntCloseError, 1)
+}
+
+func (c *SignalRCoreProtocolCounters) AddCounters(counters map[string]int64, prefix string) {
+	counters[prefix+":ping:sent"] = atomic.LoadInt64(&c.cntPingSent)
+	counters[prefix+":ping:recv"] = atomic.LoadInt64(&c.cntPingRecv)
+	counters[prefix+":handshake:error"] = atomic.LoadInt64(&c.cntHandshakeError)
+	counters[prefix+":close:normal"] = atomic.LoadInt64(&c.cntCloseNormal)
+	counters[prefix+":close:error"] = atomic.LoadInt64(&c.cntCloseError)
+}
+
+// SignalRCoreConn is a websocket connection speaking the SignalR Core JSON
+// protocol. Writes are serialized so that pings can be sent concurrently with
+// the session's own messages.
+type SignalRCoreConn struct {
+	*websocket.Conn
+	counters *SignalRCoreProtocolCounters
+
+	writeLock sync.Mutex
+	pending   [][]byte
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newSignalRCoreConn(c *websocket.Conn, counters *SignalRCoreProtocolCounters) *SignalRCoreConn {
+	return &SignalRCoreConn{
+		Conn:     c,
+		counters: counters,
+		done:     make(chan struct{}),
+	}
+}
+
+func (c *SignalRCoreConn) WriteMessage(messageType int, data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+func (c *SignalRCoreConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return c.Conn.Close()
+}
+
+// handshake sends the protocol handshake and validates the server's reply.
+// Messages batched behind the reply are kept for ReadFrame.
+func (c *SignalRCoreConn) handshake() error {
+	if err := c.WriteMessage(websocket.TextMessage, []byte("{\"protocol\":\"json\",\"version\":1}\x1e")); err != nil {
+		return fmt.Errorf("fail to set protocol: %s", err)
+	}
+
+	c.Conn.SetReadDeadline(time.Now().Add(signalRCoreHandshakeTimeout))
+	_, data, err := c.Conn.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("fail to read handshake response: %s", err)
+	}
+	c.Conn.SetReadDeadline(time.Time{})
+
+	frames, err := SplitSignalRCoreFrames(data)
+	if err != nil {
+		return err
+	}
+	if len(frames) == 0 {
+		return errors.New("empty handshake response")
+	}
+	if err = ParseSignalRCoreHandshakeResponse(frames[0]); err != nil {
+		atomic.AddInt64(&c.counters.cntHandshakeError, 1)
+		return err
+	}
+
+	c.pending = frames[1:]
+	return nil
+}
+
+// keepAlive sends a ping every interval until the connection is closed.
+func (c *SignalRCoreConn) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.WriteMessage(websocket.TextMessage, signalRCorePingFrame); err != nil {
+				return
+			}
+			atomic.AddInt64(&c.counters.cntPingSent, 1)
+		}
+	}
+}
+
+// ReadFrame returns the next hub message without its terminator. Pings are
+// consumed here and a Close message is returned as *SignalRCoreCloseError.
+func (c *SignalRCoreConn) ReadFrame() ([]byte, error) {
+	for {
+		if len(c.pending) == 0 {
+			_, data, err := c.Conn.ReadMessage()
+			if err != nil {
+				return nil, err
+			}
+			if c.pending, err = SplitSignalRCoreFrames(data); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		frame := c.pending[0]
+		c.pending = c.pending[1:]
+
+		var header signalRCoreHeader
+		if err := json.Unmarshal(frame, &header); err != nil {
+			return nil, fmt.Errorf("fail to decode message type: %s", err)
+		}
+
+		switch header.Type {
+		case SignalRCoreTypePing:
+			atomic.AddInt64(&c.counters.cntPingRecv, 1)
+		case SignalRCoreTypeClose:
+			c.counters.closed(header.Error)
+			return nil, &SignalRCoreCloseError{Message: header.Error}
+		default:
+			return frame, nil
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package sessions
+
+import "testing"
+
+func TestSplitSignalRCoreFrames(t *testing.T) {
+	t.Run("single", func(t *testing.T) {
+		frames, err := SplitSignalRCoreFrames([]byte("{\"type\":6}\x1e"))
+		if err != nil || len(frames) != 1 || string(frames[0]) != "{\"type\":6}" {
+			t.Fatal("Expect one ping frame but got", frames, err)
+		}
+	})
+
+	t.Run("batched", func(t *testing.T) {
+		frames, err := SplitSignalRCoreFrames([]byte("{}\x1e{\"type\":1}\x1e{\"type\":6}\x1e"))
+		if err != nil || len(frames) != 3 {
+			t.Fatal("Expect three frames but got", frames, err)
+		}
+		if string(frames[1]) != "{\"type\":1}" {
+			t.Fatal("Expect invocation as second frame but got", string(frames[1]))
+		}
+	})
+
+	t.Run("unterminated", func(t *testing.T) {
+		if _, err := SplitSignalRCoreFrames([]byte("{\"type\":1}\x1e{\"type\"")); err == nil {
+			t.Fatal("Expect error for unterminated frame")
+		}
+	})
+}
+
+func TestParseSignalRCoreHandshakeResponse(t *testing.T) {
+	if err := ParseSignalRCoreHandshakeResponse([]byte("{}")); err != nil {
+		t.Fatal("Expect empty response to be accepted but got", err)
+	}
+	if err := ParseSignalRCoreHandshakeResponse([]byte("{\"error\":\"unsupported protocol\"}")); err == nil {
+		t.Fatal("Expect rejected handshake to fail")
+	}
+	if err := ParseSignalRCoreHandshakeResponse([]byte("{\"type\":1}")); err == nil {
+		t.Fatal("Expect hub message before handshake response to fail")
+	}
+}
+
+func TestSignalRCoreProtocolCountersClose(t *testing.T) {
+	var c SignalRCoreProtocolCounters
+	c.Reset()
+	c.closed("")
+	c.closed("Connection closed with an error: timeout")
+	c.closed("Server is shutting down")
+
+	counters := make(map[string]int64)
+	c.AddCounters(counters, "test")
+	if counters["test:close:normal"] != 1 || counters["test:close:error"] != 2 || len(counters) != 5 {
+		t.Fatal("Expect close counters without the error text but got", counters)
+	}
+}
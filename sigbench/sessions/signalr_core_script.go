@@ -0,0 +1,452 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"microsoft.com/sigbench/metrics"
+)
+
+// Incoming invocations kept for wait steps, older ones are dropped first.
+const scriptInboxSize = 1024
+
+// LabelTimer labels the timers of a script by step name.
+const LabelTimer = "timer"
+
+// SignalRCoreScript runs the scenario declared in the script or scriptFile
+// session parameter against a SignalR Core hub.
+type SignalRCoreScript struct {
+	cntInProgress   int64
+	cntConnected    int64
+	cntError        int64
+	cntSuccess      int64
+	cntSteps        int64
+	cntInvoked      int64
+	cntCompleted    int64
+	cntErrorResult  int64
+	cntMatched      int64
+	cntWaitTimeout  int64
+	cntMessagesRecv int64
+	steps           []ScriptStep
+	timers          map[string]*metrics.Histogram
+	timerRegistry   metrics.Registry
+	protocol        SignalRCoreProtocolCounters
+	connect         ConnectCounters
+	endpoints       EndpointSelector
+	phases          PhaseMetrics
+}
+
+func (s *SignalRCoreScript) Name() string {
+	return "SignalRCore:Script"
+}
+
+func (s *SignalRCoreScript) Setup(sessionParams map[string]string) error {
+	s.endpoints.Reset()
+	s.phases.Reset()
+	s.cntInProgress = 0
+	s.cntConnected = 0
+	s.cntError = 0
+	s.cntSuccess = 0
+	s.cntSteps = 0
+	s.cntInvoked = 0
+	s.cntCompleted = 0
+	s.cntErrorResult = 0
+	s.cntMatched = 0
+	s.cntWaitTimeout = 0
+	s.cntMessagesRecv = 0
+	s.protocol.Reset()
+	s.connect.Reset()
+
+	steps, err := LoadScript(sessionParams)
+	if err != nil {
+		return err
+	}
+	s.steps = steps
+	s.timerRegistry.Reset()
+	s.timers = make(map[string]*metrics.Histogram)
+	for _, name := range scriptTimers(steps) {
+		s.timers[name] = s.timerRegistry.Histogram("timer", metrics.Labels{LabelTimer: name}, DefaultLatencyBounds...)
+	}
+	return nil
+}
+
+func (s *SignalRCoreScript) logError(ctx *UserContext, msg string, err error) {
+	log.Printf("[Error][%s] %s due to %s", ctx.UserId, msg, err)
+	atomic.AddInt64(&s.cntError, 1)
+	s.phases.Add(ctx, "errors", 1)
+}
+
+func (s *SignalRCoreScript) Execute(ctx *UserContext) (err error) {
+	atomic.AddInt64(&s.cntInProgress, 1)
+	defer atomic.AddInt64(&s.cntInProgress, -1)
+
+	if len(s.steps) == 0 {
+		err := errors.New("no script")
+		s.logError(ctx, "Fail to run script", err)
+		return err
+	}
+
+	lease, err := s.endpoints.Select(ctx, ctx.Params[ParamHost])
+	if err != nil {
+		s.logError(ctx, "Invalid endpoint selection", err)
+		return err
+	}
+	defer func() { lease.Release(err) }()
+	host := lease.Target
+
+	endpoint, err := NewEndpoint(host, ctx.Params, &s.connect)
+	if err != nil {
+		s.logError(ctx, "Invalid endpoint params", err)
+		return err
+	}
+
+	run := &scriptRun{
+		s:           s,
+		ctx:         ctx,
+		endpoint:    endpoint,
+		recvTimeout: recvTimeout(ctx.Params),
+		marks:       make(map[string]time.Time),
+
+		phaseRecv:    s.phases.Counter(ctx, "messages:recv"),
+		phaseSend:    s.phases.Counter(ctx, "messages:send"),
+		phaseLatency: s.phases.Histogram(ctx, "latency"),
+	}
+	defer run.close()
+
+	if err = run.run(s.steps); err != nil {
+		s.logError(ctx, "Fail to run script", err)
+		return err
+	}
+
+	atomic.AddInt64(&s.cntSuccess, 1)
+	return nil
+}
+
+func (s *SignalRCoreScript) Counters() map[string]int64 {
+	counters := map[string]int64{
+		"signalrcore:script:inprogress":    atomic.LoadInt64(&s.cntInProgress),
+		"signalrcore:script:connected":     atomic.LoadInt64(&s.cntConnected),
+		"signalrcore:script:success":       atomic.LoadInt64(&s.cntSuccess),
+		"signalrcore:script:error":         atomic.LoadInt64(&s.cntError),
+		"signalrcore:script:steps":         atomic.LoadInt64(&s.cntSteps),
+		"signalrcore:script:invoked":       atomic.LoadInt64(&s.cntInvoked),
+		"signalrcore:script:completed":     atomic.LoadInt64(&s.cntCompleted),
+		"signalrcore:script:error:result":  atomic.LoadInt64(&s.cntErrorResult),
+		"signalrcore:script:wait:matched":  atomic.LoadInt64(&s.cntMatched),
+		"signalrcore:script:wait:timeout":  atomic.LoadInt64(&s.cntWaitTimeout),
+		"signalrcore:script:messages:recv": atomic.LoadInt64(&s.cntMessagesRecv),
+	}
+	s.protocol.AddCounters(counters, "signalrcore:script")
+	s.connect.AddCounters(counters, "signalrcore:script")
+	return counters
+}
+
+func (s *SignalRCoreScript) Metrics() []metrics.Sample {
+	samples := append(s.endpoints.Samples(), s.connect.Samples()...)
+	samples = append(samples, s.timerRegistry.Samples()...)
+	return append(samples, s.phases.Samples()...)
+}
+
+// scriptRun is the state of one user running the script.
+type scriptRun struct {
+	s           *SignalRCoreScript
+	ctx         *UserContext
+	endpoint    *Endpoint
+	recvTimeout time.Duration
+
+	c         *SignalRCoreConn
+	closeChan chan struct{}
+
+	inboxLock   sync.Mutex
+	inbox       []*SignalRCoreHubInvocation
+	inboxSignal chan struct{}
+
+	pendingLock  sync.Mutex
+	pending      map[string]chan *SignalRCoreCompletion
+	invocationId int64
+
+	// Step name -> moment the step finished
+	marks map[string]time.Time
+
+	// Metrics of the user's phase, looked up once for all messages
+	phaseRecv    *metrics.Counter
+	phaseSend    *metrics.Counter
+	phaseLatency *metrics.Histogram
+}
+
+func (r *scriptRun) run(steps []ScriptStep) error {
+	for _, step := range steps {
+		if err := r.step(&step); err != nil {
+			return fmt.Errorf("%s step: %w", step.Action, err)
+		}
+		atomic.AddInt64(&r.s.cntSteps, 1)
+
+		now := time.Now()
+		if step.Since != "" {
+			r.s.timers[step.Name].Observe(int64(now.Sub(r.marks[step.Since]) / time.Millisecond))
+		}
+		if step.Name != "" {
+			r.marks[step.Name] = now
+		}
+	}
+	return nil
+}
+
+func (r *scriptRun) step(step *ScriptStep) error {
+	switch step.Action {
+	case ScriptActionConnect:
+		return r.connect()
+	case ScriptActionDisconnect:
+		return r.disconnect()
+	case ScriptActionInvoke:
+		return r.invoke(step.Method, expandScriptArguments(step.Arguments, r.ctx.UserId), step.NoWait, r.timeout(step))
+	case ScriptActionJoinGroup:
+		method := step.Method
+		if method == "" {
+			method = "JoinGroup"
+		}
+		group := strings.Replace(step.Group, ScriptUserIdPlaceholder, r.ctx.UserId, -1)
+		return r.invoke(method, []interface{}{group}, step.NoWait, r.timeout(step))
+	case ScriptActionWait:
+		return r.wait(step)
+	case ScriptActionSleep:
+		time.Sleep(time.Duration(step.DurationMs) * time.Millisecond)
+		return nil
+	case ScriptActionLoop:
+		for i := 0; i < step.Count; i++ {
+			if err := r.run(step.Steps); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return errors.New("unknown action")
+	}
+}
+
+func (r *scriptRun) timeout(step *ScriptStep) time.Duration {
+	if step.TimeoutMs > 0 {
+		return time.Duration(step.TimeoutMs) * time.Millisecond
+	}
+	return r.recvTimeout
+}
+
+func (r *scriptRun) connect() error {
+	if r.c != nil {
+		return errors.New("already connected")
+	}
+
+	c, _, err := DialSignalRCore(r.endpoint, r.ctx.Params, &r.s.protocol)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&r.s.cntConnected, 1)
+
+	r.c = c
+	r.closeChan = make(chan struct{})
+	r.inbox = nil
+	r.inboxSignal = make(chan struct{}, 1)
+	r.pending = make(map[string]chan *SignalRCoreCompletion)
+
+	go r.read(c, r.closeChan)
+	return nil
+}
+
+func (r *scriptRun) read(c *SignalRCoreConn, closeChan chan struct{}) {
+	defer c.Close()
+	defer close(closeChan)
+	for {
+		msg, err := c.ReadFrame()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
+				r.s.logError(r.ctx, "Fail to read incoming message", err)
+			}
+			return
+		}
+
+		var content SignalRCoreCompletion
+		if err = json.Unmarshal(msg, &content); err != nil {
+			r.s.logError(r.ctx, "Fail to decode incoming message", err)
+			return
+		}
+
+		switch content.Type {
+		case SignalRCoreTypeInvocation:
+			var invocation SignalRCoreHubInvocation
+			if err = json.Unmarshal(msg, &invocation); err != nil {
+				r.s.logError(r.ctx, "Fail to decode incoming invocation", err)
+				return
+			}
+			atomic.AddInt64(&r.s.cntMessagesRecv, 1)
+			r.phaseRecv.Inc()
+
+			r.inboxLock.Lock()
+			if len(r.inbox) >= scriptInboxSize {
+				r.inbox = r.inbox[1:]
+			}
+			r.inbox = append(r.inbox, &invocation)
+			r.inboxLock.Unlock()
+
+			select {
+			case r.inboxSignal <- struct{}{}:
+			default:
+			}
+		case SignalRCoreTypeCompletion:
+			r.pendingLock.Lock()
+			completionChan, ok := r.pending[content.InvocationId]
+			delete(r.pending, content.InvocationId)
+			r.pendingLock.Unlock()
+			if ok {
+				completionChan <- &content
+			}
+		}
+	}
+}
+
+func (r *scriptRun) invoke(method string, args []interface{}, noWait bool, timeout time.Duration) error {
+	if r.c == nil {
+		return errors.New("not connected")
+	}
+
+	invocation := &SignalRCoreHubInvocation{
+		Type:      SignalRCoreTypeInvocation,
+		Target:    method,
+		Arguments: args,
+	}
+	var completionChan chan *SignalRCoreCompletion
+	if !noWait {
+		r.invocationId++
+		invocation.InvocationId = strconv.FormatInt(r.invocationId, 10)
+		completionChan = make(chan *SignalRCoreCompletion, 1)
+		r.pendingLock.Lock()
+		r.pending[invocation.InvocationId] = completionChan
+		r.pendingLock.Unlock()
+	}
+	forget := func() {
+		r.pendingLock.Lock()
+		delete(r.pending, invocation.InvocationId)
+		r.pendingLock.Unlock()
+	}
+
+	msg, err := SerializeSignalRCoreMessage(invocation)
+	if err != nil {
+		forget()
+		return err
+	}
+	start := time.Now()
+	if err = r.c.WriteMessage(websocket.TextMessage, msg); err != nil {
+		forget()
+		return err
+	}
+	atomic.AddInt64(&r.s.cntInvoked, 1)
+	r.phaseSend.Inc()
+
+	if noWait {
+		return nil
+	}
+
+	select {
+	case completion := <-completionChan:
+		atomic.AddInt64(&r.s.cntCompleted, 1)
+		r.phaseLatency.Observe(int64(time.Now().Sub(start) / time.Millisecond))
+		if completion.Error != "" {
+			atomic.AddInt64(&r.s.cntErrorResult, 1)
+			return errors.New("invocation failed: " + completion.Error)
+		}
+		return nil
+	case <-r.closeChan:
+		forget()
+		return errors.New("connection closed before invocation completed")
+	case <-time.After(timeout):
+		forget()
+		return errors.New("no completion within timeout")
+	}
+}
+
+// wait consumes incoming invocations until one matches the step's patterns.
+func (r *scriptRun) wait(step *ScriptStep) error {
+	if r.c == nil {
+		return errors.New("not connected")
+	}
+
+	target, err := compileScriptPattern(step.Target, r.ctx.UserId)
+	if err != nil {
+		return err
+	}
+	argument, err := compileScriptPattern(step.Argument, r.ctx.UserId)
+	if err != nil {
+		return err
+	}
+
+	timeoutChan := time.After(r.timeout(step))
+	for {
+		r.inboxLock.Lock()
+		matched := false
+		consumed := len(r.inbox)
+		for i, msg := range r.inbox {
+			if matchScriptInvocation(msg, target, argument) {
+				matched = true
+				consumed = i + 1
+				break
+			}
+		}
+		r.inbox = r.inbox[consumed:]
+		r.inboxLock.Unlock()
+
+		if matched {
+			atomic.AddInt64(&r.s.cntMatched, 1)
+			return nil
+		}
+
+		select {
+		case <-r.inboxSignal:
+		case <-r.closeChan:
+			return errors.New("connection closed before matching message arrived")
+		case <-timeoutChan:
+			atomic.AddInt64(&r.s.cntWaitTimeout, 1)
+			return errors.New("no matching message within timeout")
+		}
+	}
+}
+
+func (r *scriptRun) disconnect() error {
+	if r.c == nil {
+		return errors.New("not connected")
+	}
+
+	c, closeChan := r.c, r.closeChan
+	r.c = nil
+	defer atomic.AddInt64(&r.s.cntConnected, -1)
+
+	err := c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		c.Close()
+		return err
+	}
+
+	// Wait close response
+	select {
+	case <-time.After(1 * time.Minute):
+		c.Close()
+		return errors.New("fail to receive close message")
+	case <-closeChan:
+		return nil
+	}
+}
+
+// close drops a connection the script left open.
+func (r *scriptRun) close() {
+	if r.c != nil {
+		r.c.Close()
+		r.c = nil
+		atomic.AddInt64(&r.s.cntConnected, -1)
+	}
+}
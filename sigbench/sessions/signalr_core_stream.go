@@ -0,0 +1,281 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"microsoft.com/sigbench/metrics"
+)
+
+// SignalRCoreStream starts a server-to-client stream and measures how fast
+// its items arrive, optionally cancelling it half way.
+type SignalRCoreStream struct {
+	cntInProgress    int64
+	cntConnected     int64
+	cntError         int64
+	cntCloseError    int64
+	cntSuccess       int64
+	cntStreamStarted int64
+	cntStreamDone    int64
+	cntStreamCancel  int64
+	cntErrorResult   int64
+	cntItemsRecv     int64
+	itemRate         RateMeter
+	firstItemLatency *LatencyHistogram
+	itemLatency      *LatencyHistogram
+	protocol         SignalRCoreProtocolCounters
+	connect          ConnectCounters
+	endpoints        EndpointSelector
+	phases           PhaseMetrics
+}
+
+func (s *SignalRCoreStream) Name() string {
+	return "SignalRCore:Stream"
+}
+
+func (s *SignalRCoreStream) Setup(map[string]string) error {
+	s.endpoints.Reset()
+	s.phases.Reset()
+	s.cntInProgress = 0
+	s.cntConnected = 0
+	s.cntError = 0
+	s.cntCloseError = 0
+	s.cntSuccess = 0
+	s.cntStreamStarted = 0
+	s.cntStreamDone = 0
+	s.cntStreamCancel = 0
+	s.cntErrorResult = 0
+	s.cntItemsRecv = 0
+	s.itemRate.Reset()
+	s.firstItemLatency = NewLatencyHistogram()
+	s.itemLatency = NewLatencyHistogram(10, 100, 500, 1000)
+	s.protocol.Reset()
+	s.connect.Reset()
+	return nil
+}
+
+func (s *SignalRCoreStream) logError(ctx *UserContext, msg string, err error) {
+	log.Printf("[Error][%s] %s due to %s", ctx.UserId, msg, err)
+	atomic.AddInt64(&s.cntError, 1)
+	s.phases.Add(ctx, "errors", 1)
+}
+
+// streamItemCount returns the number of stream items requested by users.
+func streamItemCount(params map[string]string) int {
+	if cntStr, ok := params[ParamStreamItemCount]; ok {
+		if cnt, err := strconv.Atoi(cntStr); err == nil {
+			return cnt
+		}
+	}
+	return 10
+}
+
+func (s *SignalRCoreStream) Execute(ctx *UserContext) (err error) {
+	atomic.AddInt64(&s.cntInProgress, 1)
+	defer atomic.AddInt64(&s.cntInProgress, -1)
+
+	// Metrics of the user's phase, looked up once for all messages
+	phaseRecv := s.phases.Counter(ctx, "messages:recv")
+	phaseLatency := s.phases.Histogram(ctx, "latency")
+
+	lease, err := s.endpoints.Select(ctx, ctx.Params[ParamHost])
+	if err != nil {
+		s.logError(ctx, "Invalid endpoint selection", err)
+		return err
+	}
+	defer func() { lease.Release(err) }()
+	host := lease.Target
+
+	endpoint, err := NewEndpoint(host, ctx.Params, &s.connect)
+	if err != nil {
+		s.logError(ctx, "Invalid endpoint params", err)
+		return err
+	}
+
+	method := ctx.Params[ParamStreamMethod]
+	if method == "" {
+		method = "Counter"
+	}
+	itemCount := streamItemCount(ctx.Params)
+	args := []interface{}{itemCount, 0}
+	if argsStr, ok := ctx.Params[ParamStreamArgs]; ok {
+		if err := json.Unmarshal([]byte(argsStr), &args); err != nil {
+			s.logError(ctx, "Invalid stream args", err)
+			return err
+		}
+	}
+	cancelAfter := 0
+	if cntStr, ok := ctx.Params[ParamStreamCancelAfter]; ok {
+		if cnt, err := strconv.Atoi(cntStr); err == nil {
+			cancelAfter = cnt
+		}
+	}
+	recvTimeout := recvTimeout(ctx.Params)
+
+	c, _, err := DialSignalRCore(endpoint, ctx.Params, &s.protocol)
+	if err != nil {
+		s.logError(ctx, "Fail to connect", err)
+		return err
+	}
+	defer c.Close()
+
+	const streamId = "1"
+	startChan := make(chan time.Time, 1)
+	doneChan := make(chan struct{})
+	var doneOnce sync.Once
+	closeChan := make(chan struct{})
+
+	go func() {
+		defer c.Close()
+		defer close(closeChan)
+
+		items := 0
+		var last time.Time
+		for {
+			msg, err := c.ReadFrame()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
+					s.logError(ctx, "Fail to read incoming message", err)
+				}
+				return
+			}
+
+			var content SignalRCoreCompletion
+			err = json.Unmarshal(msg, &content)
+			if err != nil {
+				s.logError(ctx, "Fail to decode incoming message", err)
+				return
+			}
+
+			if content.InvocationId != streamId {
+				continue
+			}
+
+			switch content.Type {
+			case SignalRCoreTypeStreamItem:
+				now := time.Now()
+				if items == 0 {
+					// Measure from the moment the stream invocation was sent
+					last = <-startChan
+					latency := int64(now.Sub(last) / time.Millisecond)
+					s.firstItemLatency.Record(latency)
+					phaseLatency.Observe(latency)
+				} else {
+					s.itemLatency.Record(int64(now.Sub(last) / time.Millisecond))
+				}
+				last = now
+				items++
+				atomic.AddInt64(&s.cntItemsRecv, 1)
+				phaseRecv.Inc()
+				s.itemRate.Add(1)
+
+				if items == cancelAfter {
+					cancel, err := SerializeSignalRCoreMessage(&SignalRCoreCancelInvocation{
+						Type:         SignalRCoreTypeCancelInvocation,
+						InvocationId: streamId,
+					})
+					if err == nil {
+						err = c.WriteMessage(websocket.TextMessage, cancel)
+					}
+					if err != nil {
+						s.logError(ctx, "Fail to cancel stream", err)
+						return
+					}
+					atomic.AddInt64(&s.cntStreamCancel, 1)
+				}
+			case SignalRCoreTypeCompletion:
+				if content.Error != "" {
+					atomic.AddInt64(&s.cntErrorResult, 1)
+				}
+				doneOnce.Do(func() { close(doneChan) })
+			}
+		}
+	}()
+
+	atomic.AddInt64(&s.cntConnected, 1)
+	defer atomic.AddInt64(&s.cntConnected, -1)
+
+	msg, err := SerializeSignalRCoreMessage(&SignalRCoreHubInvocation{
+		InvocationId: streamId,
+		Type:         SignalRCoreTypeStreamInvocation,
+		Target:       method,
+		Arguments:    args,
+	})
+	if err != nil {
+		s.logError(ctx, "Fail to serialize signalr core message", err)
+		return err
+	}
+
+	err = c.WriteMessage(websocket.TextMessage, msg)
+	if err != nil {
+		s.logError(ctx, "Fail to start stream", err)
+		return err
+	}
+	startChan <- time.Now()
+	atomic.AddInt64(&s.cntStreamStarted, 1)
+
+	// Wait stream completion
+	select {
+	case <-doneChan:
+		atomic.AddInt64(&s.cntStreamDone, 1)
+	case <-closeChan:
+		err = errors.New("connection closed before stream completed")
+		s.logError(ctx, "Fail to receive stream completion", err)
+		return err
+	case <-time.After(recvTimeout):
+		err = errors.New("no stream completion within timeout")
+		s.logError(ctx, "Fail to receive stream completion", err)
+		return err
+	}
+
+	err = c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		s.logError(ctx, "Fail to close websocket gracefully", err)
+		return err
+	}
+
+	// Wait close response
+	select {
+	case <-time.After(1 * time.Minute):
+		log.Println("Warning: Fail to receive close message")
+		atomic.AddInt64(&s.cntCloseError, 1)
+	case <-closeChan:
+		atomic.AddInt64(&s.cntSuccess, 1)
+	}
+
+	return nil
+}
+
+func (s *SignalRCoreStream) Counters() map[string]int64 {
+	counters := map[string]int64{
+		"signalrcore:stream:inprogress":   atomic.LoadInt64(&s.cntInProgress),
+		"signalrcore:stream:connected":    atomic.LoadInt64(&s.cntConnected),
+		"signalrcore:stream:success":      atomic.LoadInt64(&s.cntSuccess),
+		"signalrcore:stream:error":        atomic.LoadInt64(&s.cntError),
+		"signalrcore:stream:closeerror":   atomic.LoadInt64(&s.cntCloseError),
+		"signalrcore:stream:started":      atomic.LoadInt64(&s.cntStreamStarted),
+		"signalrcore:stream:completed":    atomic.LoadInt64(&s.cntStreamDone),
+		"signalrcore:stream:cancelled":    atomic.LoadInt64(&s.cntStreamCancel),
+		"signalrcore:stream:error:result": atomic.LoadInt64(&s.cntErrorResult),
+		"signalrcore:stream:items:recv":   atomic.LoadInt64(&s.cntItemsRecv),
+		"signalrcore:stream:items:rate":   s.itemRate.Rate(),
+	}
+	if s.firstItemLatency != nil {
+		s.firstItemLatency.AddCounters(counters, "signalrcore:stream:latency:first")
+		s.itemLatency.AddCounters(counters, "signalrcore:stream:latency:item")
+	}
+	s.protocol.AddCounters(counters, "signalrcore:stream")
+	s.connect.AddCounters(counters, "signalrcore:stream")
+	return counters
+}
+
+func (s *SignalRCoreStream) Metrics() []metrics.Sample {
+	samples := append(s.endpoints.Samples(), s.connect.Samples()...)
+	return append(samples, s.phases.Samples()...)
+}
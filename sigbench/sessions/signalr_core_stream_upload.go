@@ -0,0 +1,270 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"microsoft.com/sigbench/metrics"
+)
+
+// SignalRCoreStreamUpload invokes a hub method with a client-to-server stream
+// argument and sends stream items at the configured rate.
+type SignalRCoreStreamUpload struct {
+	cntInProgress    int64
+	cntConnected     int64
+	cntError         int64
+	cntCloseError    int64
+	cntSuccess       int64
+	cntStreamStarted int64
+	cntStreamDone    int64
+	cntErrorResult   int64
+	cntItemsSend     int64
+	sendRate         SendRateCounter
+	latency          *LatencyHistogram
+	protocol         SignalRCoreProtocolCounters
+	connect          ConnectCounters
+	endpoints        EndpointSelector
+	phases           PhaseMetrics
+}
+
+func (s *SignalRCoreStreamUpload) Name() string {
+	return "SignalRCore:Stream:Upload"
+}
+
+func (s *SignalRCoreStreamUpload) Setup(map[string]string) error {
+	s.endpoints.Reset()
+	s.phases.Reset()
+	s.cntInProgress = 0
+	s.cntConnected = 0
+	s.cntError = 0
+	s.cntCloseError = 0
+	s.cntSuccess = 0
+	s.cntStreamStarted = 0
+	s.cntStreamDone = 0
+	s.cntErrorResult = 0
+	s.cntItemsSend = 0
+	s.sendRate.Reset()
+	s.latency = NewLatencyHistogram()
+	s.protocol.Reset()
+	s.connect.Reset()
+	return nil
+}
+
+func (s *SignalRCoreStreamUpload) logError(ctx *UserContext, msg string, err error) {
+	log.Printf("[Error][%s] %s due to %s", ctx.UserId, msg, err)
+	atomic.AddInt64(&s.cntError, 1)
+	s.phases.Add(ctx, "errors", 1)
+}
+
+func (s *SignalRCoreStreamUpload) Execute(ctx *UserContext) (err error) {
+	atomic.AddInt64(&s.cntInProgress, 1)
+	defer atomic.AddInt64(&s.cntInProgress, -1)
+
+	// Metrics of the user's phase, looked up once for all messages
+	phaseSend := s.phases.Counter(ctx, "messages:send")
+	phaseLatency := s.phases.Histogram(ctx, "latency")
+
+	lease, err := s.endpoints.Select(ctx, ctx.Params[ParamHost])
+	if err != nil {
+		s.logError(ctx, "Invalid endpoint selection", err)
+		return err
+	}
+	defer func() { lease.Release(err) }()
+	host := lease.Target
+
+	endpoint, err := NewEndpoint(host, ctx.Params, &s.connect)
+	if err != nil {
+		s.logError(ctx, "Invalid endpoint params", err)
+		return err
+	}
+
+	method := ctx.Params[ParamUploadMethod]
+	if method == "" {
+		method = "UploadStream"
+	}
+	itemCount := streamItemCount(ctx.Params)
+	pacer, err := NewPacerFromParams(ctx.Params, 1)
+	if err != nil {
+		s.logError(ctx, "Invalid send rate", err)
+		return err
+	}
+	recvTimeout := recvTimeout(ctx.Params)
+
+	c, _, err := DialSignalRCore(endpoint, ctx.Params, &s.protocol)
+	if err != nil {
+		s.logError(ctx, "Fail to connect", err)
+		return err
+	}
+	defer c.Close()
+
+	const invocationId = "1"
+	const streamId = "0"
+	completionChan := make(chan time.Time, 1)
+	closeChan := make(chan struct{})
+
+	go func() {
+		defer c.Close()
+		defer close(closeChan)
+		for {
+			msg, err := c.ReadFrame()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
+					s.logError(ctx, "Fail to read incoming message", err)
+				}
+				return
+			}
+
+			var content SignalRCoreCompletion
+			err = json.Unmarshal(msg, &content)
+			if err != nil {
+				s.logError(ctx, "Fail to decode incoming message", err)
+				return
+			}
+
+			if content.Type == SignalRCoreTypeCompletion && content.InvocationId == invocationId {
+				if content.Error != "" {
+					atomic.AddInt64(&s.cntErrorResult, 1)
+				}
+				select {
+				case completionChan <- time.Now():
+				default:
+				}
+			}
+		}
+	}()
+
+	atomic.AddInt64(&s.cntConnected, 1)
+	defer atomic.AddInt64(&s.cntConnected, -1)
+
+	msg, err := SerializeSignalRCoreMessage(&SignalRCoreHubInvocation{
+		InvocationId: invocationId,
+		Type:         SignalRCoreTypeInvocation,
+		Target:       method,
+		Arguments:    []interface{}{},
+		StreamIds:    []string{streamId},
+	})
+	if err != nil {
+		s.logError(ctx, "Fail to serialize signalr core message", err)
+		return err
+	}
+
+	err = c.WriteMessage(websocket.TextMessage, msg)
+	if err != nil {
+		s.logError(ctx, "Fail to start upload stream", err)
+		return err
+	}
+	atomic.AddInt64(&s.cntStreamStarted, 1)
+
+	s.sendRate.Start(pacer)
+	defer s.sendRate.Stop(pacer)
+
+	sent := 0
+	for sent < itemCount {
+		n := pacer.Wait()
+		for i := 0; i < n && sent < itemCount; i++ {
+			item, err := SerializeSignalRCoreMessage(&SignalRCoreStreamItem{
+				Type:         SignalRCoreTypeStreamItem,
+				InvocationId: streamId,
+				Item:         ctx.UserId + ":" + time.Now().Format(time.RFC3339Nano),
+			})
+			if err != nil {
+				s.logError(ctx, "Fail to serialize stream item", err)
+				return err
+			}
+
+			err = c.WriteMessage(websocket.TextMessage, item)
+			if err != nil {
+				s.logError(ctx, "Fail to send stream item", err)
+				return err
+			}
+
+			sent++
+			atomic.AddInt64(&s.cntItemsSend, 1)
+			phaseSend.Inc()
+			s.sendRate.Sent(1)
+		}
+	}
+
+	// Complete the client stream and measure until the server completes the
+	// invocation
+	end, err := SerializeSignalRCoreMessage(&SignalRCoreCompletion{
+		Type:         SignalRCoreTypeCompletion,
+		InvocationId: streamId,
+	})
+	if err != nil {
+		s.logError(ctx, "Fail to serialize stream completion", err)
+		return err
+	}
+	endStart := time.Now()
+	err = c.WriteMessage(websocket.TextMessage, end)
+	if err != nil {
+		s.logError(ctx, "Fail to complete upload stream", err)
+		return err
+	}
+
+	select {
+	case completed := <-completionChan:
+		latency := int64(completed.Sub(endStart) / time.Millisecond)
+		s.latency.Record(latency)
+		phaseLatency.Observe(latency)
+		atomic.AddInt64(&s.cntStreamDone, 1)
+	case <-closeChan:
+		err = errors.New("connection closed before invocation completed")
+		s.logError(ctx, "Fail to receive upload completion", err)
+		return err
+	case <-time.After(recvTimeout):
+		err = errors.New("no completion within timeout")
+		s.logError(ctx, "Fail to receive upload completion", err)
+		return err
+	}
+
+	err = c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		s.logError(ctx, "Fail to close websocket gracefully", err)
+		return err
+	}
+
+	// Wait close response
+	select {
+	case <-time.After(1 * time.Minute):
+		log.Println("Warning: Fail to receive close message")
+		atomic.AddInt64(&s.cntCloseError, 1)
+	case <-closeChan:
+		atomic.AddInt64(&s.cntSuccess, 1)
+	}
+
+	return nil
+}
+
+func (s *SignalRCoreStreamUpload) Counters() map[string]int64 {
+	counters := map[string]int64{
+		"signalrcore:stream:upload:inprogress":            atomic.LoadInt64(&s.cntInProgress),
+		"signalrcore:stream:upload:connected":             atomic.LoadInt64(&s.cntConnected),
+		"signalrcore:stream:upload:success":               atomic.LoadInt64(&s.cntSuccess),
+		"signalrcore:stream:upload:error":                 atomic.LoadInt64(&s.cntError),
+		"signalrcore:stream:upload:closeerror":            atomic.LoadInt64(&s.cntCloseError),
+		"signalrcore:stream:upload:started":               atomic.LoadInt64(&s.cntStreamStarted),
+		"signalrcore:stream:upload:completed":             atomic.LoadInt64(&s.cntStreamDone),
+		"signalrcore:stream:upload:error:result":          atomic.LoadInt64(&s.cntErrorResult),
+		"signalrcore:stream:upload:items:send":            atomic.LoadInt64(&s.cntItemsSend),
+		"signalrcore:stream:upload:sendrate:target":       int64(math.Round(s.sendRate.Target())),
+		"signalrcore:stream:upload:sendrate:target:milli": s.sendRate.TargetMilli(),
+		"signalrcore:stream:upload:sendrate:measured":     s.sendRate.Measured(),
+	}
+	if s.latency != nil {
+		s.latency.AddCounters(counters, "signalrcore:stream:upload:latency")
+	}
+	s.protocol.AddCounters(counters, "signalrcore:stream:upload")
+	s.connect.AddCounters(counters, "signalrcore:stream:upload")
+	return counters
+}
+
+func (s *SignalRCoreStreamUpload) Metrics() []metrics.Sample {
+	samples := append(s.endpoints.Samples(), s.connect.Samples()...)
+	return append(samples, s.phases.Samples()...)
+}
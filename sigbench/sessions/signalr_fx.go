@@ -1,5 +1,15 @@
 package sessions
 
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
 type SignalRFxHandshakeResp struct {
 	Url                        string  `json:"Url"`
 	ConnectionToken            string  `json:"ConnectionToken"`
@@ -36,3 +46,64 @@ type SignalRFxClientMessage struct {
 	Arguments []string `json:"A"`
 	Id        int      `json:"I"`
 }
+
+const signalRFxConnectionData = "%5B%7B%22name%22%3A%22chat%22%7D%5D"
+
+// DialSignalRFx obtains a connection token from endpoint and opens the websocket
+// transport. Callers must wait for the init message before calling
+// StartSignalRFx.
+func DialSignalRFx(endpoint *Endpoint) (*websocket.Conn, string, error) {
+	start := time.Now()
+	handshakeReq, err := http.NewRequest(http.MethodGet, endpoint.HttpUrl("/signalr/negotiate?clientProtocol=1.4&connectionData="+signalRFxConnectionData), nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("fail to construct handshake request: %s", err)
+	}
+
+	handshakeResp, err := endpoint.Do(handshakeReq)
+	if err != nil {
+		return nil, "", fmt.Errorf("fail to obtain connection token: %s", err)
+	}
+	defer handshakeResp.Body.Close()
+
+	decoder := json.NewDecoder(handshakeResp.Body)
+	var handshakeContent SignalRFxHandshakeResp
+	if err = decoder.Decode(&handshakeContent); err != nil {
+		return nil, "", fmt.Errorf("fail to decode connection token: %s", err)
+	}
+	endpoint.Record(ConnectStageNegotiate, time.Now().Sub(start))
+	endpoint.RecordBackend(handshakeResp)
+
+	token := handshakeContent.ConnectionToken
+	c, _, err := endpoint.DialWebsocket("/signalr/connect?transport=webSockets&clientProtocol=1.4&connectionToken=" + url.QueryEscape(token) + "&connectionData=" + signalRFxConnectionData + "&tid=0")
+	if err != nil {
+		return nil, "", fmt.Errorf("fail to connect to websocket: %s", err)
+	}
+
+	return c, token, nil
+}
+
+// StartSignalRFx tells the server that the client is ready to receive.
+func StartSignalRFx(endpoint *Endpoint, token string) error {
+	startReq, err := http.NewRequest(http.MethodGet, endpoint.HttpUrl("/signalr/start?transport=webSockets&clientProtocol=1.4&connectionToken="+url.QueryEscape(token)+"&connectionData="+signalRFxConnectionData+"&tid=0"), nil)
+	if err != nil {
+		return fmt.Errorf("fail to construct start request: %s", err)
+	}
+
+	startResp, err := endpoint.Do(startReq)
+	if err != nil {
+		return fmt.Errorf("fail to start: %s", err)
+	}
+	defer startResp.Body.Close()
+
+	decoder := json.NewDecoder(startResp.Body)
+	var startContent SignalRFxStartResp
+	if err = decoder.Decode(&startContent); err != nil {
+		return fmt.Errorf("fail to decode start response: %s", err)
+	}
+
+	if startContent.Response != "started" {
+		return fmt.Errorf("start response not expected: %s", startContent.Response)
+	}
+
+	return nil
+}
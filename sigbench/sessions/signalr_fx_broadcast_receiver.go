@@ -0,0 +1,287 @@
+package sessions
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"microsoft.com/sigbench/metrics"
+)
+
+type SignalRFxBroadcastReceiver struct {
+	cntInProgress            int64
+	cntConnected             int64
+	cntError                 int64
+	cntCloseError            int64
+	cntSuccess               int64
+	cntMessagesRecv          int64
+	cntMessagesRecvSender    int64
+	cntLatencyLessThan100ms  int64
+	cntLatencyLessThan500ms  int64
+	cntLatencyLessThan1000ms int64
+	cntLatencyMoreThan1000ms int64
+	sequence                 SequenceCounters
+	reconnect                ReconnectCounters
+	connect                  ConnectCounters
+	endpoints                EndpointSelector
+	phases                   PhaseMetrics
+}
+
+func (s *SignalRFxBroadcastReceiver) Name() string {
+	return "SignalRFx:Broadcast:Receiver"
+}
+
+func (s *SignalRFxBroadcastReceiver) Setup(map[string]string) error {
+	s.cntInProgress = 0
+	s.cntConnected = 0
+	s.cntError = 0
+	s.cntCloseError = 0
+	s.cntSuccess = 0
+	s.cntMessagesRecv = 0
+	s.cntMessagesRecvSender = 0
+	s.cntLatencyLessThan100ms = 0
+	s.cntLatencyLessThan500ms = 0
+	s.cntLatencyLessThan1000ms = 0
+	s.cntLatencyMoreThan1000ms = 0
+	s.sequence.Reset()
+	s.reconnect.Reset()
+	s.connect.Reset()
+	s.endpoints.Reset()
+	s.phases.Reset()
+	return nil
+}
+
+func (s *SignalRFxBroadcastReceiver) logError(ctx *UserContext, msg string, err error) {
+	log.Printf("[Error][%s] %s due to %s", ctx.UserId, msg, err)
+	atomic.AddInt64(&s.cntError, 1)
+	s.phases.Add(ctx, "errors", 1)
+}
+
+func (s *SignalRFxBroadcastReceiver) logLatency(phaseLatency *metrics.Histogram, latency int64) {
+	phaseLatency.Observe(latency)
+	if latency < 100 {
+		atomic.AddInt64(&s.cntLatencyLessThan100ms, 1)
+	} else if latency < 500 {
+		atomic.AddInt64(&s.cntLatencyLessThan500ms, 1)
+	} else if latency < 1000 {
+		atomic.AddInt64(&s.cntLatencyLessThan1000ms, 1)
+	} else {
+		atomic.AddInt64(&s.cntLatencyMoreThan1000ms, 1)
+	}
+}
+
+func (s *SignalRFxBroadcastReceiver) Execute(ctx *UserContext) (err error) {
+	atomic.AddInt64(&s.cntInProgress, 1)
+	defer atomic.AddInt64(&s.cntInProgress, -1)
+
+	// Metrics of the user's phase, looked up once for all messages
+	phaseRecv := s.phases.Counter(ctx, "messages:recv")
+	phaseLatency := s.phases.Histogram(ctx, "latency")
+
+	lease, err := s.endpoints.Select(ctx, ctx.Params[ParamHost])
+	if err != nil {
+		s.logError(ctx, "Invalid endpoint selection", err)
+		return err
+	}
+	defer func() { lease.Release(err) }()
+
+	endpoint, err := NewEndpoint(lease.Target, ctx.Params, &s.connect)
+	if err != nil {
+		s.logError(ctx, "Invalid endpoint params", err)
+		return err
+	}
+	listenDurationSecs := listenDurationSecs(ctx.Params)
+	tag := senderTag(ctx.Params)
+	tracker := NewSequenceTracker()
+
+	reconnectPolicy, err := NewReconnectPolicyFromParams(ctx.Params)
+	if err != nil {
+		s.logError(ctx, "Invalid reconnect policy", err)
+		return err
+	}
+	dropper, err := NewConnectionDropperFromParams(ctx)
+	if err != nil {
+		s.logError(ctx, "Invalid drop params", err)
+		return err
+	}
+
+	var c *websocket.Conn
+	var closeChan chan struct{}
+	// Why the reader stopped, set before closeChan is closed
+	var readErr error
+
+	connect := func() error {
+		// Handshake phase 1 & 2: obtain token and connect to websocket
+		start := time.Now()
+		conn, token, err := DialSignalRFx(endpoint)
+		if err != nil {
+			return err
+		}
+		opened := time.Now()
+
+		connectChan := make(chan struct{})
+		var initOnce sync.Once
+		c = conn
+		closeChan = make(chan struct{})
+
+		go func(c *websocket.Conn, closeChan chan struct{}) {
+			defer c.Close()
+			defer close(closeChan)
+			for {
+				_, msg, err := c.ReadMessage()
+				if err != nil {
+					readErr = err
+					return
+				}
+
+				var content SignalRFxServerMessage
+				err = json.Unmarshal(msg, &content)
+				if err != nil {
+					readErr = fmt.Errorf("fail to decode incoming message: %s", err)
+					return
+				}
+
+				atomic.AddInt64(&s.cntMessagesRecv, 1)
+				phaseRecv.Inc()
+
+				// Init message
+				if content.S == 1 {
+					initOnce.Do(func() { close(connectChan) })
+					continue
+				}
+
+				for _, frame := range content.Frames {
+					if frame.Hub == "Chat" && frame.Method == "send" && len(frame.Arguments) > 1 {
+						payload, err := DecodeBroadcastPayload(frame.Arguments[1])
+						if err != nil || payload.Tag != tag {
+							continue
+						}
+
+						result := tracker.Track(frame.Arguments[0], payload.Seq)
+						s.sequence.Record(result)
+						if result.Duplicate {
+							continue
+						}
+
+						atomic.AddInt64(&s.cntMessagesRecvSender, 1)
+						s.logLatency(phaseLatency, (time.Now().UnixNano()-payload.Timestamp)/1000000)
+					}
+				}
+			}
+		}(c, closeChan)
+
+		// Handshake phase 2: wait for init message
+		select {
+		case <-connectChan:
+			break
+		case <-closeChan:
+			return errors.New("connection closed before init message")
+		case <-time.After(time.Minute):
+			c.Close()
+			return errors.New("no init message within timeout")
+		}
+
+		// Handshake phase 3: start receiving
+		if err = StartSignalRFx(endpoint, token); err != nil {
+			c.Close()
+			return err
+		}
+		s.connect.Record(ConnectStageHandshakeAck, time.Now().Sub(opened))
+		s.connect.Record(ConnectStageTotal, time.Now().Sub(start))
+
+		return nil
+	}
+
+	if err = connect(); err != nil {
+		s.logError(ctx, "Fail to connect", err)
+		return err
+	}
+
+	listenDeadline := time.After(time.Duration(listenDurationSecs) * time.Second)
+	dropped := false
+	for {
+		atomic.AddInt64(&s.cntConnected, 1)
+		cancelDrop := dropper.Schedule(c, &s.reconnect)
+
+		select {
+		case <-listenDeadline:
+			cancelDrop()
+			err = s.close(ctx, c, closeChan)
+			atomic.AddInt64(&s.cntConnected, -1)
+			return err
+		case <-closeChan:
+			dropped = cancelDrop()
+			atomic.AddInt64(&s.cntConnected, -1)
+			s.reconnect.Disconnected()
+		}
+
+		// Connection dropped before listen duration elapsed. Only the drops
+		// of the fault injection are expected.
+		if !dropped {
+			s.logError(ctx, "Connection closed before listen duration elapsed", readErr)
+		}
+		if !reconnectPolicy.Enabled() {
+			if dropped {
+				return nil
+			}
+			return errors.New("connection closed before listen duration elapsed")
+		}
+		if err = reconnectPolicy.Reconnect(&s.reconnect, connect); err != nil {
+			s.logError(ctx, "Fail to reconnect", err)
+			return err
+		}
+	}
+}
+
+func (s *SignalRFxBroadcastReceiver) close(ctx *UserContext, c *websocket.Conn, closeChan chan struct{}) error {
+	defer c.Close()
+
+	err := c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		s.logError(ctx, "Fail to close websocket gracefully", err)
+		return err
+	}
+
+	// Wait close response
+	select {
+	case <-time.After(1 * time.Minute):
+		log.Println("Warning: Fail to receive close message")
+		atomic.AddInt64(&s.cntCloseError, 1)
+	case <-closeChan:
+		atomic.AddInt64(&s.cntSuccess, 1)
+	}
+
+	return nil
+}
+
+func (s *SignalRFxBroadcastReceiver) Counters() map[string]int64 {
+	counters := map[string]int64{
+		"signalrfx:broadcast:receiver:inprogress":          atomic.LoadInt64(&s.cntInProgress),
+		"signalrfx:broadcast:receiver:connected":           atomic.LoadInt64(&s.cntConnected),
+		"signalrfx:broadcast:receiver:success":             atomic.LoadInt64(&s.cntSuccess),
+		"signalrfx:broadcast:receiver:error":               atomic.LoadInt64(&s.cntError),
+		"signalrfx:broadcast:receiver:closeerror":          atomic.LoadInt64(&s.cntCloseError),
+		"signalrfx:broadcast:receiver:messages:recv":       atomic.LoadInt64(&s.cntMessagesRecv),
+		"signalrfx:broadcast:receiver:messages:sender":     atomic.LoadInt64(&s.cntMessagesRecvSender),
+		"signalrfx:broadcast:receiver:latency:<100":        atomic.LoadInt64(&s.cntLatencyLessThan100ms),
+		"signalrfx:broadcast:receiver:latency:<500":        atomic.LoadInt64(&s.cntLatencyLessThan500ms),
+		"signalrfx:broadcast:receiver:latency:<1000":       atomic.LoadInt64(&s.cntLatencyLessThan1000ms),
+		"signalrfx:broadcast:receiver:latency:>=1000":      atomic.LoadInt64(&s.cntLatencyMoreThan1000ms),
+		"signalrfx:broadcast:receiver:messages:lost":       s.sequence.Lost(),
+		"signalrfx:broadcast:receiver:messages:duplicated": s.sequence.Duplicated(),
+		"signalrfx:broadcast:receiver:messages:outoforder": s.sequence.OutOfOrder(),
+	}
+	s.reconnect.AddCounters(counters, "signalrfx:broadcast:receiver")
+	s.connect.AddCounters(counters, "signalrfx:broadcast:receiver")
+	return counters
+}
+
+func (s *SignalRFxBroadcastReceiver) Metrics() []metrics.Sample {
+	samples := append(s.endpoints.Samples(), s.connect.Samples()...)
+	return append(samples, s.phases.Samples()...)
+}
@@ -4,13 +4,14 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
-	"net/http"
+	"math"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"net/url"
+	"microsoft.com/sigbench/metrics"
 )
 
 type SignalRFxBroadcastSender struct {
@@ -26,6 +27,12 @@ type SignalRFxBroadcastSender struct {
 	cntLatencyLessThan500ms  int64
 	cntLatencyLessThan1000ms int64
 	cntLatencyMoreThan1000ms int64
+	sendRate                 SendRateCounter
+	sequence                 SequenceCounters
+	reconnect                ReconnectCounters
+	connect                  ConnectCounters
+	endpoints                EndpointSelector
+	phases                   PhaseMetrics
 }
 
 func (s *SignalRFxBroadcastSender) Name() string {
@@ -45,15 +52,23 @@ func (s *SignalRFxBroadcastSender) Setup(map[string]string) error {
 	s.cntLatencyLessThan500ms = 0
 	s.cntLatencyLessThan1000ms = 0
 	s.cntLatencyMoreThan1000ms = 0
+	s.sendRate.Reset()
+	s.sequence.Reset()
+	s.reconnect.Reset()
+	s.connect.Reset()
+	s.endpoints.Reset()
+	s.phases.Reset()
 	return nil
 }
 
 func (s *SignalRFxBroadcastSender) logError(ctx *UserContext, msg string, err error) {
 	log.Printf("[Error][%s] %s due to %s", ctx.UserId, msg, err)
 	atomic.AddInt64(&s.cntError, 1)
+	s.phases.Add(ctx, "errors", 1)
 }
 
-func (s *SignalRFxBroadcastSender) logLatency(latency int64) {
+func (s *SignalRFxBroadcastSender) logLatency(phaseLatency *metrics.Histogram, latency int64) {
+	phaseLatency.Observe(latency)
 	// log.Println("Latency: ", latency)
 	if latency < 100 {
 		atomic.AddInt64(&s.cntLatencyLessThan100ms, 1)
@@ -66,11 +81,27 @@ func (s *SignalRFxBroadcastSender) logLatency(latency int64) {
 	}
 }
 
-func (s *SignalRFxBroadcastSender) Execute(ctx *UserContext) error {
+func (s *SignalRFxBroadcastSender) Execute(ctx *UserContext) (err error) {
 	atomic.AddInt64(&s.cntInProgress, 1)
 	defer atomic.AddInt64(&s.cntInProgress, -1)
 
-	host := ctx.Params[ParamHost]
+	// Metrics of the user's phase, looked up once for all messages
+	phaseRecv := s.phases.Counter(ctx, "messages:recv")
+	phaseSend := s.phases.Counter(ctx, "messages:send")
+	phaseLatency := s.phases.Histogram(ctx, "latency")
+
+	lease, err := s.endpoints.Select(ctx, ctx.Params[ParamHost])
+	if err != nil {
+		s.logError(ctx, "Invalid endpoint selection", err)
+		return err
+	}
+	defer func() { lease.Release(err) }()
+
+	endpoint, err := NewEndpoint(lease.Target, ctx.Params, &s.connect)
+	if err != nil {
+		s.logError(ctx, "Invalid endpoint params", err)
+		return err
+	}
 	broadcastDurationSecs := 10
 	if secsStr, ok := ctx.Params[ParamBroadcastDurationSecs]; ok {
 		if secs, err := strconv.Atoi(secsStr); err == nil {
@@ -78,167 +109,238 @@ func (s *SignalRFxBroadcastSender) Execute(ctx *UserContext) error {
 		}
 	}
 
-	// Handshake phase 1: obtain token
-	handshakeReq, err := http.NewRequest(http.MethodGet, "http://"+host+"/signalr/negotiate?clientProtocol=1.4&connectionData=%5B%7B%22name%22%3A%22chat%22%7D%5D", nil)
-	if err != nil {
-		s.logError(ctx, "Fail to construct handshake request", err)
-		return err
-	}
-
-	handshakeResp, err := http.DefaultClient.Do(handshakeReq)
+	pacer, err := NewPacerFromParams(ctx.Params, 1)
 	if err != nil {
-		s.logError(ctx, "Fail to obtain connection token", err)
+		s.logError(ctx, "Invalid send rate", err)
 		return err
 	}
-	defer handshakeResp.Body.Close()
+	tag := senderTag(ctx.Params)
+	recvTimeout := recvTimeout(ctx.Params)
+	tracker := NewSequenceTracker()
+	tracker.Follow(ctx.UserId, 0)
 
-	decoder := json.NewDecoder(handshakeResp.Body)
-	var handshakeContent SignalRFxHandshakeResp
-	err = decoder.Decode(&handshakeContent)
+	reconnectPolicy, err := NewReconnectPolicyFromParams(ctx.Params)
 	if err != nil {
-		s.logError(ctx, "Fail to decode connection token", err)
+		s.logError(ctx, "Invalid reconnect policy", err)
 		return err
 	}
-
-	// Handshake phase 2: connect to websocket
-	wsUrl := "ws://" + host + "/signalr/connect?transport=webSockets&clientProtocol=1.4&connectionToken=" + url.QueryEscape(handshakeContent.ConnectionToken) + "&connectionData=%5B%7B%22name%22%3A%22chat%22%7D%5D&tid=0"
-	c, _, err := websocket.DefaultDialer.Dial(wsUrl, nil)
+	dropper, err := NewConnectionDropperFromParams(ctx)
 	if err != nil {
-		s.logError(ctx, "Fail to connect to websocket", err)
+		s.logError(ctx, "Invalid drop params", err)
 		return err
 	}
-	defer c.Close()
 
-	connectChan := make(chan struct{})
-	closeChan := make(chan struct{})
-	recvChan := make(chan int64, broadcastDurationSecs)
+	var c *websocket.Conn
+	var closeChan chan struct{}
+	recvSignal := make(chan struct{}, 1)
+	recvSelf := int64(0)
 
-	go func() {
-		defer c.Close()
-		defer close(closeChan)
-		for {
-			_, msg, err := c.ReadMessage()
-			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
-					s.logError(ctx, "Fail to read incoming message", err)
+	connect := func() error {
+		// Handshake phase 1 & 2: obtain token and connect to websocket
+		start := time.Now()
+		conn, token, err := DialSignalRFx(endpoint)
+		if err != nil {
+			return err
+		}
+		opened := time.Now()
+
+		connectChan := make(chan struct{})
+		var initOnce sync.Once
+		c = conn
+		closeChan = make(chan struct{})
+
+		go func(c *websocket.Conn, closeChan chan struct{}) {
+			defer c.Close()
+			defer close(closeChan)
+			for {
+				_, msg, err := c.ReadMessage()
+				if err != nil {
+					if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
+						s.logError(ctx, "Fail to read incoming message", err)
+					}
+					return
 				}
-				return
-			}
 
-			var content SignalRFxServerMessage
-			err = json.Unmarshal(msg, &content)
-			if err != nil {
-				s.logError(ctx, "Fail to decode incoming message", err)
-				return
-			}
+				var content SignalRFxServerMessage
+				err = json.Unmarshal(msg, &content)
+				if err != nil {
+					s.logError(ctx, "Fail to decode incoming message", err)
+					return
+				}
 
-			atomic.AddInt64(&s.cntMessagesRecv, 1)
+				atomic.AddInt64(&s.cntMessagesRecv, 1)
+				phaseRecv.Inc()
 
-			// Init message
-			if content.S == 1 {
-				close(connectChan)
-				continue
-			}
+				// Init message
+				if content.S == 1 {
+					initOnce.Do(func() { close(connectChan) })
+					continue
+				}
 
-			// Ack message
-			if content.Id != "" {
-				atomic.AddInt64(&s.cntMessagesSendAck, 1)
-				continue
-			}
+				// Ack message
+				if content.Id != "" {
+					atomic.AddInt64(&s.cntMessagesSendAck, 1)
+					continue
+				}
 
-			for _, frame := range content.Frames {
-				if frame.Hub == "Chat" && frame.Method == "send" && frame.Arguments[0] == ctx.UserId {
-					sendStart, err := strconv.ParseInt(frame.Arguments[1], 10, 64)
-					if err != nil {
-						s.logError(ctx, "Fail to decode start timestamp", err)
-						continue
+				for _, frame := range content.Frames {
+					if frame.Hub == "Chat" && frame.Method == "send" && len(frame.Arguments) > 1 {
+						payload, err := DecodeBroadcastPayload(frame.Arguments[1])
+						if err != nil || payload.Tag != tag {
+							continue
+						}
+
+						result := tracker.Track(frame.Arguments[0], payload.Seq)
+						s.sequence.Record(result)
+						if frame.Arguments[0] != ctx.UserId || result.Duplicate {
+							continue
+						}
+
+						s.logLatency(phaseLatency, (time.Now().UnixNano()-payload.Timestamp)/1000000)
+						atomic.AddInt64(&recvSelf, 1)
+						select {
+						case recvSignal <- struct{}{}:
+						default:
+						}
 					}
-
-					recvChan <- (time.Now().UnixNano() - sendStart) / 1000000
 				}
 			}
+		}(c, closeChan)
+
+		// Handshake phase 2: wait for init message
+		select {
+		case <-connectChan:
+			break
+		case <-closeChan:
+			return errors.New("connection closed before init message")
+		case <-time.After(time.Minute):
+			c.Close()
+			return errors.New("no init message within timeout")
 		}
-	}()
 
-	// Handshake phase 2: wait for init message
-	timeoutChan := time.After(time.Minute)
-	select {
-	case <-connectChan:
-		break
-	case <-timeoutChan:
-		err = errors.New("no init message")
-		s.logError(ctx, "Fail to receive init message within timeout", err)
-		return err
-	}
+		// Handshake phase 3: start receiving
+		if err = StartSignalRFx(endpoint, token); err != nil {
+			c.Close()
+			return err
+		}
+		s.connect.Record(ConnectStageHandshakeAck, time.Now().Sub(opened))
+		s.connect.Record(ConnectStageTotal, time.Now().Sub(start))
 
-	// Handshake phase 3: start receiving
-	startReq, err := http.NewRequest(http.MethodGet, "http://"+host+"/signalr/start?transport=webSockets&clientProtocol=1.4&connectionToken="+url.QueryEscape(handshakeContent.ConnectionToken)+"&connectionData=%5B%7B%22name%22%3A%22chat%22%7D%5D&tid=0", nil)
-	if err != nil {
-		s.logError(ctx, "Fail to construct start request", err)
-		return err
+		return nil
 	}
 
-	startResp, err := http.DefaultClient.Do(startReq)
-	if err != nil {
-		s.logError(ctx, "Fail to start", err)
+	if err = connect(); err != nil {
+		s.logError(ctx, "Fail to connect", err)
 		return err
 	}
-	defer startResp.Body.Close()
+	defer func() {
+		c.Close()
+	}()
 
-	decoder = json.NewDecoder(startResp.Body)
-	var startContent SignalRFxStartResp
-	err = decoder.Decode(&startContent)
-	if err != nil {
-		s.logError(ctx, "Fail to decode start response", err)
-		return err
-	}
+	connected := true
+	atomic.AddInt64(&s.cntConnected, 1)
+	cancelDrop := dropper.Schedule(c, &s.reconnect)
+	defer func() {
+		cancelDrop()
+		if connected {
+			atomic.AddInt64(&s.cntConnected, -1)
+		}
+	}()
 
-	if startContent.Response != "started" {
-		err = errors.New(startContent.Response)
-		s.logError(ctx, "Start response not expected", err)
-		return err
+	reconnect := func() error {
+		cancelDrop()
+		connected = false
+		atomic.AddInt64(&s.cntConnected, -1)
+		s.reconnect.Disconnected()
+
+		if err := reconnectPolicy.Reconnect(&s.reconnect, connect); err != nil {
+			return err
+		}
+
+		connected = true
+		atomic.AddInt64(&s.cntConnected, 1)
+		cancelDrop = dropper.Schedule(c, &s.reconnect)
+		return nil
 	}
 
-	atomic.AddInt64(&s.cntConnected, 1)
-	defer atomic.AddInt64(&s.cntConnected, -1)
+	s.sendRate.Start(pacer)
+	defer s.sendRate.Stop(pacer)
 
 	// Now we can send messages
-	for i := 0; i < broadcastDurationSecs; i++ {
-		// Send message
-		msg, err := json.Marshal(&SignalRFxClientMessage{
-			Id:     i,
-			Hub:    "chat",
-			Method: "Send",
-			Arguments: []string{
-				ctx.UserId,
-				strconv.FormatInt(time.Now().UnixNano(), 10),
-			},
-		})
-		if err != nil {
-			s.logError(ctx, "Fail to serialize signalr fx message", err)
-			return err
+	sent := 0
+	deadline := time.Now().Add(time.Duration(broadcastDurationSecs) * time.Second)
+	for {
+		n := pacer.WaitUntil(deadline)
+		if !time.Now().Before(deadline) {
+			break
 		}
 
-		err = c.WriteMessage(websocket.TextMessage, msg)
-		if err != nil {
-			s.logError(ctx, "Fail to send broadcast message", err)
-			return err
+		// Reconnect as soon as the connection is found dropped
+		select {
+		case <-closeChan:
+			if reconnectPolicy.Enabled() {
+				if err = reconnect(); err != nil {
+					s.logError(ctx, "Fail to reconnect", err)
+					return err
+				}
+			}
+		default:
 		}
 
-		atomic.AddInt64(&s.cntMessagesSend, 1)
+		for i := 0; i < n; i++ {
+			payload, err := EncodeBroadcastPayload(&BroadcastPayload{
+				Tag:       tag,
+				Seq:       int64(sent),
+				Timestamp: time.Now().UnixNano(),
+			})
+			if err != nil {
+				s.logError(ctx, "Fail to encode payload", err)
+				return err
+			}
+
+			// Send message
+			msg, err := json.Marshal(&SignalRFxClientMessage{
+				Id:     sent,
+				Hub:    "chat",
+				Method: "Send",
+				Arguments: []string{
+					ctx.UserId,
+					payload,
+				},
+			})
+			if err != nil {
+				s.logError(ctx, "Fail to serialize signalr fx message", err)
+				return err
+			}
 
-		time.Sleep(time.Second)
+			err = c.WriteMessage(websocket.TextMessage, msg)
+			if err != nil {
+				if !reconnectPolicy.Enabled() {
+					s.logError(ctx, "Fail to send broadcast message", err)
+					return err
+				}
+				if err = reconnect(); err != nil {
+					s.logError(ctx, "Fail to reconnect", err)
+					return err
+				}
+				continue
+			}
+
+			sent++
+			atomic.AddInt64(&s.cntMessagesSend, 1)
+			phaseSend.Inc()
+			s.sendRate.Sent(1)
+		}
 	}
 
-	timeoutChan = time.After(time.Minute)
-	for i := 0; i < broadcastDurationSecs; i++ {
+	timeoutChan := time.After(recvTimeout)
+	for atomic.LoadInt64(&recvSelf) < int64(sent) {
 		select {
-		case latency := <-recvChan:
-			s.logLatency(latency)
+		case <-recvSignal:
 		case <-timeoutChan:
+			s.sequence.Record(tracker.Finish(ctx.UserId, int64(sent)))
 			s.logError(ctx, "Fail to receive all self broadcast messages within timeout", nil)
 			return errors.New("fail receive all self broadcast messages within timeout")
-			break
 		}
 	}
 
@@ -261,18 +363,32 @@ func (s *SignalRFxBroadcastSender) Execute(ctx *UserContext) error {
 }
 
 func (s *SignalRFxBroadcastSender) Counters() map[string]int64 {
-	return map[string]int64{
-		"signalrfx:broadcast:inprogress":       atomic.LoadInt64(&s.cntInProgress),
-		"signalrfx:broadcast:connected":        atomic.LoadInt64(&s.cntConnected),
-		"signalrfx:broadcast:success":          atomic.LoadInt64(&s.cntSuccess),
-		"signalrfx:broadcast:error":            atomic.LoadInt64(&s.cntError),
-		"signalrfx:broadcast:closeerror":       atomic.LoadInt64(&s.cntCloseError),
-		"signalrfx:broadcast:messages:recv":    atomic.LoadInt64(&s.cntMessagesRecv),
-		"signalrfx:broadcast:messages:send":    atomic.LoadInt64(&s.cntMessagesSend),
-		"signalrfx:broadcast:messages:sendack": atomic.LoadInt64(&s.cntMessagesSendAck),
-		"signalrfx:broadcast:latency:<100":     atomic.LoadInt64(&s.cntLatencyLessThan100ms),
-		"signalrfx:broadcast:latency:<500":     atomic.LoadInt64(&s.cntLatencyLessThan500ms),
-		"signalrfx:broadcast:latency:<1000":    atomic.LoadInt64(&s.cntLatencyLessThan1000ms),
-		"signalrfx:broadcast:latency:>=1000":   atomic.LoadInt64(&s.cntLatencyMoreThan1000ms),
+	counters := map[string]int64{
+		"signalrfx:broadcast:inprogress":            atomic.LoadInt64(&s.cntInProgress),
+		"signalrfx:broadcast:connected":             atomic.LoadInt64(&s.cntConnected),
+		"signalrfx:broadcast:success":               atomic.LoadInt64(&s.cntSuccess),
+		"signalrfx:broadcast:error":                 atomic.LoadInt64(&s.cntError),
+		"signalrfx:broadcast:closeerror":            atomic.LoadInt64(&s.cntCloseError),
+		"signalrfx:broadcast:messages:recv":         atomic.LoadInt64(&s.cntMessagesRecv),
+		"signalrfx:broadcast:messages:send":         atomic.LoadInt64(&s.cntMessagesSend),
+		"signalrfx:broadcast:messages:sendack":      atomic.LoadInt64(&s.cntMessagesSendAck),
+		"signalrfx:broadcast:latency:<100":          atomic.LoadInt64(&s.cntLatencyLessThan100ms),
+		"signalrfx:broadcast:latency:<500":          atomic.LoadInt64(&s.cntLatencyLessThan500ms),
+		"signalrfx:broadcast:latency:<1000":         atomic.LoadInt64(&s.cntLatencyLessThan1000ms),
+		"signalrfx:broadcast:latency:>=1000":        atomic.LoadInt64(&s.cntLatencyMoreThan1000ms),
+		"signalrfx:broadcast:sendrate:target":       int64(math.Round(s.sendRate.Target())),
+		"signalrfx:broadcast:sendrate:target:milli": s.sendRate.TargetMilli(),
+		"signalrfx:broadcast:sendrate:measured":     s.sendRate.Measured(),
+		"signalrfx:broadcast:messages:lost":         s.sequence.Lost(),
+		"signalrfx:broadcast:messages:duplicated":   s.sequence.Duplicated(),
+		"signalrfx:broadcast:messages:outoforder":   s.sequence.OutOfOrder(),
 	}
+	s.reconnect.AddCounters(counters, "signalrfx:broadcast")
+	s.connect.AddCounters(counters, "signalrfx:broadcast")
+	return counters
+}
+
+func (s *SignalRFxBroadcastSender) Metrics() []metrics.Sample {
+	samples := append(s.endpoints.Samples(), s.connect.Samples()...)
+	return append(samples, s.phases.Samples()...)
 }
@@ -0,0 +1,119 @@
+package sessions_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"microsoft.com/sigbench/fakeserver"
+	"microsoft.com/sigbench/metrics"
+	"microsoft.com/sigbench/sessions"
+)
+
+func startFakeSignalRFx(t *testing.T) (*fakeserver.SignalRFxServer, string) {
+	server := fakeserver.NewSignalRFxServer("")
+	ts := httptest.NewServer(server)
+	t.Cleanup(ts.Close)
+	return server, strings.TrimPrefix(ts.URL, "http://")
+}
+
+func TestSignalRFxBroadcastSenderEndToEnd(t *testing.T) {
+	server, host := startFakeSignalRFx(t)
+	server.KeepAliveTimeout = 300 * time.Millisecond
+
+	session := &sessions.SignalRFxBroadcastSender{}
+	execute(t, session, "user0", map[string]string{
+		sessions.ParamHost:                  host,
+		sessions.ParamBroadcastDurationSecs: "1",
+		sessions.ParamSendRate:              "20",
+		sessions.ParamBackendRegex:          "server(\\d+)$",
+	})
+
+	counters := session.Counters()
+	if counters["signalrfx:broadcast:success"] != 1 || counters["signalrfx:broadcast:error"] != 0 {
+		t.Fatal("Expect one successful sender but got", counters)
+	}
+	sent := counters["signalrfx:broadcast:messages:send"]
+	if sent == 0 || counters["signalrfx:broadcast:messages:sendack"] != sent {
+		t.Fatal("Expect every sent message to be acked but got", counters)
+	}
+	if metrics.Flatten(session.Metrics())["backend:connections{instance=000000}"] != 1 {
+		t.Fatal("Expect the instance id matched in the host name but got", counters)
+	}
+	if counters["signalrfx:broadcast:messages:lost"] != 0 {
+		t.Fatal("Expect no lost messages but got", counters)
+	}
+}
+
+func TestSignalRFxDelayedInit(t *testing.T) {
+	server, host := startFakeSignalRFx(t)
+	server.InitDelay = 200 * time.Millisecond
+
+	session := &sessions.SignalRFxBroadcastReceiver{}
+	execute(t, session, "user0", map[string]string{
+		sessions.ParamHost:               host,
+		sessions.ParamListenDurationSecs: "0",
+	})
+
+	counters := session.Counters()
+	if counters["signalrfx:broadcast:receiver:connect:handshake:<500"] != 1 {
+		t.Fatal("Expect the init delay in the handshake stage but got", counters)
+	}
+}
+
+func TestSignalRFxRepeatedInit(t *testing.T) {
+	server, host := startFakeSignalRFx(t)
+	server.InitMessages = 2
+
+	session := &sessions.SignalRFxBroadcastReceiver{}
+	execute(t, session, "user0", map[string]string{
+		sessions.ParamHost:               host,
+		sessions.ParamListenDurationSecs: "0",
+	})
+
+	if counters := session.Counters(); counters["signalrfx:broadcast:receiver:success"] != 1 {
+		t.Fatal("Expect a repeated init message to be ignored but got", counters)
+	}
+}
+
+func TestSignalRFxDropBeforeInit(t *testing.T) {
+	server, host := startFakeSignalRFx(t)
+	server.DropBeforeInit = true
+
+	params := map[string]string{sessions.ParamHost: host}
+	session := &sessions.SignalRFxBroadcastSender{}
+	if err := session.Setup(params); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := session.Execute(&sessions.UserContext{UserId: "user0", Params: params}); err == nil {
+		t.Fatal("Expect error when the connection drops before init")
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 5*time.Second {
+		t.Fatal("Expect to fail as soon as the connection drops but took", elapsed)
+	}
+}
+
+func TestDialSignalRFx(t *testing.T) {
+	_, host := startFakeSignalRFx(t)
+
+	endpoint, err := sessions.NewEndpoint(host, map[string]string{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, token, err := sessions.DialSignalRFx(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if token == "" {
+		t.Fatal("Expect a connection token")
+	}
+	if err = sessions.StartSignalRFx(endpoint, token); err != nil {
+		t.Fatal(err)
+	}
+	if err = sessions.StartSignalRFx(endpoint, "unknown"); err == nil {
+		t.Fatal("Expect error to start an unknown connection")
+	}
+}
@@ -0,0 +1,79 @@
+package sessions
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"sync"
+)
+
+var (
+	tlsConfigsLock sync.Mutex
+	tlsConfigs     = make(map[string]*tls.Config)
+)
+
+// NewTLSConfigFromParams builds the client TLS configuration from the tls*
+// session parameters. It returns nil if none is set so that the defaults of
+// the standard library apply. Configurations are cached since every user
+// asks for one and loading certificates is expensive.
+func NewTLSConfigFromParams(params map[string]string) (*tls.Config, error) {
+	caFile := params[ParamTLSCAFile]
+	certFile := params[ParamTLSCertFile]
+	keyFile := params[ParamTLSKeyFile]
+	serverName := params[ParamTLSServerName]
+	skipStr := params[ParamTLSInsecureSkipVerify]
+	if caFile == "" && certFile == "" && keyFile == "" && serverName == "" && skipStr == "" {
+		return nil, nil
+	}
+
+	key := caFile + "\n" + certFile + "\n" + keyFile + "\n" + serverName + "\n" + skipStr
+	tlsConfigsLock.Lock()
+	defer tlsConfigsLock.Unlock()
+	if cfg, ok := tlsConfigs[key]; ok {
+		return cfg, nil
+	}
+
+	cfg := &tls.Config{ServerName: serverName}
+	if skipStr != "" {
+		skip, err := strconv.ParseBool(skipStr)
+		if err != nil {
+			return nil, err
+		}
+		cfg.InsecureSkipVerify = skip
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("fail to read CA bundle: %s", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in CA bundle " + caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("fail to load client certificate: %s", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	tlsConfigs[key] = cfg
+	return cfg, nil
+}
+
+// secureScheme reports whether the scheme parameter asks for https and wss.
+func secureScheme(params map[string]string) (bool, error) {
+	switch params[ParamScheme] {
+	case "", "http", "ws":
+		return false, nil
+	case "https", "wss":
+		return true, nil
+	default:
+		return false, errors.New("unknown scheme: " + params[ParamScheme])
+	}
+}
@@ -1,7 +1,24 @@
 package sessions
 
+import "time"
+
 type UserContext struct {
-	UserId string
-	Phase  string
-	Params map[string]string
+	UserId   string
+	Phase    string
+	JobStart time.Time
+	Params   map[string]string
+
+	// Index of the agent running the user among AgentCount agents
+	AgentIdx   int
+	AgentCount int
+}
+
+// GlobalIndex turns the index of a user among the users of a session on this
+// agent into an index among the users of all agents, interleaving the agents
+// so that the indexes stay dense while they run the same number of users.
+func (ctx *UserContext) GlobalIndex(localIdx int64) int64 {
+	if ctx.AgentCount <= 1 {
+		return localIdx
+	}
+	return localIdx*int64(ctx.AgentCount) + int64(ctx.AgentIdx)
 }
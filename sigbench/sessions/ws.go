@@ -0,0 +1,362 @@
+package sessions
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"microsoft.com/sigbench/metrics"
+)
+
+// WsPayload is the body of every frame sent by the raw websocket sessions.
+// Gateways are expected to send it back unchanged.
+type WsPayload struct {
+	Sender    string `json:"u"`
+	Tag       string `json:"t"`
+	Seq       int64  `json:"s"`
+	Timestamp int64  `json:"ts"`
+}
+
+// NewWsDialer builds a dialer of factory and the handshake headers from the
+// ws* session parameters.
+func NewWsDialer(factory *ConnectionFactory, params map[string]string) (*websocket.Dialer, http.Header, error) {
+	dialer := factory.WebsocketDialer(nil)
+
+	if protocols := params[ParamWsSubprotocols]; protocols != "" {
+		dialer.Subprotocols = strings.Split(protocols, ",")
+	}
+	if compressionStr, ok := params[ParamWsCompression]; ok {
+		compression, err := strconv.ParseBool(compressionStr)
+		if err != nil {
+			return nil, nil, err
+		}
+		dialer.EnableCompression = compression
+	}
+	tlsConfig, err := NewTLSConfigFromParams(params)
+	if err != nil {
+		return nil, nil, err
+	}
+	if skipStr, ok := params[ParamWsInsecureSkipVerify]; ok {
+		skip, err := strconv.ParseBool(skipStr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		} else {
+			tlsConfig = tlsConfig.Clone()
+		}
+		tlsConfig.InsecureSkipVerify = skip
+	}
+	dialer.TLSClientConfig = tlsConfig
+
+	header := http.Header{}
+	if headersStr, ok := params[ParamWsHeaders]; ok {
+		var headers map[string]string
+		if err := json.Unmarshal([]byte(headersStr), &headers); err != nil {
+			return nil, nil, err
+		}
+		for key, value := range headers {
+			header.Set(key, value)
+		}
+	}
+
+	return dialer, header, nil
+}
+
+// wsMessageType returns the frame type configured by wsMessageType, text by
+// default.
+func wsMessageType(params map[string]string) (int, error) {
+	switch params[ParamWsMessageType] {
+	case "", "text":
+		return websocket.TextMessage, nil
+	case "binary":
+		return websocket.BinaryMessage, nil
+	default:
+		return 0, errors.New("unknown websocket message type: " + params[ParamWsMessageType])
+	}
+}
+
+// wsSession sends tagged frames at the configured rate and measures how long
+// they take to come back. In echo mode only the user's own frames are
+// expected; in broadcast mode frames of all senders with the same tag count.
+type wsSession struct {
+	prefix    string
+	broadcast bool
+
+	cntInProgress   int64
+	cntConnected    int64
+	cntError        int64
+	cntCloseError   int64
+	cntSuccess      int64
+	cntMessagesSend int64
+	cntMessagesRecv int64
+	latency         *LatencyHistogram
+	sendRate        SendRateCounter
+	sequence        SequenceCounters
+	connect         ConnectCounters
+	endpoints       EndpointSelector
+	phases          PhaseMetrics
+}
+
+func (s *wsSession) Setup(map[string]string) error {
+	s.endpoints.Reset()
+	s.phases.Reset()
+	s.cntInProgress = 0
+	s.cntConnected = 0
+	s.cntError = 0
+	s.cntCloseError = 0
+	s.cntSuccess = 0
+	s.cntMessagesSend = 0
+	s.cntMessagesRecv = 0
+	s.latency = NewLatencyHistogram()
+	s.sendRate.Reset()
+	s.sequence.Reset()
+	s.connect.Reset()
+	return nil
+}
+
+func (s *wsSession) logError(ctx *UserContext, msg string, err error) {
+	log.Printf("[Error][%s] %s due to %s", ctx.UserId, msg, err)
+	atomic.AddInt64(&s.cntError, 1)
+	s.phases.Add(ctx, "errors", 1)
+}
+
+func (s *wsSession) Execute(ctx *UserContext) (err error) {
+	atomic.AddInt64(&s.cntInProgress, 1)
+	defer atomic.AddInt64(&s.cntInProgress, -1)
+
+	// Metrics of the user's phase, looked up once for all messages
+	phaseRecv := s.phases.Counter(ctx, "messages:recv")
+	phaseSend := s.phases.Counter(ctx, "messages:send")
+	phaseLatency := s.phases.Histogram(ctx, "latency")
+
+	lease, err := s.endpoints.Select(ctx, ctx.Params[ParamWsUrl])
+	if err != nil {
+		s.logError(ctx, "Invalid endpoint selection", err)
+		return err
+	}
+	defer func() { lease.Release(err) }()
+	wsUrl := lease.Target
+
+	factory, err := ConnectionFactoryFromParams(ctx.Params)
+	if err != nil {
+		s.logError(ctx, "Invalid connection params", err)
+		return err
+	}
+	dialer, header, err := NewWsDialer(factory, ctx.Params)
+	if err != nil {
+		s.logError(ctx, "Invalid websocket params", err)
+		return err
+	}
+	messageType, err := wsMessageType(ctx.Params)
+	if err != nil {
+		s.logError(ctx, "Invalid websocket params", err)
+		return err
+	}
+
+	durationSecs := 10
+	if secsStr, ok := ctx.Params[ParamWsDurationSecs]; ok {
+		if secs, err := strconv.Atoi(secsStr); err == nil {
+			durationSecs = secs
+		}
+	}
+
+	pacer, err := NewPacerFromParams(ctx.Params, 1)
+	if err != nil {
+		s.logError(ctx, "Invalid send rate", err)
+		return err
+	}
+	tag := senderTag(ctx.Params)
+	recvTimeout := recvTimeout(ctx.Params)
+	tracker := NewSequenceTracker()
+	tracker.Follow(ctx.UserId, 0)
+
+	c, _, err := factory.DialWebsocket(dialer, wsUrl, header, &s.connect)
+	if err != nil {
+		s.logError(ctx, "Fail to connect to websocket", err)
+		return err
+	}
+	defer c.Close()
+
+	recvSignal := make(chan struct{}, 1)
+	recvSelf := int64(0)
+	closeChan := make(chan struct{})
+
+	go func() {
+		defer c.Close()
+		defer close(closeChan)
+		for {
+			_, msg, err := c.ReadMessage()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
+					s.logError(ctx, "Fail to read incoming message", err)
+				}
+				return
+			}
+
+			atomic.AddInt64(&s.cntMessagesRecv, 1)
+			phaseRecv.Inc()
+
+			var payload WsPayload
+			if err = json.Unmarshal(msg, &payload); err != nil || payload.Tag != tag {
+				continue
+			}
+			if !s.broadcast && payload.Sender != ctx.UserId {
+				continue
+			}
+
+			result := tracker.Track(payload.Sender, payload.Seq)
+			s.sequence.Record(result)
+			if result.Duplicate {
+				continue
+			}
+
+			latency := (time.Now().UnixNano() - payload.Timestamp) / 1000000
+			s.latency.Record(latency)
+			phaseLatency.Observe(latency)
+			if payload.Sender == ctx.UserId {
+				atomic.AddInt64(&recvSelf, 1)
+				select {
+				case recvSignal <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	atomic.AddInt64(&s.cntConnected, 1)
+	defer atomic.AddInt64(&s.cntConnected, -1)
+
+	s.sendRate.Start(pacer)
+	defer s.sendRate.Stop(pacer)
+
+	sent := int64(0)
+	deadline := time.Now().Add(time.Duration(durationSecs) * time.Second)
+	for {
+		n := pacer.WaitUntil(deadline)
+		if !time.Now().Before(deadline) {
+			break
+		}
+
+		for i := 0; i < n; i++ {
+			msg, err := json.Marshal(&WsPayload{
+				Sender:    ctx.UserId,
+				Tag:       tag,
+				Seq:       sent,
+				Timestamp: time.Now().UnixNano(),
+			})
+			if err != nil {
+				s.logError(ctx, "Fail to encode payload", err)
+				return err
+			}
+
+			if err = c.WriteMessage(messageType, msg); err != nil {
+				s.logError(ctx, "Fail to send message", err)
+				return err
+			}
+
+			sent++
+			atomic.AddInt64(&s.cntMessagesSend, 1)
+			phaseSend.Inc()
+			s.sendRate.Sent(1)
+		}
+	}
+
+	timeoutChan := time.After(recvTimeout)
+	for atomic.LoadInt64(&recvSelf) < sent {
+		select {
+		case <-recvSignal:
+		case <-closeChan:
+			s.sequence.Record(tracker.Finish(ctx.UserId, sent))
+			err = errors.New("connection closed before all messages came back")
+			s.logError(ctx, "Fail to receive all self messages", err)
+			return err
+		case <-timeoutChan:
+			s.sequence.Record(tracker.Finish(ctx.UserId, sent))
+			s.logError(ctx, "Fail to receive all self messages within timeout", nil)
+			return errors.New("fail to receive all self messages within timeout")
+		}
+	}
+
+	err = c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		s.logError(ctx, "Fail to close websocket gracefully", err)
+		return err
+	}
+
+	// Wait close response
+	select {
+	case <-time.After(1 * time.Minute):
+		log.Println("Warning: Fail to receive close message")
+		atomic.AddInt64(&s.cntCloseError, 1)
+	case <-closeChan:
+		atomic.AddInt64(&s.cntSuccess, 1)
+	}
+
+	return nil
+}
+
+func (s *wsSession) Counters() map[string]int64 {
+	counters := map[string]int64{
+		s.prefix + ":inprogress":            atomic.LoadInt64(&s.cntInProgress),
+		s.prefix + ":connected":             atomic.LoadInt64(&s.cntConnected),
+		s.prefix + ":success":               atomic.LoadInt64(&s.cntSuccess),
+		s.prefix + ":error":                 atomic.LoadInt64(&s.cntError),
+		s.prefix + ":closeerror":            atomic.LoadInt64(&s.cntCloseError),
+		s.prefix + ":messages:send":         atomic.LoadInt64(&s.cntMessagesSend),
+		s.prefix + ":messages:recv":         atomic.LoadInt64(&s.cntMessagesRecv),
+		s.prefix + ":sendrate:target":       int64(math.Round(s.sendRate.Target())),
+		s.prefix + ":sendrate:target:milli": s.sendRate.TargetMilli(),
+		s.prefix + ":sendrate:measured":     s.sendRate.Measured(),
+		s.prefix + ":messages:lost":         s.sequence.Lost(),
+		s.prefix + ":messages:duplicated":   s.sequence.Duplicated(),
+		s.prefix + ":messages:outoforder":   s.sequence.OutOfOrder(),
+	}
+	if s.latency != nil {
+		s.latency.AddCounters(counters, s.prefix+":latency")
+	}
+	s.connect.AddCounters(counters, s.prefix)
+	return counters
+}
+
+func (s *wsSession) Metrics() []metrics.Sample {
+	samples := append(s.endpoints.Samples(), s.connect.Samples()...)
+	return append(samples, s.phases.Samples()...)
+}
+
+// WsEcho expects a websocket server that echoes every frame back to its
+// sender.
+type WsEcho struct {
+	wsSession
+}
+
+func NewWsEcho() *WsEcho {
+	return &WsEcho{wsSession{prefix: "ws:echo"}}
+}
+
+func (s *WsEcho) Name() string {
+	return "Ws:Echo"
+}
+
+// WsBroadcast expects a websocket server that forwards every frame to all
+// connected clients.
+type WsBroadcast struct {
+	wsSession
+}
+
+func NewWsBroadcast() *WsBroadcast {
+	return &WsBroadcast{wsSession{prefix: "ws:broadcast", broadcast: true}}
+}
+
+func (s *WsBroadcast) Name() string {
+	return "Ws:Broadcast"
+}
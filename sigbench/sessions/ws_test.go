@@ -0,0 +1,48 @@
+package sessions
+
+import (
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestNewWsDialer(t *testing.T) {
+	factory, err := ConnectionFactoryFromParams(map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialer, header, err := NewWsDialer(factory, map[string]string{
+		ParamWsSubprotocols:       "chat,superchat",
+		ParamWsHeaders:            `{"Authorization": "Bearer token"}`,
+		ParamWsCompression:        "true",
+		ParamWsInsecureSkipVerify: "true",
+	})
+	if err != nil {
+		t.Fatal("Expect valid params but got", err)
+	}
+	if len(dialer.Subprotocols) != 2 || dialer.Subprotocols[1] != "superchat" {
+		t.Fatal("Expect two subprotocols but got", dialer.Subprotocols)
+	}
+	if !dialer.EnableCompression || !dialer.TLSClientConfig.InsecureSkipVerify {
+		t.Fatal("Expect compression and insecure skip verify to be enabled")
+	}
+	if header.Get("Authorization") != "Bearer token" {
+		t.Fatal("Expect authorization header but got", header)
+	}
+
+	if _, _, err = NewWsDialer(factory, map[string]string{ParamWsHeaders: "[]"}); err == nil {
+		t.Fatal("Expect error for headers which are not an object")
+	}
+}
+
+func TestWsMessageType(t *testing.T) {
+	if typ, err := wsMessageType(map[string]string{}); err != nil || typ != websocket.TextMessage {
+		t.Fatal("Expect text by default but got", typ, err)
+	}
+	if typ, err := wsMessageType(map[string]string{ParamWsMessageType: "binary"}); err != nil || typ != websocket.BinaryMessage {
+		t.Fatal("Expect binary but got", typ, err)
+	}
+	if _, err := wsMessageType(map[string]string{ParamWsMessageType: "ping"}); err == nil {
+		t.Fatal("Expect error for unknown message type")
+	}
+}
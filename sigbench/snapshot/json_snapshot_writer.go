@@ -19,12 +19,14 @@ func NewJsonSnapshotWriter(filename string) *JsonSnapshotWriter {
 type JsonSnapshotCountersRow struct {
 	Time     int64
 	Counters map[string]int64
+	Phases   map[string]map[string]int64 `json:",omitempty"`
 }
 
-func (w *JsonSnapshotWriter) WriteCounters(now time.Time, counters map[string]int64) error {
+func (w *JsonSnapshotWriter) WriteCounters(now time.Time, counters map[string]int64, phases map[string]map[string]int64) error {
 	row := &JsonSnapshotCountersRow{
 		Time:     now.Unix(),
 		Counters: counters,
+		Phases:   phases,
 	}
 	data, err := json.Marshal(row)
 	if err != nil {
@@ -3,5 +3,5 @@ package snapshot
 import "time"
 
 type SnapshotWriter interface {
-	WriteCounters(now time.Time, counters map[string]int64) error
+	WriteCounters(now time.Time, counters map[string]int64, phases map[string]map[string]int64) error
 }